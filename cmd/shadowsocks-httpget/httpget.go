@@ -27,7 +27,7 @@ var config struct {
 	// nsec   int
 }
 
-var debug ss.DebugLog
+var debug bool
 
 func doOneRequest(client *http.Client, uri string, buf []byte) (err error) {
 	resp, err := client.Get(uri)
@@ -38,7 +38,7 @@ func doOneRequest(client *http.Client, uri string, buf []byte) (err error) {
 	for err == nil {
 		_, err = resp.Body.Read(buf)
 		if debug {
-			debug.Println(string(buf))
+			fmt.Println(string(buf))
 		}
 	}
 	if err != io.EOF {
@@ -81,11 +81,11 @@ func main() {
 	flag.IntVar(&config.port, "p", 0, "server:port")
 	flag.IntVar(&config.core, "core", 1, "number of CPU cores to use")
 	flag.StringVar(&config.passwd, "k", "", "password")
-	flag.StringVar(&config.method, "m", "", "encryption method, use empty string or rc4")
+	flag.StringVar(&config.method, "m", "", ss.CipherMethodUsage())
 	flag.IntVar(&config.nconn, "nc", 1, "number of connection to server")
 	flag.IntVar(&config.nreq, "nr", 1, "number of request for each connection")
 	// flag.IntVar(&config.nsec, "ns", 0, "run how many seconds for each connection")
-	flag.BoolVar((*bool)(&debug), "d", false, "print http response body for debugging")
+	flag.BoolVar(&debug, "d", false, "print http response body for debugging")
 
 	flag.Parse()
 
@@ -94,6 +94,13 @@ func main() {
 		os.Exit(1)
 	}
 
+	passwd, err := ss.ResolveSecret(config.passwd)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	config.passwd = passwd
+
 	runtime.GOMAXPROCS(config.core)
 	uri := flag.Arg(0)
 	if strings.HasPrefix(uri, "https://") {
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+func main() {
+	var method string
+	var printVer bool
+
+	flag.BoolVar(&printVer, "version", false, "print version")
+	flag.StringVar(&method, "m", "", ss.CipherMethodUsage())
+	flag.Parse()
+
+	if printVer {
+		ss.PrintVersion()
+		os.Exit(0)
+	}
+
+	key, err := ss.GenerateKey(method)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(key)
+}
@@ -0,0 +1,142 @@
+#!/usr/bin/env python3
+"""Generates shadowsocks/testdata/cipher_kat.json, the known answers of the
+stream ciphers, the way the Python reference implementation encrypts: with
+OpenSSL and libsodium through ctypes, and its own rc4-md5 and table ciphers.
+
+    python3 script/cipher_kat.py > shadowsocks/testdata/cipher_kat.json
+"""
+
+import hashlib
+import json
+import struct
+from ctypes import CDLL, byref, c_char_p, c_int, c_uint32, c_ulonglong, \
+    c_void_p, create_string_buffer
+from ctypes.util import find_library
+
+PASSWORD = b'foobar!'
+PLAINTEXT = (b"Don't tell me the moon is shining; "
+             b"show me the glint of light on broken glass.")
+
+libcrypto = CDLL(find_library('crypto'))
+libcrypto.EVP_get_cipherbyname.restype = c_void_p
+libcrypto.EVP_CIPHER_CTX_new.restype = c_void_p
+libcrypto.EVP_CipherInit_ex.argtypes = (c_void_p, c_void_p, c_char_p,
+                                        c_char_p, c_char_p, c_int)
+libcrypto.EVP_CipherUpdate.argtypes = (c_void_p, c_void_p, c_void_p,
+                                       c_char_p, c_int)
+libcrypto.EVP_CIPHER_CTX_free.argtypes = (c_void_p,)
+if hasattr(libcrypto, 'OSSL_PROVIDER_load'):
+    # bf, cast5, des and rc4 moved to the legacy provider in OpenSSL 3
+    libcrypto.OSSL_PROVIDER_load.restype = c_void_p
+    libcrypto.OSSL_PROVIDER_load(None, b'legacy')
+    libcrypto.OSSL_PROVIDER_load(None, b'default')
+
+libsodium = CDLL(find_library('sodium'))
+for f in ('crypto_stream_salsa20_xor_ic', 'crypto_stream_chacha20_xor_ic'):
+    getattr(libsodium, f).argtypes = (c_void_p, c_char_p, c_ulonglong,
+                                      c_char_p, c_ulonglong, c_char_p)
+libsodium.crypto_stream_chacha20_ietf_xor_ic.argtypes = (
+    c_void_p, c_char_p, c_ulonglong, c_char_p, c_uint32, c_char_p)
+
+
+def evp_bytes_to_key(password, key_len, iv_len):
+    m = []
+    i = 0
+    while len(b''.join(m)) < (key_len + iv_len):
+        data = password
+        if i > 0:
+            data = m[i - 1] + password
+        m.append(hashlib.md5(data).digest())
+        i += 1
+    ms = b''.join(m)
+    return ms[:key_len]
+
+
+def openssl(name, key, iv, data):
+    cipher = libcrypto.EVP_get_cipherbyname(name.encode())
+    assert cipher, name
+    ctx = libcrypto.EVP_CIPHER_CTX_new()
+    assert libcrypto.EVP_CipherInit_ex(ctx, cipher, None, key, iv or None, 1)
+    out = create_string_buffer(len(data))
+    out_len = c_int(0)
+    libcrypto.EVP_CipherUpdate(ctx, out, byref(out_len), data, len(data))
+    libcrypto.EVP_CIPHER_CTX_free(ctx)
+    return out.raw[:out_len.value]
+
+
+def sodium(name, key, iv, data):
+    out = create_string_buffer(len(data))
+    getattr(libsodium, 'crypto_stream_%s_xor_ic' % name)(
+        out, data, len(data), iv, 0, key)
+    return out.raw
+
+
+def rc4_md5(key, iv, data):
+    return openssl('rc4', hashlib.md5(key + iv).digest(), b'', data)
+
+
+def get_table(key):
+    a, b = struct.unpack('<QQ', hashlib.md5(key).digest())
+    table = list(range(256))
+    for i in range(1, 1024):
+        table.sort(key=lambda x: int(a % (x + i)))
+    return bytes(table)
+
+
+def table(key, iv, data):
+    return data.translate(get_table(key))
+
+
+def openssl_cipher(name):
+    return lambda key, iv, data: openssl(name, key, iv, data)
+
+
+def sodium_cipher(name):
+    return lambda key, iv, data: sodium(name, key, iv, data)
+
+
+# method: (key length, iv length, encrypt)
+ciphers = {
+    'aes-128-cfb': (16, 16, openssl_cipher('aes-128-cfb')),
+    'aes-192-cfb': (24, 16, openssl_cipher('aes-192-cfb')),
+    'aes-256-cfb': (32, 16, openssl_cipher('aes-256-cfb')),
+    'aes-128-ctr': (16, 16, openssl_cipher('aes-128-ctr')),
+    'aes-192-ctr': (24, 16, openssl_cipher('aes-192-ctr')),
+    'aes-256-ctr': (32, 16, openssl_cipher('aes-256-ctr')),
+    'camellia-128-cfb': (16, 16, openssl_cipher('camellia-128-cfb')),
+    'camellia-192-cfb': (24, 16, openssl_cipher('camellia-192-cfb')),
+    'camellia-256-cfb': (32, 16, openssl_cipher('camellia-256-cfb')),
+    'bf-cfb': (16, 8, openssl_cipher('bf-cfb')),
+    'cast5-cfb': (16, 8, openssl_cipher('cast5-cfb')),
+    'des-cfb': (8, 8, openssl_cipher('des-cfb')),
+    'rc4': (16, 0, openssl_cipher('rc4')),
+    'rc4-md5': (16, 16, rc4_md5),
+    'rc4-md5-6': (16, 6, rc4_md5),
+    'chacha20': (32, 8, sodium_cipher('chacha20')),
+    'chacha20-ietf': (32, 12, sodium_cipher('chacha20_ietf')),
+    'salsa20': (32, 8, sodium_cipher('salsa20')),
+    'table': (0, 0, table),
+}
+
+
+def main():
+    vectors = []
+    for method in sorted(ciphers):
+        key_len, iv_len, encrypt = ciphers[method]
+        if key_len > 0:
+            key = evp_bytes_to_key(PASSWORD, key_len, iv_len)
+        else:
+            key = PASSWORD
+        iv = bytes(range(1, iv_len + 1))
+        vectors.append({
+            'method': method,
+            'password': PASSWORD.decode(),
+            'iv': iv.hex(),
+            'plaintext': PLAINTEXT.decode(),
+            'ciphertext': encrypt(key, iv, PLAINTEXT).hex(),
+        })
+    print(json.dumps(vectors, indent=2))
+
+
+if __name__ == '__main__':
+    main()
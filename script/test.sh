@@ -108,6 +108,9 @@ test_server_local_pair() {
     test_shadowsocks $url bf-cfb
     test_shadowsocks $url des-cfb
     test_shadowsocks $url cast5-cfb
+    test_shadowsocks $url camellia-128-cfb
+    test_shadowsocks $url rc4
+    test_shadowsocks $url table
     test_shadowsocks $url chacha20
     test_shadowsocks $url salsa20
 }
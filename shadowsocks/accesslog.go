@@ -0,0 +1,217 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// AccessLogConfig is the "access_log" section of the server config. The
+// access log is disabled if neither file nor syslog is set.
+type AccessLogConfig struct {
+	File string `json:"file"`
+	// "json" for JSON lines (default), or a text/template executed with an
+	// AccessRecord, e.g. "{{.End.Unix}} {{.Client}} {{.Destination}}".
+	Format     string `json:"format"`
+	MaxSize    int    `json:"max_size"`    // MB, 0 to never rotate
+	MaxBackups int    `json:"max_backups"` // default 3
+	// "local" for the local syslog daemon, or udp://host:port or
+	// tcp://host:port for a remote one.
+	Syslog string `json:"syslog"`
+}
+
+// AccessRecord describes a finished TCP session or UDP NAT entry.
+type AccessRecord struct {
+	ID      string    `json:"id"`
+	Network string    `json:"network"` // tcp or udp
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	// The port, or the user of the obfs server.
+	Port string `json:"port"`
+	// Anonymized if sanitizing is enabled, see LogConfig.
+	Client string `json:"client"`
+	// For udp, the destination of the first datagram.
+	Destination string `json:"destination"`
+	BytesUp     int64  `json:"bytes_up"`   // from the client
+	BytesDown   int64  `json:"bytes_down"` // to the client
+	CloseReason string `json:"close_reason"`
+}
+
+// Duration returns how long the session lasted.
+func (r *AccessRecord) Duration() time.Duration {
+	return r.End.Sub(r.Start)
+}
+
+// NewConnID returns a random id for a connection.
+func NewConnID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// AccessLog writes a record for each session. The zero value and a nil
+// *AccessLog write nothing. It's safe for concurrent use and can be reloaded
+// while in use.
+type AccessLog struct {
+	sync.RWMutex
+	tmpl    *template.Template // nil for json
+	writers []io.WriteCloser
+}
+
+// NewAccessLog creates an AccessLog from config.
+func NewAccessLog(config *AccessLogConfig) (*AccessLog, error) {
+	a := &AccessLog{}
+	if err := a.Load(config); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Load replaces the settings and reopens the outputs. The old settings are
+// kept on error.
+func (a *AccessLog) Load(config *AccessLogConfig) error {
+	var tmpl *template.Template
+	var writers []io.WriteCloser
+	if config != nil {
+		if config.Format != "" && config.Format != "json" {
+			var err error
+			tmpl, err = template.New("access_log").Parse(config.Format)
+			if err != nil {
+				return errors.New("shadowsocks: access log format: " + err.Error())
+			}
+		}
+		closeAll := func() {
+			for _, w := range writers {
+				w.Close()
+			}
+		}
+		if config.File != "" {
+			w, err := newRotateWriter(config.File, int64(config.MaxSize)<<20, config.MaxBackups)
+			if err != nil {
+				return err
+			}
+			writers = append(writers, w)
+		}
+		if config.Syslog != "" {
+			network, addr := "", ""
+			if config.Syslog != "local" {
+				parts := strings.SplitN(config.Syslog, "://", 2)
+				if len(parts) != 2 || (parts[0] != "udp" && parts[0] != "tcp") || parts[1] == "" {
+					closeAll()
+					return errors.New("shadowsocks: access log syslog should be local, udp://host:port or tcp://host:port")
+				}
+				network, addr = parts[0], parts[1]
+			}
+			w, err := dialSyslog(network, addr)
+			if err != nil {
+				closeAll()
+				return err
+			}
+			writers = append(writers, w)
+		}
+	}
+	a.Lock()
+	old := a.writers
+	a.tmpl, a.writers = tmpl, writers
+	a.Unlock()
+	for _, w := range old {
+		w.Close()
+	}
+	return nil
+}
+
+// Enabled reports whether records are written.
+func (a *AccessLog) Enabled() bool {
+	if a == nil {
+		return false
+	}
+	a.RLock()
+	defer a.RUnlock()
+	return len(a.writers) > 0
+}
+
+// Log writes r, anonymizing the client address if sanitizing is enabled.
+func (a *AccessLog) Log(r *AccessRecord) {
+	if !a.Enabled() {
+		return
+	}
+	rec := *r
+	logState.RLock()
+	if logState.sanitize {
+		rec.Client = "x.x.x.x:zzzz"
+	}
+	logState.RUnlock()
+
+	a.RLock()
+	defer a.RUnlock()
+	var buf bytes.Buffer
+	if a.tmpl == nil {
+		json.NewEncoder(&buf).Encode(&rec)
+	} else {
+		if err := a.tmpl.Execute(&buf, &rec); err != nil {
+			mainLog.Error("error formatting access log record", Err(err))
+			return
+		}
+		if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+	}
+	for _, w := range a.writers {
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			mainLog.Error("error writing access log", Err(err))
+		}
+	}
+}
+
+// CloseReason describes why a pipe stopped. side is the peer read from or
+// written to. Error details are left out, as they may contain addresses.
+func CloseReason(side string, err error) string {
+	if err == nil || err == io.EOF {
+		return side + " closed"
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return side + " timeout"
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return side + " reset"
+	}
+	return side + " error"
+}
+
+// Relay copies data between client and remote until either side stops, then
+// closes both. It returns the bytes copied in each direction and the reason
+// the session ended. addTraffic maybe nil.
+func Relay(client, remote net.Conn, addTraffic func(int)) (up, down int64, reason string) {
+	reasons := make(chan string, 2)
+	copyHalf := func(src, dst net.Conn, srcSide, dstSide string, n *int64) {
+		defer dst.Close()
+		readErr, writeErr := pipe(src, dst, func(c int) {
+			atomic.AddInt64(n, int64(c))
+			if addTraffic != nil {
+				addTraffic(c)
+			}
+		})
+		if writeErr != nil {
+			reasons <- CloseReason(dstSide, writeErr)
+		} else {
+			reasons <- CloseReason(srcSide, readErr)
+		}
+	}
+	go copyHalf(client, remote, "client", "remote", &up)
+	go copyHalf(remote, client, "remote", "client", &down)
+	// the first side to stop ends the session, the other one fails after
+	// its connection is closed
+	reason = <-reasons
+	<-reasons
+	return atomic.LoadInt64(&up), atomic.LoadInt64(&down), reason
+}
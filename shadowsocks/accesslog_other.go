@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package shadowsocks
+
+import (
+	"errors"
+	"io"
+)
+
+func dialSyslog(network, addr string) (io.WriteCloser, error) {
+	return nil, errors.New("shadowsocks: syslog is not supported on this platform")
+}
@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package shadowsocks
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// dialSyslog connects to the syslog daemon, the local one if network is
+// empty.
+func dialSyslog(network, addr string) (io.WriteCloser, error) {
+	return syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "shadowsocks")
+}
@@ -0,0 +1,119 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRelay(t *testing.T) {
+	client, clientPeer := net.Pipe()
+	remote, remotePeer := net.Pipe()
+	var traffic int64
+	done := make(chan struct{})
+	var up, down int64
+	var reason string
+	go func() {
+		up, down, reason = Relay(clientPeer, remote, func(n int) { atomic.AddInt64(&traffic, int64(n)) })
+		close(done)
+	}()
+
+	go io.WriteString(client, "request")
+	buf := make([]byte, 16)
+	n, _ := io.ReadFull(remotePeer, buf[:7])
+	if string(buf[:n]) != "request" {
+		t.Fatalf("remote got %q", buf[:n])
+	}
+	go io.WriteString(remotePeer, "response!")
+	if n, _ = io.ReadFull(client, buf[:9]); string(buf[:n]) != "response!" {
+		t.Fatalf("client got %q", buf[:n])
+	}
+	remotePeer.Close()
+	<-done
+	if up != 7 || down != 9 || traffic != 16 {
+		t.Errorf("got up %d down %d traffic %d", up, down, traffic)
+	}
+	if reason != "remote closed" {
+		t.Errorf("got close reason %q", reason)
+	}
+	// the client is closed too
+	if _, err := client.Read(buf); err == nil {
+		t.Error("client should be closed")
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "access.log")
+	rec := &AccessRecord{
+		ID:          "0123456789abcdef",
+		Network:     "tcp",
+		Start:       time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC),
+		End:         time.Date(2017, 1, 2, 3, 4, 7, 0, time.UTC),
+		Port:        "8388",
+		Client:      "192.0.2.1:12345",
+		Destination: "example.com:443",
+		BytesUp:     100,
+		BytesDown:   2000,
+		CloseReason: "client closed",
+	}
+
+	var a *AccessLog
+	a.Log(rec) // nil is disabled
+
+	a, err = NewAccessLog(&AccessLogConfig{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Log(rec)
+	SetupLog(&LogConfig{Sanitize: true})
+	a.Log(rec)
+	SetupLog(nil)
+
+	if err := a.Load(&AccessLogConfig{File: file, Format: "{{.ID}} {{.Client}} {{.Destination}} {{.Duration}}"}); err != nil {
+		t.Fatal(err)
+	}
+	a.Log(rec)
+	a.Load(nil)
+	a.Log(rec)
+
+	data, _ := ioutil.ReadFile(file)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got lines %q", lines)
+	}
+	var got AccessRecord
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != *rec {
+		t.Errorf("json record got %+v", got)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &got); err != nil || got.Client != "x.x.x.x:zzzz" {
+		t.Errorf("client should be sanitized, got %q", got.Client)
+	}
+	if lines[2] != "0123456789abcdef 192.0.2.1:12345 example.com:443 2s" {
+		t.Errorf("template record got %q", lines[2])
+	}
+
+	for _, config := range []*AccessLogConfig{
+		{File: file, Format: "{{.NoSuchField"},
+		{Syslog: "http://127.0.0.1:514"},
+		{File: filepath.Join(dir, "no", "such", "dir")},
+	} {
+		if err := a.Load(config); err == nil {
+			t.Errorf("%+v should be invalid", config)
+		}
+	}
+}
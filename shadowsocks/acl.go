@@ -0,0 +1,267 @@
+package shadowsocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ACLConfig is the "acl" section of the server config, restricting the
+// destinations clients can reach through the server.
+//
+// Deny rules and the block_private preset are checked against the destination
+// name and, after resolving it, against every address it resolves to. Allow
+// rules are exceptions to them: an address in allow_cidr is reachable even if
+// it's private or in deny_cidr, and a name in allow_domain is reachable
+// whatever it resolves to. Blocked ports are always denied.
+type ACLConfig struct {
+	BlockPrivate bool     `json:"block_private"` // loopback, private, link-local etc.
+	AllowCIDR    []string `json:"allow_cidr"`
+	DenyCIDR     []string `json:"deny_cidr"`
+	AllowDomain  []string `json:"allow_domain"` // matches the domain and its subdomains
+	DenyDomain   []string `json:"deny_domain"`
+	BlockPorts   []int    `json:"block_ports"`
+}
+
+// Address ranges blocked by the block_private preset.
+var privateCIDRs = []string{
+	"0.0.0.0/8",      // "this" network, 0.0.0.0 connects to localhost
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, including cloud metadata services
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, including broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+}
+
+// ACLError is returned for destinations denied by the ACL.
+type ACLError struct {
+	Host   string
+	Reason string
+}
+
+func (e *ACLError) Error() string {
+	return fmt.Sprintf("shadowsocks: %s denied by acl: %s", e.Host, e.Reason)
+}
+
+// IsACLDenied reports whether err is caused by the ACL.
+func IsACLDenied(err error) bool {
+	_, ok := err.(*ACLError)
+	return ok
+}
+
+type aclRules struct {
+	allowNet    []*net.IPNet
+	denyNet     []*net.IPNet
+	privateNet  []*net.IPNet
+	allowDomain []string
+	denyDomain  []string
+	blockPort   map[int]bool
+}
+
+// ACL checks outbound destinations. The zero value and a nil *ACL allow
+// everything. It's safe for concurrent use and can be reloaded while in use.
+type ACL struct {
+	sync.RWMutex
+	rules *aclRules
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			// single address
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("shadowsocks: acl: %v", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func normalizeDomains(list []string) []string {
+	domains := make([]string, len(list))
+	for i, d := range list {
+		domains[i] = strings.ToLower(strings.Trim(d, "."))
+	}
+	return domains
+}
+
+// NewACL creates an ACL from config, a nil config allows everything.
+func NewACL(config *ACLConfig) (*ACL, error) {
+	a := &ACL{}
+	if err := a.Load(config); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Load replaces the rules of the ACL. The old rules are kept on error.
+func (a *ACL) Load(config *ACLConfig) error {
+	var rules *aclRules
+	if config != nil {
+		var err error
+		rules = &aclRules{
+			allowDomain: normalizeDomains(config.AllowDomain),
+			denyDomain:  normalizeDomains(config.DenyDomain),
+			blockPort:   map[int]bool{},
+		}
+		if rules.allowNet, err = parseCIDRs(config.AllowCIDR); err != nil {
+			return err
+		}
+		if rules.denyNet, err = parseCIDRs(config.DenyCIDR); err != nil {
+			return err
+		}
+		if config.BlockPrivate {
+			rules.privateNet, _ = parseCIDRs(privateCIDRs)
+		}
+		for _, p := range config.BlockPorts {
+			rules.blockPort[p] = true
+		}
+	}
+	a.Lock()
+	a.rules = rules
+	a.Unlock()
+	return nil
+}
+
+func (a *ACL) getRules() *aclRules {
+	if a == nil {
+		return nil
+	}
+	a.RLock()
+	defer a.RUnlock()
+	return a.rules
+}
+
+func domainMatch(list []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range list {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func netMatch(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckHost checks the destination before resolving it. host maybe a domain
+// name or an IP address. If the returned exempt is true, the addresses the
+// name resolves to need no further check.
+func (a *ACL) CheckHost(host string, port int) (exempt bool, err error) {
+	r := a.getRules()
+	if r == nil {
+		return true, nil
+	}
+	if r.blockPort[port] {
+		return false, &ACLError{net.JoinHostPort(host, strconv.Itoa(port)), "port blocked"}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return false, a.CheckIP(ip, port)
+	}
+	if domainMatch(r.allowDomain, host) {
+		return true, nil
+	}
+	if domainMatch(r.denyDomain, host) {
+		return false, &ACLError{host, "domain denied"}
+	}
+	return false, nil
+}
+
+// CheckIP checks a resolved destination address.
+func (a *ACL) CheckIP(ip net.IP, port int) error {
+	r := a.getRules()
+	if r == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		// also catches IPv4-mapped IPv6 addresses like ::ffff:127.0.0.1
+		ip = ip4
+	}
+	if r.blockPort[port] {
+		return &ACLError{net.JoinHostPort(ip.String(), strconv.Itoa(port)), "port blocked"}
+	}
+	if netMatch(r.allowNet, ip) {
+		return nil
+	}
+	if netMatch(r.denyNet, ip) {
+		return &ACLError{ip.String(), "address denied"}
+	}
+	if netMatch(r.privateNet, ip) {
+		return &ACLError{ip.String(), "private address"}
+	}
+	return nil
+}
+
+// Resolve checks addr, given as host:port, against the ACL and returns the
+// addresses it resolves to with r that are allowed. It returns an *ACLError
+// if no address is allowed.
+func (a *ACL) Resolve(r *Resolver, addr string) (ips []net.IP, port int, err error) {
+	return a.ResolveContext(context.Background(), r, addr)
+}
+
+// ResolveContext is Resolve giving up resolving when ctx is done.
+func (a *ACL) ResolveContext(ctx context.Context, r *Resolver, addr string) (ips []net.IP, port int, err error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	if port, err = strconv.Atoi(portStr); err != nil {
+		return
+	}
+	exempt, err := a.CheckHost(host, port)
+	if err != nil {
+		return
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, port, nil
+	}
+	all, err := r.LookupIPContext(ctx, host)
+	if err != nil {
+		return
+	}
+	if exempt {
+		return all, port, nil
+	}
+	for _, ip := range all {
+		if err = a.CheckIP(ip, port); err == nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		reason := "no address"
+		if err != nil {
+			// report the denial of the last address
+			reason = err.(*ACLError).Reason
+		}
+		return nil, port, &ACLError{host, reason}
+	}
+	return ips, port, nil
+}
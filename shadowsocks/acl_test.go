@@ -0,0 +1,98 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestACLNil(t *testing.T) {
+	var a *ACL
+	if exempt, err := a.CheckHost("127.0.0.1", 22); err != nil || !exempt {
+		t.Error("nil acl should allow everything")
+	}
+	if err := a.CheckIP(net.ParseIP("127.0.0.1"), 22); err != nil {
+		t.Error("nil acl should allow everything")
+	}
+}
+
+func TestACLCheck(t *testing.T) {
+	a, err := NewACL(&ACLConfig{
+		BlockPrivate: true,
+		AllowCIDR:    []string{"10.1.0.0/16", "192.168.1.1"},
+		DenyCIDR:     []string{"8.8.4.0/24"},
+		AllowDomain:  []string{"intranet.example.com"},
+		DenyDomain:   []string{".blocked.com"},
+		BlockPorts:   []int{25},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ipTests := []struct {
+		ip      string
+		port    int
+		allowed bool
+	}{
+		{"8.8.8.8", 53, true},
+		{"8.8.8.8", 25, false},
+		{"8.8.4.4", 53, false},
+		{"127.0.0.1", 80, false},
+		{"::ffff:127.0.0.1", 80, false},
+		{"0.0.0.0", 80, false},
+		{"169.254.169.254", 80, false},
+		{"10.0.0.1", 80, false},
+		{"10.1.2.3", 80, true},
+		{"10.1.2.3", 25, false},
+		{"192.168.1.1", 80, true},
+		{"192.168.1.2", 80, false},
+		{"::1", 80, false},
+		{"fe80::1", 80, false},
+		{"2001:4860:4860::8888", 443, true},
+	}
+	for _, tt := range ipTests {
+		err := a.CheckIP(net.ParseIP(tt.ip), tt.port)
+		if (err == nil) != tt.allowed {
+			t.Errorf("CheckIP(%s, %d) = %v, allowed should be %v", tt.ip, tt.port, err, tt.allowed)
+		}
+		if err != nil && !IsACLDenied(err) {
+			t.Errorf("CheckIP(%s, %d) returned %T, should be *ACLError", tt.ip, tt.port, err)
+		}
+	}
+
+	hostTests := []struct {
+		host    string
+		port    int
+		exempt  bool
+		allowed bool
+	}{
+		{"www.example.com", 443, false, true},
+		{"blocked.com", 443, false, false},
+		{"WWW.Blocked.COM.", 443, false, false},
+		{"notblocked.com", 443, false, true},
+		{"intranet.example.com", 80, true, true},
+		{"db.intranet.example.com", 80, true, true},
+		{"intranet.example.com", 25, false, false},
+		{"127.0.0.1", 80, false, false},
+	}
+	for _, tt := range hostTests {
+		exempt, err := a.CheckHost(tt.host, tt.port)
+		if (err == nil) != tt.allowed || exempt != tt.exempt {
+			t.Errorf("CheckHost(%s, %d) = %v, %v, should be exempt %v, allowed %v",
+				tt.host, tt.port, exempt, err, tt.exempt, tt.allowed)
+		}
+	}
+}
+
+func TestACLLoadError(t *testing.T) {
+	a, err := NewACL(&ACLConfig{BlockPrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Load(&ACLConfig{DenyCIDR: []string{"not a cidr"}}); err == nil {
+		t.Error("should fail on invalid cidr")
+	}
+	// old rules are kept
+	if a.CheckIP(net.ParseIP("127.0.0.1"), 80) == nil {
+		t.Error("old rules should be kept after load error")
+	}
+}
@@ -0,0 +1,211 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// AEAD ciphers frame the tcp stream in chunks of an encrypted 2 bytes length
+// followed by the encrypted payload, each with its tag. The subkey of each
+// direction is derived from the key and a random salt sent first, the nonce
+// counts the sealed messages. Udp packets are the salt and the encrypted
+// payload with a zero nonce.
+
+const maxChunkSize = 0x3fff
+
+var errAEADAuth = errors.New("shadowsocks: message authentication failed")
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *Cipher) isAEAD() bool {
+	return c.info.newAEAD != nil
+}
+
+func (c *Cipher) newAEAD(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, c.info.keyLen)
+	r := hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey"))
+	if _, err := io.ReadFull(r, subkey); err != nil {
+		return nil, err
+	}
+	return c.info.newAEAD(subkey)
+}
+
+// initEncryptAEAD returns a new random salt. Unlike the iv of stream
+// ciphers, the salt received is never reused to send.
+func (c *Cipher) initEncryptAEAD() (salt []byte, err error) {
+	salt = make([]byte, c.info.ivLen)
+	if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	if c.aeadEnc, err = c.newAEAD(salt); err != nil {
+		return nil, err
+	}
+	c.encNonce = make([]byte, c.aeadEnc.NonceSize())
+	return salt, nil
+}
+
+func (c *Cipher) initDecryptAEAD(salt []byte) (err error) {
+	if c.aeadDec, err = c.newAEAD(salt); err != nil {
+		return
+	}
+	c.decNonce = make([]byte, c.aeadDec.NonceSize())
+	return
+}
+
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (c *Cipher) seal(dst, plaintext []byte) []byte {
+	dst = c.aeadEnc.Seal(dst, c.encNonce, plaintext, nil)
+	increment(c.encNonce)
+	return dst
+}
+
+func (c *Cipher) open(dst, ciphertext []byte) ([]byte, error) {
+	dst, err := c.aeadDec.Open(dst, c.decNonce, ciphertext, nil)
+	if err != nil {
+		return nil, errAEADAuth
+	}
+	increment(c.decNonce)
+	return dst, nil
+}
+
+// readAEAD returns the data left of the last chunk, or reads the next one.
+func (c *Conn) readAEAD(b []byte) (n int, err error) {
+	if len(c.pending) > 0 {
+		n = copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return
+	}
+	if c.aeadDec == nil {
+		salt := make([]byte, c.info.ivLen)
+		if _, err = io.ReadFull(c.Conn, salt); err != nil {
+			return
+		}
+		if err = c.initDecryptAEAD(salt); err != nil {
+			return
+		}
+		if len(c.iv) == 0 {
+			c.iv = salt
+		}
+	}
+	overhead := c.aeadDec.Overhead()
+	if c.chunk == nil {
+		c.chunk = make([]byte, maxChunkSize+overhead)
+	}
+	buf := c.chunk[:2+overhead]
+	if _, err = io.ReadFull(c.Conn, buf); err != nil {
+		return
+	}
+	if _, err = c.open(buf[:0], buf); err != nil {
+		return
+	}
+	size := int(binary.BigEndian.Uint16(buf) & maxChunkSize)
+	buf = c.chunk[:size+overhead]
+	if _, err = io.ReadFull(c.Conn, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	payload, err := c.open(buf[:0], buf)
+	if err != nil {
+		return
+	}
+	n = copy(b, payload)
+	c.pending = payload[n:]
+	return
+}
+
+// writeAEAD seals b in chunks and sends them, after the salt if it's the
+// first write, with a single write.
+func (c *Conn) writeAEAD(b []byte) (n int, err error) {
+	var salt []byte
+	if c.aeadEnc == nil {
+		if salt, err = c.initEncryptAEAD(); err != nil {
+			return
+		}
+	}
+	overhead := c.aeadEnc.Overhead()
+	chunks := (len(b) + maxChunkSize - 1) / maxChunkSize
+	size := len(salt) + len(b) + chunks*(2+2*overhead)
+	cipherData := c.writeBuf
+	if size > cap(cipherData) {
+		cipherData = make([]byte, 0, size)
+	}
+	cipherData = append(cipherData[:0], salt...)
+	var length [2]byte
+	for p := b; len(p) > 0; {
+		chunk := p
+		if len(chunk) > maxChunkSize {
+			chunk = chunk[:maxChunkSize]
+		}
+		p = p[len(chunk):]
+		binary.BigEndian.PutUint16(length[:], uint16(len(chunk)))
+		cipherData = c.seal(cipherData, length[:])
+		cipherData = c.seal(cipherData, chunk)
+	}
+	if _, err = c.Conn.Write(cipherData); err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+func (c *SecurePacketConn) readFromAEAD(b []byte) (n int, src net.Addr, err error) {
+	buf := make([]byte, maxPacketSize)
+	n, src, err = c.PacketConn.ReadFrom(buf)
+	if err != nil {
+		return
+	}
+	saltLen := c.info.ivLen
+	if n < saltLen {
+		return 0, nil, errPacketTooSmall
+	}
+	cipher := c.Copy()
+	if err = cipher.initDecryptAEAD(buf[:saltLen]); err != nil {
+		return
+	}
+	payload, err := cipher.open(buf[saltLen:saltLen], buf[saltLen:n])
+	if err != nil {
+		return 0, nil, err
+	}
+	n = copy(b, payload)
+	if n < len(payload) {
+		err = errBufferTooSmall // just a warning
+	}
+	return
+}
+
+func (c *SecurePacketConn) writeToAEAD(b []byte, dst net.Addr) (n int, err error) {
+	cipher := c.Copy()
+	salt, err := cipher.initEncryptAEAD()
+	if err != nil {
+		return
+	}
+	cipherData := make([]byte, len(salt), len(salt)+len(b)+cipher.aeadEnc.Overhead())
+	copy(cipherData, salt)
+	if _, err = c.PacketConn.WriteTo(cipher.seal(cipherData, b), dst); err != nil {
+		return
+	}
+	return len(b), nil
+}
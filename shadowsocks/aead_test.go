@@ -0,0 +1,111 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAEADConn(t *testing.T) {
+	// larger than a chunk
+	msg := bytes.Repeat([]byte(text), 2*maxChunkSize/len(text))
+	for _, method := range []string{"aes-128-gcm", "aes-192-gcm", "aes-256-gcm", "chacha20-ietf-poly1305"} {
+		cipher, err := NewCipher(method, "foobar")
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		a, b := net.Pipe()
+		client, server := NewConn(a, cipher.Copy()), NewConn(b, cipher.Copy())
+		go func() {
+			client.Write(msg)
+			client.Write([]byte("end"))
+		}()
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, len(msg)+3)
+		if _, err = io.ReadFull(server, buf); err != nil {
+			t.Fatal(method, err)
+		}
+		if !bytes.Equal(buf[:len(msg)], msg) || string(buf[len(msg):]) != "end" {
+			t.Error(method, "got different data")
+		}
+
+		// the reply has a salt of its own
+		go server.Write([]byte("reply"))
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		buf = make([]byte, 5)
+		if _, err = io.ReadFull(client, buf); err != nil || string(buf) != "reply" {
+			t.Error(method, "reply got", string(buf), err)
+		}
+		if bytes.Equal(client.GetIv(), server.GetIv()) {
+			t.Error(method, "salt reused")
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestAEADConnTampered(t *testing.T) {
+	cipher, _ := NewCipher("aes-128-gcm", "foobar")
+	var buf bytes.Buffer
+	c := NewConn(&fakeConn{Writer: &buf}, cipher.Copy())
+	c.Write([]byte("hello"))
+	data := append([]byte(nil), buf.Bytes()...)
+	data[len(data)-1] ^= 1
+
+	c = NewConn(&fakeConn{Reader: bytes.NewReader(data)}, cipher.Copy())
+	if _, err := c.Read(make([]byte, 5)); err != errAEADAuth {
+		t.Errorf("tampered data got %v", err)
+	}
+	wrong, _ := NewCipher("aes-128-gcm", "barfoo")
+	c = NewConn(&fakeConn{Reader: bytes.NewReader(buf.Bytes())}, wrong)
+	if _, err := c.Read(make([]byte, 5)); err != errAEADAuth {
+		t.Errorf("wrong password got %v", err)
+	}
+}
+
+// fakeConn is a net.Conn reading and writing from buffers.
+type fakeConn struct {
+	net.Conn
+	io.Reader
+	io.Writer
+}
+
+func (c *fakeConn) Read(b []byte) (int, error)  { return c.Reader.Read(b) }
+func (c *fakeConn) Write(b []byte) (int, error) { return c.Writer.Write(b) }
+func (c *fakeConn) Close() error                { return nil }
+
+func TestAEADPacketConn(t *testing.T) {
+	cipher, _ := NewCipher("chacha20-ietf-poly1305", "foobar")
+	a, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa, sb := NewSecurePacketConn(a, cipher.Copy()), NewSecurePacketConn(b, cipher.Copy())
+	defer sa.Close()
+	defer sb.Close()
+
+	if _, err = sa.WriteTo([]byte("hello"), b.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	sb.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 100)
+	n, src, err := sb.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+	if src.String() != a.LocalAddr().String() {
+		t.Errorf("source got %v", src)
+	}
+
+	// not encrypted with the key
+	a.WriteTo(make([]byte, 64), b.LocalAddr())
+	if _, _, err = sb.ReadFrom(buf); err != errAEADAuth {
+		t.Errorf("garbage got %v", err)
+	}
+}
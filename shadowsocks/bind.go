@@ -0,0 +1,216 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ListenConfig is the "listen" section of the server config, where the
+// ports are listened on.
+type ListenConfig struct {
+	// Addresses are the ips or host names each port is listened on, all
+	// the addresses if empty. "unix:/path" listens on a unix socket
+	// instead, with {port} in the path replaced by the port. There's no
+	// udp relay on unix sockets.
+	Addresses []string `json:"addresses"`
+	// IPv6Only sets IPV6_V6ONLY on the ipv6 addresses, so that "::" and
+	// "0.0.0.0" can be listened on separately. Without addresses, the
+	// ports are listened on both as two sockets.
+	IPv6Only bool `json:"ipv6_only"`
+	// ReusePort opens this many sockets with SO_REUSEPORT for each address,
+	// each with its own accept loop, for the kernel to spread the
+	// connections over them. Not supported on all systems.
+	ReusePort int `json:"reuse_port"`
+	// KeepAlive is the keepalive period of the connections accepted, in
+	// seconds, default 15, negative to disable.
+	KeepAlive int `json:"keepalive"`
+	// Socket tunes the sockets listened on and the connections accepted.
+	Socket *SocketConfig `json:"socket"`
+}
+
+const unixAddrPrefix = "unix:"
+
+// bindAddr is an address a port is listened on.
+type bindAddr struct {
+	network string // tcp, tcp4, tcp6 or unix
+	addr    string
+}
+
+// udp returns the network of the udp relay on the address, empty for none.
+func (b bindAddr) udp() string {
+	if b.network == "unix" {
+		return ""
+	}
+	return "udp" + strings.TrimPrefix(b.network, "tcp")
+}
+
+// check checks the addresses and the options, for a config with nports
+// ports.
+func (c *ListenConfig) check(nports int) error {
+	if c == nil {
+		return nil
+	}
+	for _, a := range c.Addresses {
+		if !strings.HasPrefix(a, unixAddrPrefix) {
+			if a == "" || strings.ContainsAny(a, "/ ") {
+				return fmt.Errorf("shadowsocks: listen: invalid address %q", a)
+			}
+			continue
+		}
+		path := a[len(unixAddrPrefix):]
+		if path == "" {
+			return fmt.Errorf("shadowsocks: listen: invalid address %q", a)
+		}
+		if nports > 1 && !strings.Contains(path, "{port}") {
+			return fmt.Errorf("shadowsocks: listen: %s is shared by all the ports, add {port} to the path", a)
+		}
+	}
+	if c.ReusePort < 0 {
+		return errors.New("shadowsocks: listen: negative reuse_port")
+	}
+	if c.ReusePort > 1 {
+		if _, err := reusePort(); err != nil {
+			return err
+		}
+	}
+	return c.Socket.check()
+}
+
+// socket returns the socket options of the connections accepted.
+func (c *ListenConfig) socket() *SocketConfig {
+	if c == nil {
+		return nil
+	}
+	return c.Socket
+}
+
+// bindAddrs returns the addresses to listen on for port.
+func (c *ListenConfig) bindAddrs(port string) []bindAddr {
+	var addrs []string
+	v6only := false
+	if c != nil {
+		addrs, v6only = c.Addresses, c.IPv6Only
+	}
+	if len(addrs) == 0 {
+		if !v6only {
+			return []bindAddr{{"tcp", ":" + port}}
+		}
+		addrs = []string{"0.0.0.0", "::"}
+	}
+	binds := make([]bindAddr, 0, len(addrs))
+	for _, a := range addrs {
+		if strings.HasPrefix(a, unixAddrPrefix) {
+			path := strings.Replace(a[len(unixAddrPrefix):], "{port}", port, -1)
+			binds = append(binds, bindAddr{"unix", path})
+			continue
+		}
+		host := strings.TrimSuffix(strings.TrimPrefix(a, "["), "]")
+		network := "tcp"
+		if ip := net.ParseIP(host); ip != nil {
+			if ip.To4() != nil {
+				network = "tcp4"
+			} else if v6only {
+				network = "tcp6"
+			}
+		}
+		binds = append(binds, bindAddr{network, net.JoinHostPort(host, port)})
+	}
+	return binds
+}
+
+// sockets returns how many sockets to open on b.
+func (c *ListenConfig) sockets(b bindAddr) int {
+	if c == nil || c.ReusePort < 1 || b.network == "unix" {
+		return 1
+	}
+	return c.ReusePort
+}
+
+func (c *ListenConfig) netConfig(b bindAddr) *net.ListenConfig {
+	lc := &net.ListenConfig{}
+	if c == nil || b.network == "unix" {
+		return lc
+	}
+	if c.KeepAlive != 0 {
+		lc.KeepAlive = time.Duration(c.KeepAlive) * time.Second
+	}
+	var reuse func(network, address string, c syscall.RawConn) error
+	if c.sockets(b) > 1 {
+		reuse, _ = reusePort()
+	}
+	control, _ := c.Socket.control(true)
+	lc.Control = chainControl(reuse, control)
+	return lc
+}
+
+// listen listens on the addresses of port, with the sockets inherited from
+// the parent process if any.
+func (c *ListenConfig) listen(port string) ([]net.Listener, error) {
+	var lns []net.Listener
+	for _, b := range c.bindAddrs(port) {
+		for i := 0; i < c.sockets(b); i++ {
+			ln := InheritedListener(strings.TrimRight(b.network, "46"), b.addr)
+			if ln == nil {
+				if b.network == "unix" {
+					removeStaleSocket(b.addr)
+				}
+				var err error
+				if ln, err = c.netConfig(b).Listen(context.Background(), b.network, b.addr); err != nil {
+					for _, ln := range lns {
+						ln.Close()
+					}
+					return nil, err
+				}
+			}
+			lns = append(lns, ln)
+		}
+	}
+	return lns, nil
+}
+
+// listenUDP listens on the udp addresses of port like listen. The
+// addresses failing are logged and skipped.
+func (c *ListenConfig) listenUDP(port string) []*net.UDPConn {
+	var conns []*net.UDPConn
+	for _, b := range c.bindAddrs(port) {
+		network := b.udp()
+		if network == "" {
+			continue
+		}
+		for i := 0; i < c.sockets(b); i++ {
+			conn, ok := InheritedPacketConn("udp", b.addr).(*net.UDPConn)
+			if !ok {
+				pc, err := c.netConfig(b).ListenPacket(context.Background(), network, b.addr)
+				if err != nil {
+					udpLog.Error("error listening udp port", F("port", port), F("addr", b.addr), Err(err))
+					break
+				}
+				conn = pc.(*net.UDPConn)
+			}
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+// removeStaleSocket removes the unix socket at path left by a process gone
+// without closing it, so it can be listened on again. A socket accepting
+// connections is kept.
+func removeStaleSocket(path string) {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return
+	}
+	mainLog.Info("removing stale unix socket", F("path", path))
+	os.Remove(path)
+}
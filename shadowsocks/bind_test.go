@@ -0,0 +1,124 @@
+package shadowsocks
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListenConfigBindAddrs(t *testing.T) {
+	tests := []struct {
+		config *ListenConfig
+		want   []bindAddr
+	}{
+		{nil, []bindAddr{{"tcp", ":8388"}}},
+		{&ListenConfig{}, []bindAddr{{"tcp", ":8388"}}},
+		{&ListenConfig{IPv6Only: true}, []bindAddr{{"tcp4", "0.0.0.0:8388"}, {"tcp6", "[::]:8388"}}},
+		{&ListenConfig{Addresses: []string{"127.0.0.1", "[::1]", "localhost"}},
+			[]bindAddr{{"tcp4", "127.0.0.1:8388"}, {"tcp", "[::1]:8388"}, {"tcp", "localhost:8388"}}},
+		{&ListenConfig{Addresses: []string{"::1"}, IPv6Only: true}, []bindAddr{{"tcp6", "[::1]:8388"}}},
+		{&ListenConfig{Addresses: []string{"unix:/run/ss-{port}.sock"}}, []bindAddr{{"unix", "/run/ss-8388.sock"}}},
+	}
+	for _, tt := range tests {
+		if got := tt.config.bindAddrs("8388"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: got %v, want %v", tt.config, got, tt.want)
+		}
+	}
+}
+
+func TestListenConfigCheck(t *testing.T) {
+	tests := []struct {
+		config *ListenConfig
+		nports int
+		ok     bool
+	}{
+		{nil, 2, true},
+		{&ListenConfig{Addresses: []string{"127.0.0.1", "::"}, IPv6Only: true}, 2, true},
+		{&ListenConfig{Addresses: []string{"unix:/run/ss.sock"}}, 1, true},
+		{&ListenConfig{Addresses: []string{"unix:/run/ss.sock"}}, 2, false},
+		{&ListenConfig{Addresses: []string{"unix:/run/ss-{port}.sock"}}, 2, true},
+		{&ListenConfig{Addresses: []string{"unix:"}}, 1, false},
+		{&ListenConfig{Addresses: []string{""}}, 1, false},
+		{&ListenConfig{Addresses: []string{"127.0.0.1:8388"}}, 1, true},
+		{&ListenConfig{Addresses: []string{"/run/ss.sock"}}, 1, false},
+		{&ListenConfig{ReusePort: -1}, 1, false},
+	}
+	for _, tt := range tests {
+		if err := tt.config.check(tt.nports); (err == nil) != tt.ok {
+			t.Errorf("%+v with %d ports: got %v", tt.config, tt.nports, err)
+		}
+	}
+}
+
+func TestServerListen(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	dir, err := ioutil.TempDir("", "sslisten")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	port := freePort(t)
+	config := &Config{
+		PortPassword: map[string]string{port: "foobar"},
+		Method:       "aes-128-cfb",
+		Listen:       &ListenConfig{Addresses: []string{"127.0.0.1"}},
+	}
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if lns, _ := s.Listeners(); len(lns) != 1 || lns[0].Addr().String() != "127.0.0.1:"+port {
+		t.Fatalf("got listeners %v, want 127.0.0.1:%s", lns, port)
+	}
+
+	// a new listen config restarts the port, even with the same password
+	sock := filepath.Join(dir, "ss-{port}.sock")
+	config.Listen = &ListenConfig{Addresses: []string{"127.0.0.1", "unix:" + sock}, ReusePort: 2}
+	if _, err = reusePort(); err != nil {
+		config.Listen.ReusePort = 0
+	}
+	if err = s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	want := 2
+	if config.Listen.ReusePort > 1 {
+		want = 3
+	}
+	if lns, _ := s.Listeners(); len(lns) != want {
+		t.Errorf("got %d listeners, want %d", len(lns), want)
+	}
+
+	cipher, err := NewCipher("aes-128-cfb", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("unix", filepath.Join(dir, "ss-"+port+".sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewConn(conn, cipher)
+	defer c.Close()
+	rawaddr, err := RawAddr(echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(time.Second))
+	if _, err = c.Write(append(rawaddr, "hello"...)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("echo through the unix socket got %q, %v", buf, err)
+	}
+}
@@ -0,0 +1,339 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A hop of a proxy chain, connecting to the next address over a connection
+// to the proxy.
+type proxyHop interface {
+	addr() string
+	connect(c net.Conn, network, addr string) (net.Conn, error)
+	String() string // without credentials, for logging
+}
+
+// ProxyChain connects to destinations through a list of upstream proxies,
+// each hop connecting to the next one. Hops are given as urls:
+//
+//	socks5://[user:password@]host:port
+//	http://[user:password@]host:port     (HTTP CONNECT)
+//	ss://method:password@host:port       (userinfo maybe base64 encoded)
+type ProxyChain struct {
+	hops []proxyHop
+	// Dialer connects to the first hop, nil uses the defaults.
+	Dialer *OutboundDialer
+	// ACL checks the destinations, nil allows everything. If the ACL has any
+	// rule, names are resolved locally and the addresses are passed to the
+	// upstream, so that they can be checked too.
+	ACL *ACL
+	// Resolver is used to resolve names for the ACL.
+	Resolver *Resolver
+}
+
+// NewProxyChain parses the hop urls.
+func NewProxyChain(hops []string) (*ProxyChain, error) {
+	if len(hops) == 0 {
+		return nil, errors.New("shadowsocks: empty proxy chain")
+	}
+	chain := &ProxyChain{}
+	for i, s := range hops {
+		hop, err := parseProxyHop(s)
+		if err != nil {
+			// don't print the url, it may contain the password
+			return nil, fmt.Errorf("shadowsocks: proxy chain hop %d: %v", i+1, err)
+		}
+		chain.hops = append(chain.hops, hop)
+	}
+	return chain, nil
+}
+
+func parseProxyHop(s string) (proxyHop, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, errors.New("invalid url")
+	}
+	if u.Port() == "" {
+		return nil, errors.New("missing port")
+	}
+	var user, password string
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	switch u.Scheme {
+	case "socks5":
+		if len(user) > 255 || len(password) > 255 {
+			return nil, errors.New("socks5 user or password too long")
+		}
+		return &socks5Hop{u.Host, user, password}, nil
+	case "http":
+		return &httpHop{u.Host, user, password}, nil
+	case "ss":
+		d, err := parseSSURL(u)
+		if err != nil {
+			return nil, err
+		}
+		return &ssHop{d}, nil
+	}
+	return nil, fmt.Errorf("unsupported protocol %s", u.Scheme)
+}
+
+// parseSSURL creates a Dialer from an ss://method:password@host:port url,
+// the userinfo maybe base64 encoded as in SIP002.
+func parseSSURL(u *url.URL) (*Dialer, error) {
+	if u.Port() == "" {
+		return nil, errors.New("missing port")
+	}
+	var method, password string
+	if u.User != nil {
+		method = u.User.Username()
+		var ok bool
+		if password, ok = u.User.Password(); !ok {
+			// SIP002 form, base64(method:password)
+			b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(method, "="))
+			if err != nil {
+				return nil, errors.New("invalid ss userinfo")
+			}
+			parts := strings.SplitN(string(b), ":", 2)
+			if len(parts) != 2 {
+				return nil, errors.New("invalid ss userinfo")
+			}
+			method, password = parts[0], parts[1]
+		}
+	}
+	if method == "" || password == "" {
+		return nil, errors.New("ss url needs method and password")
+	}
+	cipher, err := NewCipher(method, password)
+	if err != nil {
+		return nil, err
+	}
+	return NewDialer(u.Host, cipher)
+}
+
+// Dial connects to addr through the chain.
+func (chain *ProxyChain) Dial(network, addr string) (net.Conn, error) {
+	return chain.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the chain. The connect timeout of
+// Dialer covers the whole chain, resolving addr for the ACL included.
+func (chain *ProxyChain) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if timeout := chain.Dialer.getConf().dialer.Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if chain.ACL.getRules() != nil {
+		ips, port, err := chain.ACL.ResolveContext(ctx, chain.Resolver, addr)
+		if err != nil {
+			return nil, err
+		}
+		addr = net.JoinHostPort(ips[0].String(), strconv.Itoa(port))
+	}
+
+	c, err := chain.Dialer.DialContext(ctx, "tcp", chain.hops[0].addr())
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	for i, hop := range chain.hops {
+		next, nextNetwork := addr, network
+		if i+1 < len(chain.hops) {
+			next, nextNetwork = chain.hops[i+1].addr(), "tcp"
+		}
+		conn, err := hop.connect(c, nextNetwork, next)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("shadowsocks: proxy chain hop %d %s: %v", i+1, hop, err)
+		}
+		c = conn
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func splitHostPort(addr string) (host string, port int, err error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	port, err = strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		err = fmt.Errorf("invalid port in %s", addr)
+	}
+	return
+}
+
+type socks5Hop struct {
+	server   string
+	user     string
+	password string
+}
+
+func (h *socks5Hop) addr() string   { return h.server }
+func (h *socks5Hop) String() string { return "socks5://" + h.server }
+
+const (
+	socksVer5       = 5
+	socksCmdConnect = 1
+	socksAuthNone   = 0
+	socksAuthPasswd = 2
+)
+
+func (h *socks5Hop) connect(c net.Conn, network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, fmt.Errorf("unsupported connection type: %s", network)
+	}
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	method := byte(socksAuthNone)
+	if h.user != "" {
+		method = socksAuthPasswd
+	}
+	if _, err = c.Write([]byte{socksVer5, 1, method}); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 262)
+	if _, err = io.ReadFull(c, buf[:2]); err != nil {
+		return nil, err
+	}
+	if buf[0] != socksVer5 || buf[1] != method {
+		return nil, errors.New("socks5 authentication method not accepted")
+	}
+	if method == socksAuthPasswd {
+		// RFC 1929
+		req := []byte{1, byte(len(h.user))}
+		req = append(req, h.user...)
+		req = append(req, byte(len(h.password)))
+		req = append(req, h.password...)
+		if _, err = c.Write(req); err != nil {
+			return nil, err
+		}
+		if _, err = io.ReadFull(c, buf[:2]); err != nil {
+			return nil, err
+		}
+		if buf[1] != 0 {
+			return nil, errors.New("socks5 authentication failed")
+		}
+	}
+
+	req := []byte{socksVer5, socksCmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, errors.New("host name too long")
+		}
+		req = append(req, typeDm, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, typeIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, typeIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err = c.Write(req); err != nil {
+		return nil, err
+	}
+
+	// reply: ver, rep, rsv, atyp, bound address, bound port
+	if _, err = io.ReadFull(c, buf[:4]); err != nil {
+		return nil, err
+	}
+	if buf[1] != 0 {
+		return nil, fmt.Errorf("socks5 connect failed, reply %d", buf[1])
+	}
+	var alen int
+	switch buf[3] {
+	case typeIPv4:
+		alen = net.IPv4len
+	case typeIPv6:
+		alen = net.IPv6len
+	case typeDm:
+		if _, err = io.ReadFull(c, buf[:1]); err != nil {
+			return nil, err
+		}
+		alen = int(buf[0])
+	default:
+		return nil, fmt.Errorf("socks5 reply address type %d not supported", buf[3])
+	}
+	if _, err = io.ReadFull(c, buf[:alen+2]); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type httpHop struct {
+	server   string
+	user     string
+	password string
+}
+
+func (h *httpHop) addr() string   { return h.server }
+func (h *httpHop) String() string { return "http://" + h.server }
+
+// bufferedConn returns the data read ahead by the response parser first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (h *httpHop) connect(c net.Conn, network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, fmt.Errorf("unsupported connection type: %s", network)
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if h.user != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(h.user + ":" + h.password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(c); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http connect failed: %s", resp.Status)
+	}
+	if r.Buffered() > 0 {
+		return &bufferedConn{c, r}, nil
+	}
+	return c, nil
+}
+
+type ssHop struct {
+	*Dialer
+}
+
+func (h *ssHop) addr() string   { return h.server }
+func (h *ssHop) String() string { return "ss://" + h.server }
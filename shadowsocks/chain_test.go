@@ -0,0 +1,219 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// serveTest accepts connections on a new listener and handles them with
+// handle in background.
+func serveTest(t *testing.T, handle func(c net.Conn)) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(c)
+		}
+	}()
+	return ln
+}
+
+func relayTest(c net.Conn, target string) {
+	remote, err := net.Dial("tcp", target)
+	if err != nil {
+		c.Close()
+		return
+	}
+	go func() {
+		io.Copy(remote, c)
+		remote.Close()
+	}()
+	io.Copy(c, remote)
+	c.Close()
+}
+
+func echoServer(t *testing.T) net.Listener {
+	return serveTest(t, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+}
+
+// socks5Server only supports the connect command with password auth.
+func socks5Server(t *testing.T, user, password string) net.Listener {
+	return serveTest(t, func(c net.Conn) {
+		buf := make([]byte, 262)
+		io.ReadFull(c, buf[:2])
+		io.ReadFull(c, buf[:buf[1]])
+		c.Write([]byte{5, 2})
+		// auth
+		io.ReadFull(c, buf[:2])
+		u := make([]byte, buf[1])
+		io.ReadFull(c, u)
+		io.ReadFull(c, buf[:1])
+		p := make([]byte, buf[0])
+		io.ReadFull(c, p)
+		if string(u) != user || string(p) != password {
+			c.Write([]byte{1, 1})
+			c.Close()
+			return
+		}
+		c.Write([]byte{1, 0})
+		// request
+		io.ReadFull(c, buf[:4])
+		var host string
+		switch buf[3] {
+		case typeIPv4:
+			io.ReadFull(c, buf[:4])
+			host = net.IP(buf[:4]).String()
+		case typeDm:
+			io.ReadFull(c, buf[:1])
+			n := int(buf[0])
+			io.ReadFull(c, buf[:n])
+			host = string(buf[:n])
+		}
+		io.ReadFull(c, buf[:2])
+		port := binary.BigEndian.Uint16(buf)
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		relayTest(c, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	})
+}
+
+func httpConnectServer(t *testing.T, user, password string) net.Listener {
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	return serveTest(t, func(c net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil || req.Method != "CONNECT" {
+			c.Close()
+			return
+		}
+		if req.Header.Get("Proxy-Authorization") != auth {
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			c.Close()
+			return
+		}
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		relayTest(c, req.Host)
+	})
+}
+
+func ssServer(t *testing.T, method, password string) net.Listener {
+	cipher, err := NewCipher(method, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveTest(t, func(raw net.Conn) {
+		c := NewConn(raw, cipher.Copy())
+		buf := make([]byte, 260)
+		io.ReadFull(c, buf[:1])
+		var host string
+		switch buf[0] {
+		case typeIPv4:
+			io.ReadFull(c, buf[:4])
+			host = net.IP(buf[:4]).String()
+		case typeDm:
+			io.ReadFull(c, buf[:1])
+			n := int(buf[0])
+			io.ReadFull(c, buf[:n])
+			host = string(buf[:n])
+		}
+		io.ReadFull(c, buf[:2])
+		port := binary.BigEndian.Uint16(buf)
+		relayTest(c, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	})
+}
+
+func TestProxyChain(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	socks := socks5Server(t, "user", "socks pass")
+	defer socks.Close()
+	httpProxy := httpConnectServer(t, "user", "http pass")
+	defer httpProxy.Close()
+	ss := ssServer(t, "aes-128-cfb", "ss pass")
+	defer ss.Close()
+	sip002 := base64.RawURLEncoding.EncodeToString([]byte("aes-128-cfb:ss pass"))
+
+	tests := [][]string{
+		{"socks5://user:socks%20pass@" + socks.Addr().String()},
+		{"http://user:http%20pass@" + httpProxy.Addr().String()},
+		{"ss://aes-128-cfb:ss%20pass@" + ss.Addr().String()},
+		{
+			"socks5://user:socks%20pass@" + socks.Addr().String(),
+			"http://user:http%20pass@" + httpProxy.Addr().String(),
+			"ss://" + sip002 + "@" + ss.Addr().String(),
+		},
+	}
+	for _, hops := range tests {
+		chain, err := NewProxyChain(hops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := chain.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Errorf("%v: %v", chain.hops, err)
+			continue
+		}
+		msg := []byte("hello through the chain")
+		c.Write(msg)
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != string(msg) {
+			t.Errorf("%v: echo got %q, %v", chain.hops, buf, err)
+		}
+		c.Close()
+	}
+
+	// wrong credentials
+	for _, hop := range []string{
+		"socks5://user:wrong@" + socks.Addr().String(),
+		"http://user:wrong@" + httpProxy.Addr().String(),
+	} {
+		chain, _ := NewProxyChain([]string{hop})
+		if c, err := chain.Dial("tcp", echo.Addr().String()); err == nil {
+			c.Close()
+			t.Errorf("%v: should fail with wrong credentials", chain.hops)
+		}
+	}
+}
+
+func TestProxyChainACL(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	socks := socks5Server(t, "user", "pass")
+	defer socks.Close()
+
+	chain, _ := NewProxyChain([]string{"socks5://user:pass@" + socks.Addr().String()})
+	chain.ACL, _ = NewACL(&ACLConfig{BlockPrivate: true})
+	// the proxy itself is reachable, the destination is denied
+	if _, err := chain.Dial("tcp", echo.Addr().String()); !IsACLDenied(err) {
+		t.Errorf("dial to loopback through chain should be denied, got %v", err)
+	}
+}
+
+func TestParseProxyHop(t *testing.T) {
+	for _, s := range []string{
+		"socks5://127.0.0.1",
+		"https://127.0.0.1:443",
+		"ss://127.0.0.1:8388",
+		"ss://no-such-method:pass@127.0.0.1:8388",
+	} {
+		if _, err := NewProxyChain([]string{s}); err == nil {
+			t.Errorf("%s should be invalid", s)
+		}
+	}
+	if _, err := NewProxyChain(nil); err == nil {
+		t.Error("empty chain should be invalid")
+	}
+}
@@ -0,0 +1,564 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	errAddrType      = errors.New("socks addr type not supported")
+	errVer           = errors.New("socks version not supported")
+	errMethod        = errors.New("socks only support 1 method now")
+	errAuthExtraData = errors.New("socks authentication get extra data")
+	errReqExtraData  = errors.New("socks request get extra data")
+	errCmd           = errors.New("socks command not supported")
+)
+
+type serverCipher struct {
+	server string
+	cipher *Cipher
+}
+
+// Client is a local socks5 server relaying the connections through the
+// servers of a Config like the shadowsocks-local command, so it can be
+// embedded in other programs. The servers are tried in the order of the
+// config, failed ones are skipped for a while.
+type Client struct {
+	localAddr string
+	pool      atomic.Value // *serverPool
+
+	mu     sync.Mutex
+	ln     net.Listener
+	closed bool
+	conns  *ConnGroup
+}
+
+// serverPool is the servers of a client with the dialer connecting to them.
+// Reload replaces it as a whole, the connections in progress keep using the
+// one they started with.
+type serverPool struct {
+	servers []*serverCipher
+	// dialer is the outbound dialer or the proxy chain on top of it
+	dialer NetDialer
+
+	failMu  sync.Mutex
+	failCnt []int // failed connection count
+}
+
+func newServerPool(config *Config) (*serverPool, error) {
+	oc := config.Outbound
+	if config.FastOpen {
+		c := OutboundConfig{}
+		if oc != nil {
+			c = *oc
+		}
+		c.Socket = c.Socket.withFastOpen()
+		oc = &c
+	}
+	outbound, err := NewOutboundDialer(oc)
+	if err != nil {
+		return nil, err
+	}
+	p := &serverPool{dialer: outbound}
+	if config.Chain != "" && config.Chain != "direct" {
+		hops, ok := config.ProxyChains[config.Chain]
+		if !ok {
+			return nil, fmt.Errorf("proxy chain %s not defined", config.Chain)
+		}
+		chain, err := NewProxyChain(hops)
+		if err != nil {
+			return nil, err
+		}
+		chain.Dialer = outbound
+		p.dialer = chain
+	}
+	if p.servers, err = parseServerConfig(config); err != nil {
+		return nil, err
+	}
+	p.failCnt = make([]int, len(p.servers))
+	return p, nil
+}
+
+// NewClient creates a client for the servers of config, either
+// server_password or server, server_port and password. The method defaults
+// to DefaultCipherMethod.
+func NewClient(config *Config) (*Client, error) {
+	c := &Client{
+		localAddr: config.LocalAddress + ":" + strconv.Itoa(config.LocalPort),
+		conns:     NewConnGroup(),
+	}
+	p, err := newServerPool(config)
+	if err != nil {
+		return nil, err
+	}
+	c.pool.Store(p)
+	for _, se := range p.servers {
+		mainLog.Info("available remote server", F("server", se.server))
+	}
+	return c, nil
+}
+
+// Reload replaces the servers, the outbound options and the proxy chain
+// with those of config once they're all valid, the old ones are kept on
+// error. The failure counts of the servers kept are too. The local address
+// can't change.
+func (c *Client) Reload(config *Config) error {
+	p, err := newServerPool(config)
+	if err != nil {
+		return err
+	}
+	if addr := config.LocalAddress + ":" + strconv.Itoa(config.LocalPort); addr != c.localAddr {
+		mainLog.Warn("can't change the local address, restart to apply it", F("addr", addr))
+	}
+	old := c.pool.Load().(*serverPool)
+	kept := make(map[string]bool)
+	old.failMu.Lock()
+	for i, se := range p.servers {
+		for j, ose := range old.servers {
+			if se.server == ose.server && bytes.Equal(se.cipher.key, ose.cipher.key) && se.cipher.info == ose.cipher.info {
+				p.failCnt[i] = old.failCnt[j]
+				kept[se.server] = true
+				break
+			}
+		}
+	}
+	old.failMu.Unlock()
+	c.pool.Store(p)
+	for _, se := range p.servers {
+		if !kept[se.server] {
+			mainLog.Info("server added", F("server", se.server))
+		}
+	}
+	for _, se := range old.servers {
+		if !kept[se.server] {
+			mainLog.Info("server removed", F("server", se.server))
+		}
+	}
+	return nil
+}
+
+func parseServerConfig(config *Config) ([]*serverCipher, error) {
+	hasPort := func(s string) bool {
+		_, port, err := net.SplitHostPort(s)
+		if err != nil {
+			return false
+		}
+		return port != ""
+	}
+
+	if len(config.ServerPassword) == 0 {
+		if config.Server == nil || config.ServerPort == 0 || config.Password == "" && config.Key == "" {
+			return nil, errors.New("shadowsocks: must specify server address, password or key and server port")
+		}
+		if err := CheckCipherMethod(config.Method); err != nil {
+			return nil, err
+		}
+		// only one encryption table
+		cipher, err := newCipherFor(config.Method, config.Password, config.Key)
+		if err != nil {
+			return nil, err
+		}
+		srvPort := strconv.Itoa(config.ServerPort)
+		srvArr, err := config.GetServerArray()
+		if err != nil {
+			return nil, err
+		}
+		servers := make([]*serverCipher, len(srvArr))
+		for i, s := range srvArr {
+			if hasPort(s) {
+				mainLog.Info("ignore server_port option for server", F("server", s))
+				servers[i] = &serverCipher{s, cipher}
+			} else {
+				servers[i] = &serverCipher{net.JoinHostPort(s, srvPort), cipher}
+			}
+		}
+		return servers, nil
+	}
+
+	if config.Password != "" || config.Key != "" || config.ServerPort != 0 || config.Server != nil {
+		// don't print the config, it contains the passwords
+		mainLog.Warn("given server_password, ignore server, server_port, password and key option")
+	}
+	// multiple servers
+	servers := make([]*serverCipher, len(config.ServerPassword))
+	cipherCache := make(map[string]*Cipher)
+	for i, serverInfo := range config.ServerPassword {
+		if len(serverInfo) < 2 || len(serverInfo) > 4 {
+			// don't print the server info, it contains the password
+			return nil, fmt.Errorf("shadowsocks: server_password %d syntax error", i)
+		}
+		server := serverInfo[0]
+		passwd := serverInfo[1]
+		encmethod := config.Method
+		if len(serverInfo) >= 3 && serverInfo[2] != "" {
+			encmethod = serverInfo[2]
+		}
+		key := ""
+		if len(serverInfo) == 4 {
+			key = serverInfo[3]
+		}
+		if !hasPort(server) {
+			return nil, fmt.Errorf("shadowsocks: no port for server %s", server)
+		}
+		// Using "|" as delimiter is safe here, since no encryption
+		// method contains it in the name, nor base64 keys.
+		cacheKey := encmethod + "|" + passwd + "|" + key
+		cipher, ok := cipherCache[cacheKey]
+		if !ok {
+			if err := CheckCipherMethod(encmethod); err != nil {
+				return nil, fmt.Errorf("shadowsocks: server %s: %v", server, err)
+			}
+			var err error
+			cipher, err = newCipherFor(encmethod, passwd, key)
+			if err != nil {
+				return nil, fmt.Errorf("shadowsocks: server %s: %v", server, err)
+			}
+			cipherCache[cacheKey] = cipher
+		}
+		servers[i] = &serverCipher{server, cipher}
+	}
+	return servers, nil
+}
+
+// Start listens on local_address:local_port and serves it in background,
+// until ctx is done or the client is closed.
+func (c *Client) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", c.localAddr)
+	if err != nil {
+		return err
+	}
+	mainLog.Info("starting local socks5 server", F("addr", ln.Addr()))
+	go c.Serve(ln)
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+	return nil
+}
+
+// Serve accepts socks5 connections on ln until the client is closed, which
+// returns nil, or ln fails.
+func (c *Client) Serve(ln net.Listener) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	c.ln = ln
+	c.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			c.mu.Lock()
+			closed := c.closed
+			c.mu.Unlock()
+			if closed {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				tcpLog.Error("accept error", Err(err))
+				continue
+			}
+			return err
+		}
+		if !c.conns.Add(conn) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			c.handleConnection(conn)
+			c.conns.Done(conn)
+		}()
+	}
+}
+
+// Addr returns the address the client is listening on, nil if it's not
+// serving.
+func (c *Client) Addr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ln == nil {
+		return nil
+	}
+	return c.ln.Addr()
+}
+
+// Close stops listening and closes the connections in progress.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	ln := c.ln
+	c.mu.Unlock()
+	var err error
+	if ln != nil {
+		err = ln.Close()
+	}
+	c.conns.CloseAll()
+	return err
+}
+
+func handShake(conn net.Conn) (err error) {
+	const (
+		idVer     = 0
+		idNmethod = 1
+	)
+	// version identification and method selection message in theory can have
+	// at most 256 methods, plus version and nmethod field in total 258 bytes
+	// the current rfc defines only 3 authentication methods (plus 2 reserved),
+	// so it won't be such long in practice
+
+	buf := make([]byte, 258)
+
+	var n int
+	SetReadTimeout(conn)
+	// make sure we get the nmethod field
+	if n, err = io.ReadAtLeast(conn, buf, idNmethod+1); err != nil {
+		return
+	}
+	if buf[idVer] != socksVer5 {
+		return errVer
+	}
+	nmethod := int(buf[idNmethod])
+	msgLen := nmethod + 2
+	if n == msgLen { // handshake done, common case
+		// do nothing, jump directly to send confirmation
+	} else if n < msgLen { // has more methods to read, rare case
+		if _, err = io.ReadFull(conn, buf[n:msgLen]); err != nil {
+			return
+		}
+	} else { // error, should not get extra data
+		return errAuthExtraData
+	}
+	// send confirmation: version 5, no authentication required
+	_, err = conn.Write([]byte{socksVer5, 0})
+	return
+}
+
+func getSocksRequest(conn net.Conn) (rawaddr []byte, host string, err error) {
+	const (
+		idVer   = 0
+		idCmd   = 1
+		idType  = 3 // address type index
+		idIP0   = 4 // ip address start index
+		idDmLen = 4 // domain address length index
+		idDm0   = 5 // domain address start index
+
+		lenIPv4   = 3 + 1 + net.IPv4len + 2 // 3(ver+cmd+rsv) + 1addrType + ipv4 + 2port
+		lenIPv6   = 3 + 1 + net.IPv6len + 2 // 3(ver+cmd+rsv) + 1addrType + ipv6 + 2port
+		lenDmBase = 3 + 1 + 1 + 2           // 3 + 1addrType + 1addrLen + 2port, plus addrLen
+	)
+	// refer to getRequest in server.go for why set buffer size to 263
+	buf := make([]byte, 263)
+	var n int
+	SetReadTimeout(conn)
+	// read till we get possible domain length field
+	if n, err = io.ReadAtLeast(conn, buf, idDmLen+1); err != nil {
+		return
+	}
+	// check version and cmd
+	if buf[idVer] != socksVer5 {
+		err = errVer
+		return
+	}
+	if buf[idCmd] != socksCmdConnect {
+		err = errCmd
+		return
+	}
+
+	reqLen := -1
+	switch buf[idType] {
+	case typeIPv4:
+		reqLen = lenIPv4
+	case typeIPv6:
+		reqLen = lenIPv6
+	case typeDm:
+		reqLen = int(buf[idDmLen]) + lenDmBase
+	default:
+		err = errAddrType
+		return
+	}
+
+	if n == reqLen {
+		// common case, do nothing
+	} else if n < reqLen { // rare case
+		if _, err = io.ReadFull(conn, buf[n:reqLen]); err != nil {
+			return
+		}
+	} else {
+		err = errReqExtraData
+		return
+	}
+
+	rawaddr = buf[idType:reqLen]
+
+	if tcpLog.Enabled(LevelDebug) {
+		switch buf[idType] {
+		case typeIPv4:
+			host = net.IP(buf[idIP0 : idIP0+net.IPv4len]).String()
+		case typeIPv6:
+			host = net.IP(buf[idIP0 : idIP0+net.IPv6len]).String()
+		case typeDm:
+			host = string(buf[idDm0 : idDm0+buf[idDmLen]])
+		}
+		port := binary.BigEndian.Uint16(buf[reqLen-2 : reqLen])
+		host = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+
+	return
+}
+
+func (p *serverPool) connectToServer(serverId int, rawaddr []byte, addr string) (remote *Conn, err error) {
+	se := p.servers[serverId]
+	remote, err = DialWithRawAddrLazy(p.dialer, rawaddr, se.server, se.cipher.Copy())
+	p.failMu.Lock()
+	defer p.failMu.Unlock()
+	if err != nil {
+		tcpLog.Warn("error connecting to shadowsocks server", F("server", se.server), Err(err))
+		const maxFailCnt = 30
+		if p.failCnt[serverId] < maxFailCnt {
+			p.failCnt[serverId]++
+		}
+		return nil, err
+	}
+	tcpLog.Debug("connected", F("host", addr), F("server", se.server))
+	p.failCnt[serverId] = 0
+	return
+}
+
+// Connection to the server in the order specified in the config. On
+// connection failure, try the next server. A failed server will be tried with
+// some probability according to its fail count, so we can discover recovered
+// servers.
+func (p *serverPool) createServerConn(rawaddr []byte, addr string) (remote *Conn, err error) {
+	const baseFailCnt = 20
+	n := len(p.servers)
+	skipped := make([]int, 0)
+	for i := 0; i < n; i++ {
+		// skip failed server, but try it with some probability
+		p.failMu.Lock()
+		failCnt := p.failCnt[i]
+		p.failMu.Unlock()
+		if failCnt > 0 && rand.Intn(failCnt+baseFailCnt) != 0 {
+			skipped = append(skipped, i)
+			continue
+		}
+		remote, err = p.connectToServer(i, rawaddr, addr)
+		if err == nil {
+			return
+		}
+	}
+	// last resort, try skipped servers, not likely to succeed
+	for _, i := range skipped {
+		remote, err = p.connectToServer(i, rawaddr, addr)
+		if err == nil {
+			return
+		}
+	}
+	return nil, err
+}
+
+// firstDataWait is how long the client may take to send its first data
+// after the socks reply, for it to go with the address.
+const firstDataWait = 50 * time.Millisecond
+
+// sendFirstData sends the first data of conn with the address kept by
+// remote, or the address alone if conn sends nothing within firstDataWait,
+// as for the protocols where the server speaks first.
+func sendFirstData(conn net.Conn, remote *Conn) error {
+	buf := leakyBuf.Get()
+	defer leakyBuf.Put(buf)
+	conn.SetReadDeadline(time.Now().Add(firstDataWait))
+	n, err := conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+	if n > 0 {
+		_, err = remote.Write(buf[:n])
+		return err
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return remote.Flush()
+	}
+	if err == nil {
+		err = io.ErrNoProgress
+	}
+	return err
+}
+
+// socksReplyCode returns the socks5 reply for the error connecting to the
+// servers.
+func socksReplyCode(err error) byte {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return 0x05 // connection refused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return 0x03 // network unreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return 0x04 // host unreachable
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return 0x04
+	}
+	return 0x01 // general failure
+}
+
+func (c *Client) handleConnection(conn net.Conn) {
+	tcpLog.Debug("socks connect", ClientAddr(conn.RemoteAddr()))
+	closed := false
+	defer func() {
+		if !closed {
+			conn.Close()
+		}
+	}()
+
+	var err error = nil
+	if err = handShake(conn); err != nil {
+		tcpLog.Info("socks handshake error", ClientAddr(conn.RemoteAddr()), Err(err))
+		return
+	}
+	rawaddr, addr, err := getSocksRequest(conn)
+	if err != nil {
+		tcpLog.Info("error getting request", ClientAddr(conn.RemoteAddr()), Err(err))
+		return
+	}
+	// The reply waits for the connection to the server, so the client
+	// knows when it fails. The address is only sent with the first data.
+	pool := c.pool.Load().(*serverPool)
+	remote, err := pool.createServerConn(rawaddr, addr)
+	if err != nil {
+		if len(pool.servers) > 1 {
+			tcpLog.Error("failed connect to all available shadowsocks servers")
+		}
+		conn.Write([]byte{socksVer5, socksReplyCode(err), 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return
+	}
+	defer func() {
+		if !closed {
+			remote.Close()
+		}
+	}()
+	_, err = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x08, 0x43})
+	if err != nil {
+		tcpLog.Debug("send connection confirmation error", Err(err))
+		return
+	}
+	if err = sendFirstData(conn, remote); err != nil {
+		tcpLog.Debug("error sending first data", F("host", addr), Err(err))
+		return
+	}
+
+	go PipeThenClose(conn, remote, nil)
+	PipeThenClose(remote, conn, nil)
+	closed = true
+	tcpLog.Debug("closed connection", F("host", addr))
+}
@@ -10,10 +10,10 @@ package shadowsocks
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	// "log"
-	"os"
+	"net/url"
 	"reflect"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,77 +24,321 @@ type Config struct {
 	LocalAddress string      `json:"local_address"`
 	Password     string      `json:"password"`
 	Method       string      `json:"method"` // encryption method
+	// Base64 raw key of the method's key length, instead of password.
+	Key string `json:"key"`
+
+	// Controls outbound connections, to destinations on the server and to
+	// the servers on the client.
+	Outbound *OutboundConfig `json:"outbound"`
+	// Upstream proxy chains by name, see ProxyChain for the hop format.
+	ProxyChains map[string][]string `json:"proxy_chains"`
+	// The proxy chain used for all outbound connections, "direct" or empty
+	// for none.
+	Chain string `json:"chain"`
+	// Logging, written to stderr at info level if not set.
+	Log *LogConfig `json:"log"`
+	// TCP Fast Open between the client and the server, the fast_open of
+	// the listen socket options on the server and of the outbound ones on
+	// the client.
+	FastOpen bool `json:"fast_open"`
 
 	// following options are only used by server
 	PortPassword map[string]string `json:"port_password"`
-	Timeout      int               `json:"timeout"`
+	// The port_password entries given as objects, see PortUser.
+	PortUsers map[string]*PortUser `json:"-"`
+	Timeout   int                  `json:"timeout"`
+	// Relays udp too.
+	UDP bool `json:"udp"`
+	// The addresses and the socket options the ports are listened on.
+	Listen *ListenConfig `json:"listen"`
+	// The port the obfs server serves all the users on, default 8088.
+	ObfsPort int `json:"obfs_port"`
+	// Seconds to wait for in-flight connections when shutting down or
+	// removing a port, negative to close them immediately.
+	DrainTimeout int `json:"drain_timeout"`
+	// Proxy chain per port, overriding chain.
+	PortChain map[string]string `json:"port_chain"`
+	// PROXY protocol on inbound and outbound connections.
+	ProxyProtocol *ProxyProtocolConfig `json:"proxy_protocol"`
+	// Restricts the destinations clients can connect to.
+	ACL *ACLConfig `json:"acl"`
+	// Resolves the destinations, the system resolver is used if not set.
+	DNS *ResolverConfig `json:"dns"`
+	// Connection limits and the ban list for clients failing handshakes.
+	Limits *LimitConfig `json:"limits"`
+	// Writes a record for each tcp session and udp nat entry.
+	AccessLog *AccessLogConfig `json:"access_log"`
 
 	// following options are only used by client
 
 	// The order of servers in the client config is significant, so use array
 	// instead of map to preserve the order.
+	// Each entry is server, password and optionally method and key. Entries
+	// given as objects, with the server, password, method and key fields,
+	// are converted to this form.
 	ServerPassword [][]string `json:"server_password"`
 }
 
-var readTimeout time.Duration
+// PortUser is the object form of a port_password entry, which can give a
+// base64 key instead of the password, and the method and limits of the
+// port.
+type PortUser struct {
+	Password string `json:"password,omitempty"`
+	Key      string `json:"key,omitempty"`
+	// Method of the port, the method of the config if empty.
+	Method string `json:"method,omitempty"`
+	// Connection limits of the port, overriding those of the config.
+	Limits *PortLimitConfig `json:"limits,omitempty"`
+}
 
-func (config *Config) GetServerArray() []string {
-	// Specifying multiple servers in the "server" options is deprecated.
-	// But for backward compatibility, keep this.
-	if config.Server == nil {
-		return nil
+// sameCipher reports whether the port can keep its listener going from u
+// to o, the limits are applied without restarting it.
+func (u PortUser) sameCipher(o PortUser) bool {
+	return u.Password == o.Password && u.Key == o.Key && u.Method == o.Method
+}
+
+// serverEntry is the object form of a server_password entry.
+type serverEntry struct {
+	Server   string `json:"server"`
+	Password string `json:"password"`
+	Method   string `json:"method"`
+	Key      string `json:"key"`
+}
+
+// UnmarshalJSON parses the config, accepting strings or objects as
+// port_password entries and arrays or objects as server_password entries.
+func (config *Config) UnmarshalJSON(data []byte) error {
+	type plainConfig Config
+	aux := struct {
+		*plainConfig
+		PortPassword   map[string]json.RawMessage `json:"port_password"`
+		ServerPassword []json.RawMessage          `json:"server_password"`
+	}{plainConfig: (*plainConfig)(config)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
 	}
-	single, ok := config.Server.(string)
-	if ok {
-		return []string{single}
+	config.PortPassword, config.PortUsers = nil, nil
+	for port, raw := range aux.PortPassword {
+		var password string
+		if err := json.Unmarshal(raw, &password); err == nil {
+			if config.PortPassword == nil {
+				config.PortPassword = make(map[string]string)
+			}
+			config.PortPassword[port] = password
+			continue
+		}
+		user := &PortUser{}
+		if err := json.Unmarshal(raw, user); err != nil {
+			return fmt.Errorf("port_password %s: %v", port, err)
+		}
+		if config.PortUsers == nil {
+			config.PortUsers = make(map[string]*PortUser)
+		}
+		config.PortUsers[port] = user
+	}
+	config.ServerPassword = nil
+	for i, raw := range aux.ServerPassword {
+		var entry []string
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			var se serverEntry
+			if err = json.Unmarshal(raw, &se); err != nil {
+				return fmt.Errorf("server_password %d: %v", i, err)
+			}
+			entry = []string{se.Server, se.Password, se.Method}
+			if se.Key != "" {
+				entry = append(entry, se.Key)
+			}
+		}
+		config.ServerPassword = append(config.ServerPassword, entry)
 	}
-	arr, ok := config.Server.([]interface{})
-	if ok {
+	return nil
+}
+
+// readTimeout is the timeout of the config loaded last, in nanoseconds. It's
+// set again on reload while connections read it.
+var readTimeout int64
+
+func setReadTimeout(d time.Duration) {
+	atomic.StoreInt64(&readTimeout, int64(d))
+}
+
+func getReadTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&readTimeout))
+}
+
+// GetServerArray returns the servers of the server option, a string or an
+// array of strings.
+func (config *Config) GetServerArray() ([]string, error) {
+	// Specifying multiple servers in the "server" options is deprecated.
+	// But for backward compatibility, keep this.
+	switch server := config.Server.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{server}, nil
+	case []string:
+		return server, nil
+	case []interface{}:
 		/*
-			if len(arr) > 1 {
+			if len(server) > 1 {
 				log.Println("Multiple servers in \"server\" option is deprecated. " +
 					"Please use \"server_password\" instead.")
 			}
 		*/
-		serverArr := make([]string, len(arr), len(arr))
-		for i, s := range arr {
-			serverArr[i], ok = s.(string)
-			if !ok {
-				goto typeError
+		serverArr := make([]string, len(server))
+		for i, s := range server {
+			var ok bool
+			if serverArr[i], ok = s.(string); !ok {
+				return nil, fmt.Errorf("shadowsocks: server %d is %T, not a string", i, s)
 			}
 		}
-		return serverArr
+		return serverArr, nil
 	}
-typeError:
-	panic(fmt.Sprintf("Config.Server type error %v", reflect.TypeOf(config.Server)))
+	return nil, fmt.Errorf("shadowsocks: server is %T, not a string or an array of strings", config.Server)
 }
 
+// ParseConfig reads the config file with the files it includes, see
+// ConfigError for the errors in the files.
 func ParseConfig(path string) (config *Config, err error) {
-	file, err := os.Open(path) // For read access.
+	doc, _, err := loadConfigDoc(path, nil, nil)
 	if err != nil {
 		return
 	}
-	defer file.Close()
-
-	data, err := ioutil.ReadAll(file)
+	data, err := json.Marshal(doc)
 	if err != nil {
 		return
 	}
 
 	config = &Config{}
 	if err = json.Unmarshal(data, config); err != nil {
+		return nil, &ConfigError{Path: path, Err: err}
+	}
+	if err = config.ResolveSecrets(); err != nil {
 		return nil, err
 	}
-	readTimeout = time.Duration(config.Timeout) * time.Second
+	setReadTimeout(time.Duration(config.Timeout) * time.Second)
 	return
 }
 
+// MarshalJSON writes the config as UnmarshalJSON reads it, with the
+// PortUsers back in port_password.
+func (config *Config) MarshalJSON() ([]byte, error) {
+	type plainConfig Config
+	aux := struct {
+		*plainConfig
+		PortPassword map[string]interface{} `json:"port_password,omitempty"`
+	}{plainConfig: (*plainConfig)(config)}
+	if len(config.PortPassword)+len(config.PortUsers) > 0 {
+		aux.PortPassword = make(map[string]interface{})
+		for port, password := range config.PortPassword {
+			aux.PortPassword[port] = password
+		}
+		for port, user := range config.PortUsers {
+			aux.PortPassword[port] = user
+		}
+	}
+	return json.Marshal(aux)
+}
+
+const redacted = "[redacted]"
+
+// Redacted returns a copy of the config with the passwords and keys, also
+// those of the proxy chain urls, replaced, to print it.
+func (config *Config) Redacted() *Config {
+	redact := func(s string) string {
+		if s == "" {
+			return s
+		}
+		return redacted
+	}
+	c := *config
+	c.Password = redact(c.Password)
+	c.Key = redact(c.Key)
+	if config.PortPassword != nil {
+		c.PortPassword = make(map[string]string, len(config.PortPassword))
+		for port := range config.PortPassword {
+			c.PortPassword[port] = redacted
+		}
+	}
+	if config.PortUsers != nil {
+		c.PortUsers = make(map[string]*PortUser, len(config.PortUsers))
+		for port, user := range config.PortUsers {
+			u := *user
+			u.Password, u.Key = redact(u.Password), redact(u.Key)
+			c.PortUsers[port] = &u
+		}
+	}
+	if config.ServerPassword != nil {
+		c.ServerPassword = make([][]string, len(config.ServerPassword))
+		for i, entry := range config.ServerPassword {
+			entry = append([]string(nil), entry...)
+			if len(entry) > 1 {
+				entry[1] = redact(entry[1])
+			}
+			if len(entry) > 3 {
+				entry[3] = redact(entry[3])
+			}
+			c.ServerPassword[i] = entry
+		}
+	}
+	if config.ProxyChains != nil {
+		c.ProxyChains = make(map[string][]string, len(config.ProxyChains))
+		for name, hops := range config.ProxyChains {
+			redactedHops := make([]string, len(hops))
+			for i, hop := range hops {
+				redactedHops[i] = redactURL(hop)
+			}
+			c.ProxyChains[name] = redactedHops
+		}
+	}
+	return &c
+}
+
+// PrintConfig prints the config redacted, as JSON, for -check-config.
+func PrintConfig(config *Config) error {
+	data, err := json.MarshalIndent(config.Redacted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// redactURL replaces the password of the url, or the whole userinfo if it
+// has no password, as the base64 one of ss urls.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redacted
+	}
+	if u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "redacted")
+	} else {
+		u.User = url.User("redacted")
+	}
+	return u.String()
+}
+
+// SetDebug enables debug messages of all subsystems. SetupLog overrides the
+// levels, so apply -d to LogConfig when using it.
 func SetDebug(d DebugLog) {
 	Debug = d
+	if d {
+		logState.Lock()
+		logState.def = LevelDebug
+		logState.levels = nil
+		logState.Unlock()
+	}
 }
 
 // Useful for command line to override options specified in config file
 // Debug is not updated.
+//
+// Deprecated: zero values, maps and slices can't override the old ones, use
+// ConfigLoader.
 func UpdateConfig(old, new *Config) {
 	// Using reflection here is not necessary, but it's a good exercise.
 	// For more information on reflections in Go, read "The Laws of Reflection"
@@ -127,5 +371,5 @@ func UpdateConfig(old, new *Config) {
 	}
 
 	old.Timeout = new.Timeout
-	readTimeout = time.Duration(old.Timeout) * time.Second
+	setReadTimeout(time.Duration(old.Timeout) * time.Second)
 }
@@ -0,0 +1,653 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config files are JSON, or YAML and TOML by the .yaml, .yml and .toml
+// extensions. The files are decoded to the values encoding/json would give,
+// so the formats only differ in the syntax. Each file is checked on its own
+// for the errors to point to the file and line, then merged over the files
+// it includes, as a path or an array of paths relative to it:
+//
+//	{"include": ["users.yaml"], "method": "aes-256-gcm"}
+//
+// The objects are merged key by key, so e.g. the ports of all the files add
+// up. Any other value, and the port_password entries, replace the included
+// ones.
+
+// ConfigError is an error in a config file, at the line if known.
+type ConfigError struct {
+	Path string
+	Line int
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %v", e.Path, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// configFile is a decoded config file, with the line of the keys and array
+// items by their path, the keys and indexes joined by dots.
+type configFile struct {
+	path  string
+	doc   map[string]interface{}
+	lines map[string]int
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// line returns the line of path, or of its closest parent known.
+func (f *configFile) line(path string) int {
+	for {
+		if l, ok := f.lines[path]; ok {
+			return l
+		}
+		i := strings.LastIndexByte(path, '.')
+		if i < 0 {
+			return 0
+		}
+		path = path[:i]
+	}
+}
+
+func (f *configFile) errorAt(line int, err error) error {
+	return &ConfigError{Path: f.path, Line: line, Err: err}
+}
+
+func decodeConfigFile(path string, data []byte) (*configFile, error) {
+	f := &configFile{path: path, lines: make(map[string]int)}
+	var v interface{}
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		v, err = f.decodeYAML(data)
+	case ".toml":
+		v, err = f.decodeTOML(data)
+	default:
+		v, err = f.decodeJSON(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		v = map[string]interface{}{}
+	}
+	doc, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, f.errorAt(1, errors.New("config is not an object"))
+	}
+	f.doc = doc
+	return f, nil
+}
+
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte{'\n'}) + 1
+}
+
+func (f *configFile) decodeJSON(data []byte) (interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		if se, ok := err.(*json.SyntaxError); ok {
+			return nil, f.errorAt(lineAt(data, se.Offset), err)
+		}
+		return nil, f.errorAt(0, err)
+	}
+	// the syntax is fine, walk the tokens again for the lines
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var walk func(path string) error
+	walk = func(path string) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				p := joinPath(path, key.(string))
+				f.lines[p] = lineAt(data, dec.InputOffset())
+				if err = walk(p); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				p := joinPath(path, strconv.Itoa(i))
+				// the offset is before the separator
+				off := dec.InputOffset()
+				for off < int64(len(data)) && strings.IndexByte(" \t\r\n,", data[off]) >= 0 {
+					off++
+				}
+				f.lines[p] = lineAt(data, off)
+				if err = walk(p); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		}
+		return err
+	}
+	if err := walk(""); err != nil {
+		return nil, f.errorAt(0, err)
+	}
+	return v, nil
+}
+
+func (f *configFile) decodeYAML(data []byte) (interface{}, error) {
+	var n yaml.Node
+	if err := yaml.Unmarshal(data, &n); err != nil {
+		return nil, f.errorAt(0, err)
+	}
+	return f.yamlValue(&n, "")
+}
+
+func (f *configFile) yamlValue(n *yaml.Node, path string) (interface{}, error) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return nil, nil
+		}
+		return f.yamlValue(n.Content[0], path)
+	case yaml.AliasNode:
+		return f.yamlValue(n.Alias, path)
+	case yaml.MappingNode:
+		m := make(map[string]interface{}, len(n.Content)/2)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			p := joinPath(path, key.Value)
+			f.lines[p] = key.Line
+			v, err := f.yamlValue(n.Content[i+1], p)
+			if err != nil {
+				return nil, err
+			}
+			m[key.Value] = v
+		}
+		return m, nil
+	case yaml.SequenceNode:
+		a := make([]interface{}, len(n.Content))
+		for i, item := range n.Content {
+			p := joinPath(path, strconv.Itoa(i))
+			f.lines[p] = item.Line
+			v, err := f.yamlValue(item, p)
+			if err != nil {
+				return nil, err
+			}
+			a[i] = v
+		}
+		return a, nil
+	}
+	var err error
+	switch n.ShortTag() {
+	case "!!null":
+		return nil, nil
+	case "!!bool":
+		var b bool
+		if err = n.Decode(&b); err == nil {
+			return b, nil
+		}
+	case "!!int", "!!float":
+		var x float64
+		if err = n.Decode(&x); err == nil {
+			return x, nil
+		}
+	default:
+		// strings, and the timestamps and binaries as written
+		return n.Value, nil
+	}
+	return nil, f.errorAt(n.Line, err)
+}
+
+func (f *configFile) decodeTOML(data []byte) (interface{}, error) {
+	var m map[string]interface{}
+	if _, err := toml.Decode(string(data), &m); err != nil {
+		if pe, ok := err.(toml.ParseError); ok {
+			return nil, f.errorAt(pe.Position.Line, errors.New(pe.Message))
+		}
+		return nil, f.errorAt(0, err)
+	}
+	f.tomlLines(data)
+	// convert the integers, datetimes and arrays of tables to the json values
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, f.errorAt(0, err)
+	}
+	var v interface{}
+	if err = json.Unmarshal(b, &v); err != nil {
+		return nil, f.errorAt(0, err)
+	}
+	return v, nil
+}
+
+// tomlLines finds the lines of the tables and keys, which the decoder
+// doesn't give. The values of inline tables and multi-line arrays get the
+// line of their key.
+func (f *configFile) tomlLines(data []byte) {
+	table := ""
+	arrays := make(map[string]int)
+	multiline := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if multiline != "" {
+			if strings.Contains(line, multiline) {
+				multiline = ""
+			}
+			continue
+		}
+		switch {
+		case line == "" || line[0] == '#':
+		case strings.HasPrefix(line, "[["):
+			if end := strings.Index(line, "]]"); end > 0 {
+				name := tomlKey(line[2:end])
+				if _, ok := f.lines[name]; !ok {
+					f.lines[name] = i + 1
+				}
+				table = joinPath(name, strconv.Itoa(arrays[name]))
+				arrays[name]++
+				f.lines[table] = i + 1
+			}
+		case line[0] == '[':
+			if end := strings.IndexByte(line, ']'); end > 0 {
+				table = tomlKey(line[1:end])
+				f.lines[table] = i + 1
+			}
+		default:
+			eq := strings.IndexByte(line, '=')
+			if eq <= 0 {
+				continue
+			}
+			f.lines[joinPath(table, tomlKey(line[:eq]))] = i + 1
+			for _, quote := range []string{`"""`, `'''`} {
+				if strings.Count(line[eq:], quote) == 1 {
+					multiline = quote
+				}
+			}
+		}
+	}
+}
+
+// tomlKey returns the dotted key s with the quotes and spaces removed.
+func tomlKey(s string) string {
+	var parts []string
+	var part []byte
+	quote := byte(0)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				part = append(part, c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '.':
+			parts = append(parts, string(part))
+			part = part[:0]
+		case c != ' ' && c != '\t':
+			part = append(part, c)
+		}
+	}
+	return strings.Join(append(parts, string(part)), ".")
+}
+
+var (
+	configType      = reflect.TypeOf(Config{})
+	portUserType    = reflect.TypeOf(PortUser{})
+	serverEntryType = reflect.TypeOf(serverEntry{})
+	stringsType     = reflect.TypeOf([]string(nil))
+)
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// obsoleteConfigFields are options of older versions, or of the other
+// implementations, common in config files. They're ignored with a warning
+// rather than failing as unknown.
+var obsoleteConfigFields = map[string]bool{
+	"cache_enctable": true,
+	"workers":        true,
+}
+
+// check returns the first unknown field or value of the wrong type, in the
+// order of the keys.
+func (f *configFile) check() error {
+	for _, key := range sortedKeys(f.doc) {
+		if obsoleteConfigFields[key] {
+			mainLog.Warn("ignore obsolete config field", F("file", f.path), F("line", f.line(key)), F("field", key))
+			delete(f.doc, key)
+			continue
+		}
+		path, err := checkConfigField(key, f.doc[key])
+		if err != nil {
+			return f.errorAt(f.line(path), err)
+		}
+	}
+	return nil
+}
+
+func checkConfigField(key string, v interface{}) (string, error) {
+	switch key {
+	case "include":
+		if _, err := includePaths(v); err != nil {
+			return key, err
+		}
+		return "", nil
+	case "server":
+		if _, ok := v.(string); ok || v == nil {
+			return "", nil
+		}
+		if _, ok := v.([]interface{}); !ok {
+			return key, errors.New("server: want a string or an array of strings")
+		}
+		return checkValue(v, stringsType, key)
+	case "port_password":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return checkValue(v, reflect.TypeOf(map[string]string(nil)), key)
+		}
+		for _, port := range sortedKeys(m) {
+			if _, ok := m[port].(string); ok {
+				continue
+			}
+			if path, err := checkValue(m[port], portUserType, joinPath(key, port)); err != nil {
+				return path, err
+			}
+		}
+		return "", nil
+	case "server_password":
+		a, ok := v.([]interface{})
+		if !ok {
+			return checkValue(v, stringsType, key)
+		}
+		for i, entry := range a {
+			t := serverEntryType
+			if _, ok := entry.([]interface{}); ok {
+				t = stringsType
+			}
+			if path, err := checkValue(entry, t, joinPath(key, strconv.Itoa(i))); err != nil {
+				return path, err
+			}
+		}
+		return "", nil
+	}
+	field, ok := jsonField(configType, key)
+	if !ok {
+		return key, fmt.Errorf("unknown field %q", key)
+	}
+	return checkValue(v, field.Type, key)
+}
+
+// jsonField returns the field of struct t encoding/json decodes key to.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	var fold *reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if name == key {
+			return field, true
+		}
+		if fold == nil && strings.EqualFold(name, key) {
+			fold = &field
+		}
+	}
+	if fold != nil {
+		return *fold, true
+	}
+	return reflect.StructField{}, false
+}
+
+// checkValue checks the decoded value v can be decoded to type t, returning
+// the path of the first error.
+func checkValue(v interface{}, t reflect.Type, path string) (string, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if v == nil {
+		return "", nil
+	}
+	var want string
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			want = "an object"
+			break
+		}
+		for _, key := range sortedKeys(m) {
+			p := joinPath(path, key)
+			field, ok := jsonField(t, key)
+			if !ok {
+				return p, fmt.Errorf("unknown field %q", p)
+			}
+			if p, err := checkValue(m[key], field.Type, p); err != nil {
+				return p, err
+			}
+		}
+		return "", nil
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			want = "an object"
+			break
+		}
+		for _, key := range sortedKeys(m) {
+			if p, err := checkValue(m[key], t.Elem(), joinPath(path, key)); err != nil {
+				return p, err
+			}
+		}
+		return "", nil
+	case reflect.Slice:
+		a, ok := v.([]interface{})
+		if !ok {
+			want = "an array"
+			break
+		}
+		for i, item := range a {
+			if p, err := checkValue(item, t.Elem(), joinPath(path, strconv.Itoa(i))); err != nil {
+				return p, err
+			}
+		}
+		return "", nil
+	case reflect.String:
+		if _, ok := v.(string); ok {
+			return "", nil
+		}
+		want = "a string"
+	case reflect.Bool:
+		if _, ok := v.(bool); ok {
+			return "", nil
+		}
+		want = "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if x, ok := v.(float64); ok && x == math.Trunc(x) {
+			return "", nil
+		}
+		want = "an integer"
+	case reflect.Float32, reflect.Float64:
+		if _, ok := v.(float64); ok {
+			return "", nil
+		}
+		want = "a number"
+	default:
+		return "", nil
+	}
+	return path, fmt.Errorf("%s: want %s, got %s", path, want, jsonTypeName(v))
+}
+
+func jsonTypeName(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "null"
+}
+
+// includePaths returns the files an include value names, a path or an
+// array of paths.
+func includePaths(v interface{}) ([]string, error) {
+	errInclude := errors.New("include: want a path or an array of paths")
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		paths := make([]string, len(v))
+		for i, p := range v {
+			s, ok := p.(string)
+			if !ok {
+				return nil, errInclude
+			}
+			paths[i] = s
+		}
+		return paths, nil
+	}
+	return nil, errInclude
+}
+
+// loadConfigDoc reads and checks the config file and the files it includes,
+// parents are the files including it. The sources are the files giving the
+// values, by path. The files read, or tried, are added to files if not nil.
+func loadConfigDoc(path string, parents []string, files *[]string) (doc map[string]interface{}, sources map[string]string, err error) {
+	if files != nil {
+		*files = append(*files, path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	f, err := decodeConfigFile(path, data)
+	if err != nil {
+		return
+	}
+	if err = f.check(); err != nil {
+		return
+	}
+	includes, _ := includePaths(f.doc["include"])
+	delete(f.doc, "include")
+	parents = append(parents[:len(parents):len(parents)], filepath.Clean(path))
+	doc = make(map[string]interface{})
+	sources = make(map[string]string)
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		for _, p := range parents {
+			if p == include {
+				return nil, nil, f.errorAt(f.line("include"), fmt.Errorf("%s included recursively", include))
+			}
+		}
+		included, includedSources, err := loadConfigDoc(include, parents, files)
+		if err != nil {
+			if _, ok := err.(*ConfigError); !ok {
+				err = f.errorAt(f.line("include"), err)
+			}
+			return nil, nil, err
+		}
+		mergeConfigDoc(doc, included, sources, includedSources, "")
+	}
+	mergeConfigDoc(doc, f.doc, sources, map[string]string{"": "file " + path}, "")
+	return doc, sources, nil
+}
+
+// mergeConfigDoc merges src at path over dst, the objects key by key except
+// the port_password entries, which are replaced as a whole. The sources of
+// the values replaced are updated from srcSources, where the source of a
+// value is the one of its closest parent given.
+func mergeConfigDoc(dst, src map[string]interface{}, dstSources, srcSources map[string]string, path string) {
+	for key, v := range src {
+		p := joinPath(path, key)
+		if sm, ok := v.(map[string]interface{}); ok && path != "port_password" {
+			if dm, ok := dst[key].(map[string]interface{}); ok {
+				mergeConfigDoc(dm, sm, dstSources, srcSources, p)
+				continue
+			}
+		}
+		dst[key] = v
+		for sp := range dstSources {
+			if strings.HasPrefix(sp, p+".") {
+				delete(dstSources, sp)
+			}
+		}
+		dstSources[p] = lookupSource(srcSources, p)
+		for sp, source := range srcSources {
+			if strings.HasPrefix(sp, p+".") {
+				dstSources[sp] = source
+			}
+		}
+	}
+}
+
+func lookupSource(sources map[string]string, path string) string {
+	for {
+		if source, ok := sources[path]; ok {
+			return source
+		}
+		if path == "" {
+			return ""
+		}
+		i := strings.LastIndexByte(path, '.')
+		if i < 0 {
+			i = 0
+		}
+		path = path[:i]
+	}
+}
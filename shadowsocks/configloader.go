@@ -0,0 +1,506 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigLoader builds the config in layers, each overriding the values of
+// the ones before: the defaults, the config file, the SS_ environment
+// variables and the command line flags. Any option can be set in any layer,
+// and an option set to its zero value, e.g. SS_TIMEOUT=0, is set.
+//
+// The environment variables and flags are named after the path of the
+// option, SS_OUTBOUND_CONNECT_TIMEOUT and -outbound-connect-timeout for
+// connect_timeout in outbound. The values are written as in the config
+// file, arrays and objects in JSON, or arrays as comma-separated lists and
+// objects by entry: SS_PORT_PASSWORD_8388=foobar or -port-password
+// 8388=foobar. The server_password entries are server,password[,method[,key]]
+// or JSON, in SS_SERVER_PASSWORD, SS_SERVER_PASSWORD_0, _1 and so on, or the
+// repeated -server-password flag. A repeated flag adds to the array or
+// object.
+type ConfigLoader struct {
+	// File is the config file, skipped if it doesn't exist.
+	File string
+	// Defaults are the non-zero values of the config.
+	Defaults *Config
+	// Env is the environment, os.Environ() if nil.
+	Env []string
+
+	flags   *configLayer
+	sources map[string]string
+	files   []string
+}
+
+// configLayer is a config document with the sources of the values, by
+// path, see mergeConfigDoc.
+type configLayer struct {
+	doc     map[string]interface{}
+	sources map[string]string
+}
+
+func newConfigLayer() *configLayer {
+	return &configLayer{doc: make(map[string]interface{}), sources: make(map[string]string)}
+}
+
+// set sets the option at path to v, adding to the array or object set
+// before, then checks it.
+func (c *configLayer) set(path string, v interface{}, source string) error {
+	keys := strings.Split(path, ".")
+	m := c.doc
+	for _, key := range keys[:len(keys)-1] {
+		sub, ok := m[key].(map[string]interface{})
+		if !ok {
+			sub = make(map[string]interface{})
+			m[key] = sub
+		}
+		m = sub
+	}
+	last := keys[len(keys)-1]
+	switch v := v.(type) {
+	case []interface{}:
+		if old, ok := m[last].([]interface{}); ok {
+			m[last] = append(old, v...)
+		} else {
+			m[last] = v
+		}
+		c.sources[path] = source
+	case map[string]interface{}:
+		old, ok := m[last].(map[string]interface{})
+		if !ok {
+			old = make(map[string]interface{})
+			m[last] = old
+		}
+		for key, entry := range v {
+			old[key] = entry
+			c.sources[joinPath(path, key)] = source
+		}
+	default:
+		m[last] = v
+		c.sources[path] = source
+	}
+	_, err := checkConfigField(keys[0], c.doc[keys[0]])
+	return err
+}
+
+// configOption is an option of the config. The options of struct type,
+// given as JSON, are followed by their fields.
+type configOption struct {
+	path string
+	t    reflect.Type
+}
+
+func configOptions() []configOption {
+	var opts []configOption
+	var walk func(t reflect.Type, path string)
+	walk = func(t reflect.Type, path string) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if field.PkgPath != "" || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			p := joinPath(path, name)
+			ft := field.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			opts = append(opts, configOption{p, ft})
+			if ft.Kind() == reflect.Struct {
+				walk(ft, p)
+			}
+		}
+	}
+	walk(configType, "")
+	return opts
+}
+
+func lookupOption(path string) (configOption, bool) {
+	for _, opt := range configOptions() {
+		if opt.path == path {
+			return opt, true
+		}
+	}
+	return configOption{}, false
+}
+
+func (opt configOption) flagName() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(opt.path)
+}
+
+func (opt configOption) envName() string {
+	return "SS_" + strings.ToUpper(strings.Replace(opt.path, ".", "_", -1))
+}
+
+func (opt configOption) usage() string {
+	switch {
+	case opt.path == "server_password":
+		return "server_password entry, server,password[,method[,key]] or JSON, repeatable"
+	case opt.t.Kind() == reflect.Map:
+		return opt.path + " entry as key=value, repeatable"
+	case opt.t.Kind() == reflect.Slice:
+		return opt.path + " option, comma-separated, repeatable"
+	case opt.t.Kind() == reflect.Struct:
+		return opt.path + " option as a JSON object"
+	}
+	return opt.path + " option"
+}
+
+// parse parses the value of the option given as a string, see ConfigLoader.
+// The server_password value is an array of the entry.
+func (opt configOption) parse(s string) (interface{}, error) {
+	if opt.path == "server_password" {
+		entry, err := parseServerEntry(s)
+		return []interface{}{entry}, err
+	}
+	return parseOptionValue(opt.path, opt.t, s)
+}
+
+func parseOptionValue(path string, t reflect.Type, s string) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.String, reflect.Interface:
+		return s, nil
+	case reflect.Bool:
+		return strconv.ParseBool(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseInt(s, 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		return float64(n), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(s, 64)
+	case reflect.Slice:
+		if strings.HasPrefix(s, "[") {
+			return parseJSONValue(s)
+		}
+		var a []interface{}
+		for _, item := range strings.Split(s, ",") {
+			v, err := parseOptionValue(path, t.Elem(), strings.TrimSpace(item))
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		return a, nil
+	case reflect.Struct:
+		return parseJSONValue(s)
+	case reflect.Map:
+		if strings.HasPrefix(s, "{") {
+			return parseJSONValue(s)
+		}
+		i := strings.IndexByte(s, '=')
+		if i <= 0 {
+			return nil, errors.New("want key=value")
+		}
+		key, value := s[:i], s[i+1:]
+		if path == "port_password" && strings.HasPrefix(value, "{") {
+			// the object form, or a password starting with a brace
+			if v, err := parseJSONValue(value); err == nil {
+				return map[string]interface{}{key: v}, nil
+			}
+		}
+		v, err := parseOptionValue(joinPath(path, key), t.Elem(), value)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{key: v}, nil
+	}
+	return nil, fmt.Errorf("%s can't be given as a string", path)
+}
+
+func parseJSONValue(s string) (interface{}, error) {
+	var v interface{}
+	err := json.Unmarshal([]byte(s), &v)
+	return v, err
+}
+
+// parseServerEntry parses a server_password entry, the comma-separated
+// server, password, method and key, or JSON.
+func parseServerEntry(s string) (interface{}, error) {
+	if strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{") {
+		return parseJSONValue(s)
+	}
+	var entry []interface{}
+	for _, item := range strings.SplitN(s, ",", 4) {
+		entry = append(entry, item)
+	}
+	return entry, nil
+}
+
+// optionFlag sets an option from the command line.
+type optionFlag struct {
+	l    *ConfigLoader
+	name string
+	opt  configOption
+}
+
+func (f *optionFlag) String() string {
+	return ""
+}
+
+func (f *optionFlag) IsBoolFlag() bool {
+	return f.opt.t.Kind() == reflect.Bool
+}
+
+func (f *optionFlag) Set(s string) error {
+	v, err := f.opt.parse(s)
+	if err != nil {
+		return err
+	}
+	return f.l.flags.set(f.opt.path, v, "flag -"+f.name)
+}
+
+// Flag defines a flag for the option at path, e.g. a short name. It panics
+// if there's no such option.
+func (l *ConfigLoader) Flag(fs *flag.FlagSet, name, path, usage string) {
+	opt, ok := lookupOption(path)
+	if !ok {
+		panic("shadowsocks: no config option " + path)
+	}
+	if l.flags == nil {
+		l.flags = newConfigLayer()
+	}
+	fs.Var(&optionFlag{l, name, opt}, name, usage)
+}
+
+// Flags defines the flags of all the options, named after their path, that
+// are not defined in fs yet.
+func (l *ConfigLoader) Flags(fs *flag.FlagSet) {
+	for _, opt := range configOptions() {
+		if fs.Lookup(opt.flagName()) == nil {
+			l.Flag(fs, opt.flagName(), opt.path, opt.usage())
+		}
+	}
+}
+
+// envLayer reads the SS_ environment variables. Unknown ones are ignored
+// with a warning, they may be for something else.
+func (l *ConfigLoader) envLayer() (*configLayer, error) {
+	env := l.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	opts := configOptions()
+	byName := make(map[string]configOption, len(opts))
+	for _, opt := range opts {
+		byName[opt.envName()] = opt
+	}
+	layer := newConfigLayer()
+	vars := make(map[string]string)
+	var names []string
+	for _, kv := range env {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 || !strings.HasPrefix(kv, "SS_") {
+			continue
+		}
+		vars[kv[:i]] = kv[i+1:]
+		names = append(names, kv[:i])
+	}
+	// the server_password entries in the order of their index
+	entryIndex := func(name string) int {
+		const prefix = "SS_SERVER_PASSWORD_"
+		if !strings.HasPrefix(name, prefix) {
+			return -1
+		}
+		n, err := strconv.Atoi(name[len(prefix):])
+		if err != nil || n < 0 {
+			return -1
+		}
+		return n
+	}
+	sortKey := func(name string) string {
+		if n := entryIndex(name); n >= 0 {
+			return fmt.Sprintf("SS_SERVER_PASSWORD_%010d", n)
+		}
+		return name
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return sortKey(names[i]) < sortKey(names[j])
+	})
+	for _, name := range names {
+		value := vars[name]
+		opt, ok := byName[name]
+		if !ok && entryIndex(name) >= 0 {
+			opt, ok = byName["SS_SERVER_PASSWORD"], true
+		}
+		if !ok {
+			// an object entry, SS_<option>_<key>
+			for _, o := range opts {
+				prefix := o.envName() + "_"
+				if o.t.Kind() == reflect.Map && strings.HasPrefix(name, prefix) {
+					opt, ok = o, true
+					value = strings.ToLower(name[len(prefix):]) + "=" + value
+					break
+				}
+			}
+		}
+		if !ok {
+			mainLog.Warn("ignore unknown environment variable", F("name", name))
+			continue
+		}
+		v, err := opt.parse(value)
+		if err == nil {
+			err = layer.set(opt.path, v, "env "+name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("shadowsocks: %s: %v", name, err)
+		}
+	}
+	return layer, nil
+}
+
+// pruneConfigDoc removes the null, zero and empty values of doc.
+func pruneConfigDoc(doc map[string]interface{}) {
+	for key, v := range doc {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			pruneConfigDoc(v)
+			if len(v) > 0 {
+				continue
+			}
+		case []interface{}:
+			if len(v) > 0 {
+				continue
+			}
+		case string:
+			if v != "" {
+				continue
+			}
+		case float64:
+			if v != 0 {
+				continue
+			}
+		case bool:
+			if v {
+				continue
+			}
+		}
+		delete(doc, key)
+	}
+}
+
+// Load builds the config from the layers. The file is read again, as are
+// the environment variables, the flags are those parsed.
+func (l *ConfigLoader) Load() (*Config, error) {
+	doc := make(map[string]interface{})
+	sources := make(map[string]string)
+	if l.Defaults != nil {
+		data, err := json.Marshal(l.Defaults)
+		if err != nil {
+			return nil, err
+		}
+		defaults := make(map[string]interface{})
+		if err = json.Unmarshal(data, &defaults); err != nil {
+			return nil, err
+		}
+		pruneConfigDoc(defaults)
+		mergeConfigDoc(doc, defaults, sources, map[string]string{"": "default"}, "")
+	}
+	var files []string
+	if l.File != "" {
+		fileDoc, fileSources, err := loadConfigDoc(l.File, nil, &files)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			mergeConfigDoc(doc, fileDoc, sources, fileSources, "")
+		}
+	}
+	env, err := l.envLayer()
+	if err != nil {
+		return nil, err
+	}
+	mergeConfigDoc(doc, env.doc, sources, env.sources, "")
+	if l.flags != nil {
+		// a copy, the flags are merged again on the next load
+		data, err := json.Marshal(l.flags.doc)
+		if err != nil {
+			return nil, err
+		}
+		flags := make(map[string]interface{})
+		if err = json.Unmarshal(data, &flags); err != nil {
+			return nil, err
+		}
+		mergeConfigDoc(doc, flags, sources, l.flags.sources, "")
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if err = config.ResolveSecrets(); err != nil {
+		return nil, err
+	}
+	setReadTimeout(time.Duration(config.Timeout) * time.Second)
+	l.sources = sources
+	l.files = files
+	return config, nil
+}
+
+// Files returns the config file and the files it includes, as read by the
+// last config loaded.
+func (l *ConfigLoader) Files() []string {
+	return l.files
+}
+
+// Sources returns the layer that gave each value of the last config loaded,
+// "default", "file <path>", "env <name>" or "flag -<name>", by the path of
+// the value. The source of a value not in it is the one of its closest
+// parent.
+func (l *ConfigLoader) Sources() map[string]string {
+	return l.sources
+}
+
+// PrintConfigSources prints the values set by the layers, redacted, with
+// the layer that gave each, for -dump-config.
+func PrintConfigSources(config *Config, sources map[string]string) error {
+	data, err := json.Marshal(config.Redacted())
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	var print func(path string, v interface{})
+	print = func(path string, v interface{}) {
+		if m, ok := v.(map[string]interface{}); ok && len(m) > 0 {
+			for _, key := range sortedKeys(m) {
+				print(joinPath(path, key), m[key])
+			}
+			return
+		}
+		source := lookupSource(sources, path)
+		if source == "" {
+			return
+		}
+		if _, ok := sources[path]; !ok {
+			// the zero values of an object given are not set
+			zero := map[string]interface{}{"v": v}
+			if pruneConfigDoc(zero); len(zero) == 0 {
+				return
+			}
+		}
+		value, _ := json.Marshal(v)
+		fmt.Printf("%s = %s (%s)\n", path, value, source)
+	}
+	print("", doc)
+	return nil
+}
@@ -0,0 +1,112 @@
+package shadowsocks
+
+import (
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigLoader(t *testing.T) {
+	l := &ConfigLoader{
+		File:     "testdata/include.yaml",
+		Defaults: &Config{Timeout: 300, Method: DefaultCipherMethod, LocalPort: 1080},
+		Env: []string{
+			"PATH=/bin",
+			"SS_TIMEOUT=0",
+			"SS_PORT_PASSWORD_9000=envpw",
+			"SS_OUTBOUND_KEEPALIVE=30",
+			"SS_SERVER_PASSWORD_10=127.0.0.1:8390,foobar",
+			"SS_SERVER_PASSWORD_2=127.0.0.1:8389,barfoo,rc4",
+			`SS_SERVER_PASSWORD={"server": "127.0.0.1:8388", "key": "AAECAwQFBgcICQoLDA0ODw=="}`,
+		},
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	l.Flag(fs, "p", "server_port", "server port")
+	l.Flags(fs)
+	err := fs.Parse([]string{"-p", "8388", "-port-password", "8387=flagpw", "-port-password", "9001={\"key\": \"AAECAwQFBgcICQoLDA0ODw==\"}",
+		"-udp", "-acl-deny-cidr", "10.0.0.0/8", "-acl-deny-cidr", "192.168.0.0/16,172.16.0.0/12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := l.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Timeout != 0 {
+		t.Errorf("timeout %d, SS_TIMEOUT=0 should override the file", config.Timeout)
+	}
+	if config.Method != "aes-128-cfb" || config.LocalPort != 1080 || config.ServerPort != 8388 || !config.UDP {
+		t.Errorf("method %s local_port %d server_port %d udp %v", config.Method, config.LocalPort, config.ServerPort, config.UDP)
+	}
+	want := map[string]string{"8387": "flagpw", "8388": "barfoo", "8390": "foobar!", "9000": "envpw"}
+	if !reflect.DeepEqual(config.PortPassword, want) {
+		t.Errorf("port_password got %v", config.PortPassword)
+	}
+	if len(config.PortUsers) != 2 || config.PortUsers["9001"] == nil || config.PortUsers["9001"].Key == "" {
+		t.Errorf("port_password objects got %v", config.PortUsers)
+	}
+	if o := config.Outbound; o == nil || o.ConnectTimeout != 5 || o.KeepAlive != 30 {
+		t.Errorf("outbound got %+v", o)
+	}
+	if acl := config.ACL; acl == nil || !reflect.DeepEqual(acl.DenyCIDR, []string{"10.0.0.0/8", "192.168.0.0/16", "172.16.0.0/12"}) {
+		t.Errorf("acl got %+v", acl)
+	}
+	servers := [][]string{
+		{"127.0.0.1:8388", "", "", "AAECAwQFBgcICQoLDA0ODw=="},
+		{"127.0.0.1:8389", "barfoo", "rc4"},
+		{"127.0.0.1:8390", "foobar"},
+	}
+	if !reflect.DeepEqual(config.ServerPassword, servers) {
+		t.Errorf("server_password got %v", config.ServerPassword)
+	}
+
+	sources := map[string]string{
+		"local_port":              "default",
+		"method":                  "file testdata/include.yaml",
+		"port_password.8388":      "file testdata/include-users.toml",
+		"port_password.8387":      "flag -port-password",
+		"port_password.9000":      "env SS_PORT_PASSWORD_9000",
+		"timeout":                 "env SS_TIMEOUT",
+		"outbound.fallback_delay": "file testdata/include-users.toml",
+		"outbound.keepalive":      "env SS_OUTBOUND_KEEPALIVE",
+		"server_port":             "flag -p",
+	}
+	for path, source := range sources {
+		if got := lookupSource(l.Sources(), path); got != source {
+			t.Errorf("source of %s is %q, want %q", path, got, source)
+		}
+	}
+}
+
+func TestConfigLoaderErrors(t *testing.T) {
+	tests := []struct {
+		env []string
+		err string
+	}{
+		{[]string{"SS_TIMEOUT=abc"}, "SS_TIMEOUT"},
+		{[]string{"SS_ACL_BLOCK_PORTS=25,smtp"}, "SS_ACL_BLOCK_PORTS"},
+		{[]string{`SS_OUTBOUND={"connect_timout": 5}`}, `unknown field "outbound.connect_timout"`},
+		{[]string{"SS_PORT_PASSWORD_8388={\"pasword\": \"foobar\"}"}, `unknown field "port_password.8388.pasword"`},
+	}
+	for _, tt := range tests {
+		l := &ConfigLoader{File: "testdata/none.json", Env: tt.env}
+		if _, err := l.Load(); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: got %v, want %s", tt.env, err, tt.err)
+		}
+	}
+
+	l := &ConfigLoader{Env: []string{}}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	l.Flags(fs)
+	if err := fs.Parse([]string{"-timeout", "abc"}); err == nil {
+		t.Error("invalid flag value should fail")
+	}
+	if err := fs.Parse([]string{"-port-password", "8388"}); err == nil {
+		t.Error("port_password without a password should fail")
+	}
+}
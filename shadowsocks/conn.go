@@ -1,11 +1,13 @@
 package shadowsocks
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"time"
 )
 
 const (
@@ -17,6 +19,13 @@ type Conn struct {
 	*Cipher
 	readBuf  []byte
 	writeBuf []byte
+
+	// aead ciphers only, the chunk read and its data not yet returned
+	chunk   []byte
+	pending []byte
+
+	// the address not sent yet, see DialWithRawAddrLazy
+	header []byte
 }
 
 func NewConn(c net.Conn, cipher *Cipher) *Conn {
@@ -57,7 +66,46 @@ func RawAddr(addr string) (buf []byte, err error) {
 // rawaddr shoud contain part of the data in socks request, starting from the
 // ATYP field. (Refer to rfc1928 for more information.)
 func DialWithRawAddr(rawaddr []byte, server string, cipher *Cipher) (c *Conn, err error) {
-	conn, err := net.Dial("tcp", server)
+	return DialWithRawAddrDialer((*OutboundDialer)(nil), rawaddr, server, cipher)
+}
+
+// NetDialer is implemented by OutboundDialer and ProxyChain.
+type NetDialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// ContextDialer is implemented by net.Dialer, OutboundDialer, ProxyChain and
+// Dialer. It's the same as proxy.ContextDialer of golang.org/x/net/proxy.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// DialWithRawAddrContext is like DialWithRawAddr, connecting to server with
+// d, nil for the default OutboundDialer. ctx covers connecting and sending
+// the address.
+func DialWithRawAddrContext(ctx context.Context, d ContextDialer, rawaddr []byte, server string, cipher *Cipher) (c *Conn, err error) {
+	if d == nil {
+		d = (*OutboundDialer)(nil)
+	}
+	conn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	c = NewConn(conn, cipher)
+	if _, err = c.Write(rawaddr); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return
+}
+
+// DialWithRawAddrDialer is like DialWithRawAddr, connecting to server with d.
+func DialWithRawAddrDialer(d NetDialer, rawaddr []byte, server string, cipher *Cipher) (c *Conn, err error) {
+	conn, err := d.Dial("tcp", server)
 	if err != nil {
 		return
 	}
@@ -69,6 +117,29 @@ func DialWithRawAddr(rawaddr []byte, server string, cipher *Cipher) (c *Conn, er
 	return
 }
 
+// DialWithRawAddrLazy is like DialWithRawAddrDialer, but rawaddr is only
+// sent with the first Write, so the iv, the address and the first data go
+// in one segment. Flush sends it alone, e.g. when the client waits for the
+// destination to speak first.
+func DialWithRawAddrLazy(d NetDialer, rawaddr []byte, server string, cipher *Cipher) (c *Conn, err error) {
+	conn, err := d.Dial("tcp", server)
+	if err != nil {
+		return
+	}
+	c = NewConn(conn, cipher)
+	c.header = append([]byte(nil), rawaddr...)
+	return
+}
+
+// Flush sends the address kept by DialWithRawAddrLazy if not sent yet.
+func (c *Conn) Flush() error {
+	if c.header == nil {
+		return nil
+	}
+	_, err := c.Write(nil)
+	return err
+}
+
 // addr should be in the form of host:port
 func Dial(addr, server string, cipher *Cipher) (c *Conn, err error) {
 	ra, err := RawAddr(addr)
@@ -78,6 +149,15 @@ func Dial(addr, server string, cipher *Cipher) (c *Conn, err error) {
 	return DialWithRawAddr(ra, server, cipher)
 }
 
+// DialContext is like Dial with a context.
+func DialContext(ctx context.Context, addr, server string, cipher *Cipher) (c *Conn, err error) {
+	ra, err := RawAddr(addr)
+	if err != nil {
+		return
+	}
+	return DialWithRawAddrContext(ctx, nil, ra, server, cipher)
+}
+
 func (c *Conn) GetIv() (iv []byte) {
 	iv = make([]byte, len(c.iv))
 	copy(iv, c.iv)
@@ -91,6 +171,9 @@ func (c *Conn) GetKey() (key []byte) {
 }
 
 func (c *Conn) Read(b []byte) (n int, err error) {
+	if c.isAEAD() {
+		return c.readAEAD(b)
+	}
 	if c.dec == nil {
 		iv := make([]byte, c.info.ivLen)
 		if _, err = io.ReadFull(c.Conn, iv); err != nil {
@@ -119,6 +202,22 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 }
 
 func (c *Conn) Write(b []byte) (n int, err error) {
+	if c.header != nil {
+		header := c.header
+		c.header = nil
+		n, err = c.write(append(header, b...))
+		if n -= len(header); n < 0 {
+			n = 0
+		}
+		return
+	}
+	return c.write(b)
+}
+
+func (c *Conn) write(b []byte) (n int, err error) {
+	if c.isAEAD() {
+		return c.writeAEAD(b)
+	}
 	var iv []byte
 	if c.enc == nil {
 		iv, err = c.initEncrypt()
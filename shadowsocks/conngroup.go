@@ -0,0 +1,104 @@
+package shadowsocks
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnGroup tracks the live connections accepted on a listener, so they can
+// be drained or force closed when the listener goes away.
+//
+// Register the raw accepted connection, not the *Conn wrapping it: closing a
+// *Conn twice returns its buffers to the leaky buffer twice.
+type ConnGroup struct {
+	sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	empty  chan struct{} // closed when the group becomes empty
+}
+
+func NewConnGroup() *ConnGroup {
+	return &ConnGroup{conns: map[net.Conn]struct{}{}}
+}
+
+// Add registers c with the group. It returns false if the group has been
+// closed, in which case the caller should close c itself.
+func (g *ConnGroup) Add(c net.Conn) bool {
+	g.Lock()
+	defer g.Unlock()
+	if g.closed {
+		return false
+	}
+	g.conns[c] = struct{}{}
+	return true
+}
+
+// Done removes c from the group once its handler has finished.
+func (g *ConnGroup) Done(c net.Conn) {
+	g.Lock()
+	defer g.Unlock()
+	delete(g.conns, c)
+	if len(g.conns) == 0 && g.empty != nil {
+		close(g.empty)
+		g.empty = nil
+	}
+}
+
+// Len returns the number of connections still in the group.
+func (g *ConnGroup) Len() int {
+	g.Lock()
+	defer g.Unlock()
+	return len(g.conns)
+}
+
+// Wait stops the group from accepting new connections and waits at most
+// timeout for the existing ones to finish. It returns true if the group
+// drained in time.
+func (g *ConnGroup) Wait(timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return g.WaitContext(ctx)
+}
+
+// WaitContext is like Wait, waiting until ctx is done.
+func (g *ConnGroup) WaitContext(ctx context.Context) bool {
+	g.Lock()
+	g.closed = true
+	if len(g.conns) == 0 {
+		g.Unlock()
+		return true
+	}
+	if g.empty == nil {
+		g.empty = make(chan struct{})
+	}
+	empty := g.empty
+	g.Unlock()
+
+	select {
+	case <-empty:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// CloseAll stops the group from accepting new connections and closes all the
+// connections still in it. Returns the number of connections closed.
+func (g *ConnGroup) CloseAll() int {
+	g.Lock()
+	g.closed = true
+	conns := make([]net.Conn, 0, len(g.conns))
+	for c := range g.conns {
+		conns = append(conns, c)
+	}
+	g.Unlock()
+
+	// Closing the connection makes the pipes reading from it fail, which
+	// in turn closes the other end, so the handler calls Done by itself.
+	for _, c := range conns {
+		c.Close()
+	}
+	return len(conns)
+}
@@ -0,0 +1,57 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnGroupWait(t *testing.T) {
+	g := NewConnGroup()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	if !g.Add(c1) {
+		t.Fatal("add to open group failed")
+	}
+	if g.Wait(10 * time.Millisecond) {
+		t.Error("wait should time out with a live connection")
+	}
+	if g.Add(c2) {
+		t.Error("add should fail once the group is draining")
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		g.Done(c1)
+	}()
+	if !g.Wait(time.Second) {
+		t.Error("wait should return once the connection is done")
+	}
+}
+
+func TestConnGroupCloseAll(t *testing.T) {
+	g := NewConnGroup()
+	c1, c2 := net.Pipe()
+	g.Add(c1)
+	done := make(chan struct{})
+	go func() {
+		// mimic a handler blocked on reading from the client
+		buf := make([]byte, 1)
+		c1.Read(buf)
+		g.Done(c1)
+		close(done)
+	}()
+	if n := g.CloseAll(); n != 1 {
+		t.Errorf("CloseAll closed %d connections, want 1", n)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handler not unblocked by CloseAll")
+	}
+	if _, err := c2.Write([]byte{0}); err == nil {
+		t.Error("peer of a closed connection should fail to write")
+	}
+	if g.Len() != 0 {
+		t.Errorf("group has %d connections after close", g.Len())
+	}
+}
@@ -0,0 +1,288 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OutboundConfig is the "outbound" section of the config, controlling how
+// the server connects to destinations and the client connects to servers.
+type OutboundConfig struct {
+	ConnectTimeout int           `json:"connect_timeout"` // seconds, default 10
+	FallbackDelay  int           `json:"fallback_delay"`  // ms before trying the next address, default 250, negative to try one by one
+	BindAddress    string        `json:"bind_address"`    // source ip
+	BindInterface  string        `json:"bind_interface"`  // linux only
+	KeepAlive      int           `json:"keepalive"`       // seconds, default 15, negative to disable
+	Socket         *SocketConfig `json:"socket"`          // tcp options, see SocketConfig
+}
+
+const (
+	defaultConnectTimeout = 10 * time.Second
+	defaultFallbackDelay  = 250 * time.Millisecond // recommended by RFC 8305
+)
+
+type outboundConf struct {
+	dialer        net.Dialer
+	fallbackDelay time.Duration // negative: no racing
+	socket        *SocketConfig
+}
+
+var defaultOutboundConf = &outboundConf{
+	dialer:        net.Dialer{Timeout: defaultConnectTimeout},
+	fallbackDelay: defaultFallbackDelay,
+}
+
+// OutboundDialer makes outbound connections. Names are resolved with
+// Resolver, the addresses are checked with ACL, then tried with Happy
+// Eyeballs (RFC 8305): a new attempt starts every fallback delay or as soon
+// as the previous one fails, alternating the address families, and the first
+// connection wins. A nil *OutboundDialer and the zero value use the defaults
+// and the system resolver. It's safe for concurrent use and can be reloaded
+// while in use.
+type OutboundDialer struct {
+	ACL      *ACL      // nil allows everything
+	Resolver *Resolver // nil uses the system resolver
+
+	mu   sync.RWMutex
+	conf *outboundConf
+}
+
+// NewOutboundDialer creates an OutboundDialer from config, nil uses the
+// defaults.
+func NewOutboundDialer(config *OutboundConfig) (*OutboundDialer, error) {
+	d := &OutboundDialer{}
+	if err := d.Load(config); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Load replaces the settings of the dialer. The old settings are kept on
+// error.
+func (d *OutboundDialer) Load(config *OutboundConfig) error {
+	conf := defaultOutboundConf
+	if config != nil {
+		conf = &outboundConf{
+			dialer:        net.Dialer{Timeout: defaultConnectTimeout},
+			fallbackDelay: defaultFallbackDelay,
+		}
+		if config.ConnectTimeout > 0 {
+			conf.dialer.Timeout = time.Duration(config.ConnectTimeout) * time.Second
+		}
+		if config.FallbackDelay != 0 {
+			conf.fallbackDelay = time.Duration(config.FallbackDelay) * time.Millisecond
+		}
+		if config.KeepAlive != 0 {
+			conf.dialer.KeepAlive = time.Duration(config.KeepAlive) * time.Second
+		}
+		if config.BindAddress != "" {
+			ip := net.ParseIP(config.BindAddress)
+			if ip == nil {
+				return fmt.Errorf("shadowsocks: outbound: invalid bind address %s", config.BindAddress)
+			}
+			// the port is set for each network in dialAddr
+			conf.dialer.LocalAddr = &net.IPAddr{IP: ip}
+		}
+		if config.BindInterface != "" {
+			control, err := bindToDevice(config.BindInterface)
+			if err != nil {
+				return err
+			}
+			conf.dialer.Control = control
+		}
+		if err := config.Socket.check(); err != nil {
+			return err
+		}
+		control, _ := config.Socket.control(false)
+		conf.dialer.Control = chainControl(conf.dialer.Control, control)
+		conf.socket = config.Socket
+	}
+	d.mu.Lock()
+	d.conf = conf
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *OutboundDialer) getConf() *outboundConf {
+	if d == nil {
+		return defaultOutboundConf
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.conf == nil {
+		return defaultOutboundConf
+	}
+	return d.conf
+}
+
+// Dial connects to addr, given as host:port.
+func (d *OutboundDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr, given as host:port. The connect timeout
+// covers resolving and all the attempts.
+func (d *OutboundDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conf := d.getConf()
+	var acl *ACL
+	var resolver *Resolver
+	if d != nil {
+		acl, resolver = d.ACL, d.Resolver
+	}
+	if conf.dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.dialer.Timeout)
+		defer cancel()
+	}
+
+	ips, port, err := acl.ResolveContext(ctx, resolver, addr)
+	if err != nil {
+		return nil, err
+	}
+	var bindIP net.IP
+	if la, ok := conf.dialer.LocalAddr.(*net.IPAddr); ok {
+		bindIP = la.IP
+	}
+	ips = filterFamily(ips, network, bindIP)
+	if len(ips) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("no suitable address for " + addr)}
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range interleaveFamily(ips) {
+		addrs[i] = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	}
+	return dialParallel(ctx, conf, network, addrs)
+}
+
+// filterFamily keeps the addresses usable for network and the bind address.
+func filterFamily(ips []net.IP, network string, bindIP net.IP) []net.IP {
+	want4 := strings.HasSuffix(network, "4") || (bindIP != nil && bindIP.To4() != nil)
+	want6 := strings.HasSuffix(network, "6") || (bindIP != nil && bindIP.To4() == nil)
+	if !want4 && !want6 {
+		return ips
+	}
+	var res []net.IP
+	for _, ip := range ips {
+		if is4 := ip.To4() != nil; (is4 && want4) || (!is4 && want6) {
+			res = append(res, ip)
+		}
+	}
+	return res
+}
+
+// interleaveFamily alternates the address families, starting with the
+// family of the first address, as described in RFC 8305 section 4.
+func interleaveFamily(ips []net.IP) []net.IP {
+	if len(ips) < 2 {
+		return ips
+	}
+	first4 := ips[0].To4() != nil
+	var primary, secondary []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == first4 {
+			primary = append(primary, ip)
+		} else {
+			secondary = append(secondary, ip)
+		}
+	}
+	res := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(primary) || i < len(secondary); i++ {
+		if i < len(primary) {
+			res = append(res, primary[i])
+		}
+		if i < len(secondary) {
+			res = append(res, secondary[i])
+		}
+	}
+	return res
+}
+
+func dialAddr(ctx context.Context, conf *outboundConf, network, addr string) (net.Conn, error) {
+	dialer := conf.dialer
+	dialer.Timeout = 0 // ctx carries the timeout
+	if la, ok := dialer.LocalAddr.(*net.IPAddr); ok {
+		if strings.HasPrefix(network, "udp") {
+			dialer.LocalAddr = &net.UDPAddr{IP: la.IP}
+		} else {
+			dialer.LocalAddr = &net.TCPAddr{IP: la.IP}
+		}
+	}
+	c, err := dialer.DialContext(ctx, network, addr)
+	if err == nil {
+		conf.socket.apply(c)
+	}
+	return c, err
+}
+
+// dialParallel tries addrs in order, starting the next attempt after the
+// fallback delay or when the current ones have all failed. Returns the first
+// established connection, or the first error if all fail.
+func dialParallel(ctx context.Context, conf *outboundConf, network string, addrs []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		c   net.Conn
+		err error
+	}
+	results := make(chan dialResult)
+	next, pending := 0, 0
+	start := func() {
+		go func(addr string) {
+			c, err := dialAddr(ctx, conf, network, addr)
+			select {
+			case results <- dialResult{c, err}:
+			case <-ctx.Done():
+				// lost the race
+				if c != nil {
+					c.Close()
+				}
+			}
+		}(addrs[next])
+		next++
+		pending++
+	}
+
+	var firstErr error
+	start()
+	for pending > 0 {
+		var timer *time.Timer
+		var fallback <-chan time.Time
+		if next < len(addrs) && conf.fallbackDelay >= 0 {
+			timer = time.NewTimer(conf.fallbackDelay)
+			fallback = timer.C
+		}
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.c, nil
+			}
+			tcpLog.Debug("dial error", F("network", network), Err(res.err))
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if next < len(addrs) && ctx.Err() == nil {
+				start()
+			}
+		case <-fallback:
+			start()
+		case <-ctx.Done():
+			// the losers close their connections
+			if firstErr == nil {
+				firstErr = ctx.Err()
+			}
+			return nil, firstErr
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,18 @@
+package shadowsocks
+
+import "syscall"
+
+// bindToDevice returns a dialer control function binding the socket to the
+// network interface iface.
+func bindToDevice(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}, nil
+}
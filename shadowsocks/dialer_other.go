@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package shadowsocks
+
+import (
+	"errors"
+	"syscall"
+)
+
+func bindToDevice(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, errors.New("shadowsocks: outbound: bind_interface is only supported on linux")
+}
@@ -0,0 +1,161 @@
+package shadowsocks
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInterleaveFamily(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::3"),
+		net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"),
+	}
+	got := ipStrings(interleaveFamily(ips))
+	want := "2001:db8::1,192.0.2.1,2001:db8::2,192.0.2.2,2001:db8::3"
+	if got != want {
+		t.Errorf("got %s, should be %s", got, want)
+	}
+	if got := ipStrings(filterFamily(ips, "tcp", net.ParseIP("192.0.2.9"))); got != "192.0.2.1,192.0.2.2" {
+		t.Errorf("bind to ipv4 should only keep ipv4 addresses, got %s", got)
+	}
+	if got := ipStrings(filterFamily(ips, "tcp6", nil)); got != "2001:db8::1,2001:db8::2,2001:db8::3" {
+		t.Errorf("tcp6 should only keep ipv6 addresses, got %s", got)
+	}
+}
+
+func listenTest(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	return ln
+}
+
+// testDialer resolves test.example.com to addrs, dialing slowAddr is delayed
+// by the given time.
+func testDialer(addrs []string, fallbackDelay, timeout time.Duration, slowAddr string, delay time.Duration) *OutboundDialer {
+	r, _ := NewResolver(&ResolverConfig{Hosts: map[string][]string{"test.example.com": addrs}})
+	d := &OutboundDialer{Resolver: r}
+	d.conf = &outboundConf{
+		dialer: net.Dialer{
+			Timeout: timeout,
+			Control: func(network, address string, c syscall.RawConn) error {
+				if host, _, _ := net.SplitHostPort(address); host == slowAddr {
+					time.Sleep(delay)
+				}
+				return nil
+			},
+		},
+		fallbackDelay: fallbackDelay,
+	}
+	return d
+}
+
+func TestOutboundDialerFallback(t *testing.T) {
+	ln := listenTest(t)
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	addr := net.JoinHostPort("test.example.com", port)
+
+	// nothing listens on 127.0.0.2, the connection is refused
+	d := testDialer([]string{"127.0.0.2", "127.0.0.1"}, -1, time.Second, "", 0)
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("should fall back to the next address:", err)
+	}
+	c.Close()
+
+	// the slow address doesn't hold up the next attempt
+	d = testDialer([]string{"127.0.0.2", "127.0.0.1"}, 20*time.Millisecond, time.Second, "127.0.0.2", 500*time.Millisecond)
+	start := time.Now()
+	c, err = d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("racing dial:", err)
+	}
+	c.Close()
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("racing dial took %v, should not wait for the slow address", elapsed)
+	}
+}
+
+func TestOutboundDialerTimeout(t *testing.T) {
+	ln := listenTest(t)
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	d := testDialer([]string{"127.0.0.1"}, 0, 100*time.Millisecond, "127.0.0.1", 500*time.Millisecond)
+	start := time.Now()
+	if c, err := d.Dial("tcp", net.JoinHostPort("test.example.com", port)); err == nil {
+		c.Close()
+		t.Fatal("dial should time out")
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("dial returned after %v, should time out after 100ms", elapsed)
+	}
+
+	// the timeout covers resolving, the nameserver never answers
+	ns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	r, _ := NewResolver(&ResolverConfig{Nameservers: []string{ns.LocalAddr().String()}})
+	d = &OutboundDialer{Resolver: r}
+	d.conf = &outboundConf{dialer: net.Dialer{Timeout: 100 * time.Millisecond}}
+	start = time.Now()
+	if c, err := d.Dial("tcp", net.JoinHostPort("test.example.com", port)); err == nil {
+		c.Close()
+		t.Fatal("dial should time out resolving")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dial returned after %v, should time out resolving after 100ms", elapsed)
+	}
+}
+
+func TestOutboundDialerACL(t *testing.T) {
+	ln := listenTest(t)
+	defer ln.Close()
+
+	a, _ := NewACL(&ACLConfig{BlockPrivate: true})
+	d := &OutboundDialer{ACL: a}
+	if _, err := d.Dial("tcp", ln.Addr().String()); !IsACLDenied(err) {
+		t.Errorf("dial to loopback should be denied, got %v", err)
+	}
+	a.Load(&ACLConfig{BlockPrivate: true, AllowCIDR: []string{"127.0.0.1"}})
+	c, err := d.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("dial to allowed address:", err)
+	}
+	c.Close()
+}
+
+func TestOutboundDialerConfig(t *testing.T) {
+	if _, err := NewOutboundDialer(&OutboundConfig{BindAddress: "not an ip"}); err == nil {
+		t.Error("invalid bind address should fail")
+	}
+	d, err := NewOutboundDialer(&OutboundConfig{BindAddress: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := listenTest(t)
+	defer ln.Close()
+	c, err := d.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("dial with bind address:", err)
+	}
+	if host, _, _ := net.SplitHostPort(c.LocalAddr().String()); host != "127.0.0.1" {
+		t.Errorf("local address %s, should be bound to 127.0.0.1", c.LocalAddr())
+	}
+	c.Close()
+}
@@ -7,13 +7,19 @@ import (
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/rc4"
+	"encoding/base64"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/aead/chacha20"
 	"golang.org/x/crypto/blowfish"
 	"golang.org/x/crypto/cast5"
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/salsa20/salsa"
 )
 
@@ -92,6 +98,15 @@ func newCast5Stream(key, iv []byte, doe DecOrEnc) (cipher.Stream, error) {
 	return newStream(block, err, key, iv, doe)
 }
 
+func newCamelliaStream(key, iv []byte, doe DecOrEnc) (cipher.Stream, error) {
+	block, err := newCamelliaCipher(key)
+	return newStream(block, err, key, iv, doe)
+}
+
+func newRC4Stream(key, _ []byte, _ DecOrEnc) (cipher.Stream, error) {
+	return rc4.NewCipher(key)
+}
+
 func newRC4MD5Stream(key, iv []byte, _ DecOrEnc) (cipher.Stream, error) {
 	h := md5.New()
 	h.Write(key)
@@ -149,37 +164,218 @@ func newSalsa20Stream(key, iv []byte, _ DecOrEnc) (cipher.Stream, error) {
 	return &c, nil
 }
 
+// tableCipher substitutes each byte, the tables are derived from the
+// password only.
+type tableCipher []byte
+
+func (t tableCipher) XORKeyStream(dst, src []byte) {
+	for i, b := range src {
+		dst[i] = t[b]
+	}
+}
+
+var tableCache struct {
+	sync.Mutex
+	enc map[string]tableCipher
+}
+
+func newTableStream(key, _ []byte, doe DecOrEnc) (cipher.Stream, error) {
+	tableCache.Lock()
+	defer tableCache.Unlock()
+	enc, ok := tableCache.enc[string(key)]
+	if !ok {
+		enc = make(tableCipher, 256)
+		for i := range enc {
+			enc[i] = byte(i)
+		}
+		s := md5sum(key)
+		a := binary.LittleEndian.Uint64(s)
+		for i := uint64(1); i < 1024; i++ {
+			sort.SliceStable(enc, func(x, y int) bool {
+				return a%(uint64(enc[x])+i) < a%(uint64(enc[y])+i)
+			})
+		}
+		if tableCache.enc == nil {
+			tableCache.enc = make(map[string]tableCipher)
+		}
+		tableCache.enc[string(key)] = enc
+	}
+	if doe == Encrypt {
+		return enc, nil
+	}
+	dec := make(tableCipher, 256)
+	for i, b := range enc {
+		dec[b] = byte(i)
+	}
+	return dec, nil
+}
+
+// plainStream leaves the data as is, for links encrypted otherwise.
+type plainStream struct{}
+
+func (plainStream) XORKeyStream(dst, src []byte) {
+	copy(dst, src)
+}
+
+func newPlainStream(_, _ []byte, _ DecOrEnc) (cipher.Stream, error) {
+	return plainStream{}, nil
+}
+
 type cipherInfo struct {
+	// the password is used as the key if 0
 	keyLen    int
-	ivLen     int
+	ivLen     int // the salt length of aead ciphers
 	newStream func(key, iv []byte, doe DecOrEnc) (cipher.Stream, error)
+	newAEAD   func(key []byte) (cipher.AEAD, error)
+	// weak ciphers, still supported to talk to old servers and clients
+	deprecated bool
 }
 
+// DefaultCipherMethod is used when no method is configured.
+const DefaultCipherMethod = "aes-256-cfb"
+
+var cipherMu sync.RWMutex
+
 var cipherMethod = map[string]*cipherInfo{
-	"aes-128-cfb":   {16, 16, newAESCFBStream},
-	"aes-192-cfb":   {24, 16, newAESCFBStream},
-	"aes-256-cfb":   {32, 16, newAESCFBStream},
-	"aes-128-ctr":   {16, 16, newAESCTRStream},
-	"aes-192-ctr":   {24, 16, newAESCTRStream},
-	"aes-256-ctr":   {32, 16, newAESCTRStream},
-	"des-cfb":       {8, 8, newDESStream},
-	"bf-cfb":        {16, 8, newBlowFishStream},
-	"cast5-cfb":     {16, 8, newCast5Stream},
-	"rc4-md5":       {16, 16, newRC4MD5Stream},
-	"rc4-md5-6":     {16, 6, newRC4MD5Stream},
-	"chacha20":      {32, 8, newChaCha20Stream},
-	"chacha20-ietf": {32, 12, newChaCha20IETFStream},
-	"salsa20":       {32, 8, newSalsa20Stream},
+	"aes-128-cfb":            {keyLen: 16, ivLen: 16, newStream: newAESCFBStream},
+	"aes-192-cfb":            {keyLen: 24, ivLen: 16, newStream: newAESCFBStream},
+	"aes-256-cfb":            {keyLen: 32, ivLen: 16, newStream: newAESCFBStream},
+	"aes-128-ctr":            {keyLen: 16, ivLen: 16, newStream: newAESCTRStream},
+	"aes-192-ctr":            {keyLen: 24, ivLen: 16, newStream: newAESCTRStream},
+	"aes-256-ctr":            {keyLen: 32, ivLen: 16, newStream: newAESCTRStream},
+	"des-cfb":                {keyLen: 8, ivLen: 8, newStream: newDESStream, deprecated: true},
+	"bf-cfb":                 {keyLen: 16, ivLen: 8, newStream: newBlowFishStream, deprecated: true},
+	"cast5-cfb":              {keyLen: 16, ivLen: 8, newStream: newCast5Stream, deprecated: true},
+	"rc4-md5":                {keyLen: 16, ivLen: 16, newStream: newRC4MD5Stream, deprecated: true},
+	"rc4-md5-6":              {keyLen: 16, ivLen: 6, newStream: newRC4MD5Stream, deprecated: true},
+	"camellia-128-cfb":       {keyLen: 16, ivLen: 16, newStream: newCamelliaStream},
+	"camellia-192-cfb":       {keyLen: 24, ivLen: 16, newStream: newCamelliaStream},
+	"camellia-256-cfb":       {keyLen: 32, ivLen: 16, newStream: newCamelliaStream},
+	"rc4":                    {keyLen: 16, ivLen: 0, newStream: newRC4Stream, deprecated: true},
+	"table":                  {keyLen: 0, ivLen: 0, newStream: newTableStream, deprecated: true},
+	"none":                   {keyLen: 0, ivLen: 0, newStream: newPlainStream},
+	"plain":                  {keyLen: 0, ivLen: 0, newStream: newPlainStream},
+	"chacha20":               {keyLen: 32, ivLen: 8, newStream: newChaCha20Stream},
+	"chacha20-ietf":          {keyLen: 32, ivLen: 12, newStream: newChaCha20IETFStream},
+	"salsa20":                {keyLen: 32, ivLen: 8, newStream: newSalsa20Stream},
+	"aes-128-gcm":            {keyLen: 16, ivLen: 16, newAEAD: newAESGCM},
+	"aes-192-gcm":            {keyLen: 24, ivLen: 24, newAEAD: newAESGCM},
+	"aes-256-gcm":            {keyLen: 32, ivLen: 32, newAEAD: newAESGCM},
+	"chacha20-ietf-poly1305": {keyLen: 32, ivLen: 32, newAEAD: chacha20poly1305.New},
+}
+
+func getCipherInfo(method string) (*cipherInfo, bool) {
+	cipherMu.RLock()
+	defer cipherMu.RUnlock()
+	mi, ok := cipherMethod[method]
+	return mi, ok
+}
+
+func registerCipher(name string, mi *cipherInfo) error {
+	if name == "" {
+		return errors.New("shadowsocks: empty cipher name")
+	}
+	if mi.keyLen < 0 || mi.ivLen < 0 || mi.newAEAD != nil && (mi.keyLen == 0 || mi.ivLen == 0) {
+		return fmt.Errorf("shadowsocks: invalid key or iv length for cipher %s", name)
+	}
+	cipherMu.Lock()
+	defer cipherMu.Unlock()
+	if _, ok := cipherMethod[name]; ok {
+		return fmt.Errorf("shadowsocks: cipher %s already registered", name)
+	}
+	cipherMethod[name] = mi
+	return nil
+}
+
+// RegisterCipher adds a stream cipher, usable as method in the config and
+// by NewCipher. newStream is called with a key of keyLen bytes, derived from
+// the password, and the random iv of ivLen bytes sent ahead of the data. If
+// keyLen is 0, the key is the password itself.
+func RegisterCipher(name string, keyLen, ivLen int,
+	newStream func(key, iv []byte, doe DecOrEnc) (cipher.Stream, error)) error {
+	if newStream == nil {
+		return errors.New("shadowsocks: nil cipher constructor")
+	}
+	return registerCipher(name, &cipherInfo{keyLen: keyLen, ivLen: ivLen, newStream: newStream})
+}
+
+// RegisterAEADCipher adds an AEAD cipher. newAEAD is called for each
+// connection or packet with a subkey of keyLen bytes, derived from the key
+// and the random salt of saltLen bytes sent ahead of the data.
+func RegisterAEADCipher(name string, keyLen, saltLen int,
+	newAEAD func(key []byte) (cipher.AEAD, error)) error {
+	if newAEAD == nil {
+		return errors.New("shadowsocks: nil cipher constructor")
+	}
+	return registerCipher(name, &cipherInfo{keyLen: keyLen, ivLen: saltLen, newAEAD: newAEAD})
+}
+
+// CipherInfo describes a registered cipher.
+type CipherInfo struct {
+	Name       string
+	KeyLen     int
+	IVLen      int // stream ciphers only
+	SaltLen    int // aead ciphers only
+	AEAD       bool
+	Deprecated bool
+}
+
+func (mi *cipherInfo) export(name string) CipherInfo {
+	ci := CipherInfo{Name: name, KeyLen: mi.keyLen, AEAD: mi.newAEAD != nil, Deprecated: mi.deprecated}
+	if ci.AEAD {
+		ci.SaltLen = mi.ivLen
+	} else {
+		ci.IVLen = mi.ivLen
+	}
+	return ci
+}
+
+// LookupCipher returns the registered cipher method.
+func LookupCipher(method string) (CipherInfo, bool) {
+	mi, ok := getCipherInfo(method)
+	if !ok {
+		return CipherInfo{}, false
+	}
+	return mi.export(method), true
 }
 
+// ListCiphers returns the registered ciphers sorted by name.
+func ListCiphers() []CipherInfo {
+	cipherMu.RLock()
+	list := make([]CipherInfo, 0, len(cipherMethod))
+	for name, mi := range cipherMethod {
+		list = append(list, mi.export(name))
+	}
+	cipherMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// CipherMethodUsage is the help text of the command line option setting the
+// method.
+func CipherMethodUsage() string {
+	var names []string
+	for _, ci := range ListCiphers() {
+		if !ci.Deprecated {
+			names = append(names, ci.Name)
+		}
+	}
+	return fmt.Sprintf("encryption method, default: %s, one of %s", DefaultCipherMethod, strings.Join(names, ", "))
+}
+
+// CheckCipherMethod returns an error if method is not registered, and warns
+// about deprecated ones. An empty method stands for DefaultCipherMethod.
 func CheckCipherMethod(method string) error {
 	if method == "" {
-		method = "aes-256-cfb"
+		method = DefaultCipherMethod
 	}
-	_, ok := cipherMethod[method]
+	mi, ok := getCipherInfo(method)
 	if !ok {
 		return errors.New("Unsupported encryption method: " + method)
 	}
+	if mi.deprecated {
+		mainLog.Warn("encryption method is deprecated, consider an aead one", F("method", method))
+	}
 	return nil
 }
 
@@ -189,21 +385,36 @@ type Cipher struct {
 	key  []byte
 	info *cipherInfo
 	iv   []byte
+
+	// aead ciphers with their nonces, enc and dec are nil
+	aeadEnc  cipher.AEAD
+	aeadDec  cipher.AEAD
+	encNonce []byte
+	decNonce []byte
 }
 
 // NewCipher creates a cipher that can be used in Dial() etc.
 // Use cipher.Copy() to create a new cipher with the same method and password
-// to avoid the cost of repeated cipher initialization.
+// to avoid the cost of repeated cipher initialization. An empty method stands
+// for DefaultCipherMethod.
 func NewCipher(method, password string) (c *Cipher, err error) {
 	if password == "" {
 		return nil, errEmptyPassword
 	}
-	mi, ok := cipherMethod[method]
+	if method == "" {
+		method = DefaultCipherMethod
+	}
+	mi, ok := getCipherInfo(method)
 	if !ok {
 		return nil, errors.New("Unsupported encryption method: " + method)
 	}
 
-	key := evpBytesToKey(password, mi.keyLen)
+	var key []byte
+	if mi.keyLen > 0 {
+		key = evpBytesToKey(password, mi.keyLen)
+	} else {
+		key = []byte(password)
+	}
 
 	c = &Cipher{key: key, info: mi}
 
@@ -213,6 +424,88 @@ func NewCipher(method, password string) (c *Cipher, err error) {
 	return c, nil
 }
 
+// NewCipherWithKey is like NewCipher with a raw key instead of a password,
+// the key length must be the one of the method.
+func NewCipherWithKey(method string, key []byte) (*Cipher, error) {
+	if method == "" {
+		method = DefaultCipherMethod
+	}
+	mi, ok := getCipherInfo(method)
+	if !ok {
+		return nil, errors.New("Unsupported encryption method: " + method)
+	}
+	if err := checkKeyLen(method, mi, key); err != nil {
+		return nil, err
+	}
+	return &Cipher{key: append([]byte(nil), key...), info: mi}, nil
+}
+
+func checkKeyLen(method string, mi *cipherInfo, key []byte) error {
+	if len(key) == 0 {
+		return errEmptyPassword
+	}
+	if mi.keyLen > 0 && len(key) != mi.keyLen {
+		return fmt.Errorf("shadowsocks: %s needs a key of %d bytes, got %d", method, mi.keyLen, len(key))
+	}
+	return nil
+}
+
+// DecodeKey decodes a base64 key of the config and checks its length for
+// method.
+func DecodeKey(method, key string) ([]byte, error) {
+	if method == "" {
+		method = DefaultCipherMethod
+	}
+	mi, ok := getCipherInfo(method)
+	if !ok {
+		return nil, errors.New("Unsupported encryption method: " + method)
+	}
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, errors.New("shadowsocks: key is not valid base64")
+	}
+	if err = checkKeyLen(method, mi, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// GenerateKey returns a random key for method, base64 encoded as in the
+// config.
+func GenerateKey(method string) (string, error) {
+	if method == "" {
+		method = DefaultCipherMethod
+	}
+	mi, ok := getCipherInfo(method)
+	if !ok {
+		return "", errors.New("Unsupported encryption method: " + method)
+	}
+	if mi.keyLen == 0 {
+		return "", fmt.Errorf("shadowsocks: %s takes the password as key", method)
+	}
+	key := make([]byte, mi.keyLen)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// newCipherFor creates the cipher of a password or a base64 key, only one
+// of them may be set.
+func newCipherFor(method, password, key string) (*Cipher, error) {
+	switch {
+	case key != "" && password != "":
+		return nil, errors.New("shadowsocks: both password and key given")
+	case key != "":
+		b, err := DecodeKey(method, key)
+		if err != nil {
+			return nil, err
+		}
+		return NewCipherWithKey(method, b)
+	}
+	return NewCipher(method, password)
+}
+
 // Initializes the block cipher with CFB mode, returns IV.
 func (c *Cipher) initEncrypt() (iv []byte, err error) {
 	if c.iv == nil {
@@ -259,5 +552,9 @@ func (c *Cipher) Copy() *Cipher {
 	nc := *c
 	nc.enc = nil
 	nc.dec = nil
+	nc.aeadEnc = nil
+	nc.aeadDec = nil
+	nc.encNonce = nil
+	nc.decNonce = nil
 	return &nc
 }
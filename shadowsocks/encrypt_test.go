@@ -1,8 +1,12 @@
 package shadowsocks
 
 import (
+	"bytes"
 	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"io"
+	"io/ioutil"
 	"reflect"
 	"testing"
 )
@@ -107,6 +111,90 @@ func TestChaCha20IETF(t *testing.T) {
 	testBlockCipher(t, "chacha20-ietf")
 }
 
+func TestCamellia(t *testing.T) {
+	testBlockCipher(t, "camellia-128-cfb")
+	testBlockCipher(t, "camellia-192-cfb")
+	testBlockCipher(t, "camellia-256-cfb")
+
+	// RFC 3713 test vectors
+	plain, _ := hex.DecodeString("0123456789abcdeffedcba9876543210")
+	for _, v := range []struct{ key, cipher string }{
+		{"0123456789abcdeffedcba9876543210", "67673138549669730857065648eabe43"},
+		{"0123456789abcdeffedcba98765432100011223344556677", "b4993401b3e996f84ee5cee7d79b09b9"},
+		{"0123456789abcdeffedcba987654321000112233445566778899aabbccddeeff", "9acc237dff16d76c20ef7c919e3a7509"},
+	} {
+		key, _ := hex.DecodeString(v.key)
+		block, err := newCamelliaCipher(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 16)
+		block.Encrypt(buf, plain)
+		if got := hex.EncodeToString(buf); got != v.cipher {
+			t.Errorf("camellia %d encrypt got %s, want %s", len(key)*8, got, v.cipher)
+		}
+		block.Decrypt(buf, buf)
+		if !bytes.Equal(buf, plain) {
+			t.Errorf("camellia %d decrypt got %x", len(key)*8, buf)
+		}
+	}
+}
+
+func TestLegacyCiphers(t *testing.T) {
+	for _, method := range []string{"rc4", "table", "none", "plain"} {
+		testBlockCipher(t, method)
+	}
+	c, _ := NewCipher("none", "foobar")
+	c.initEncrypt()
+	buf := make([]byte, len(text))
+	c.encrypt(buf, []byte(text))
+	if string(buf) != text {
+		t.Error("none should not change the data")
+	}
+}
+
+// TestKnownAnswers checks the ciphers against the outputs of the Python
+// implementation, generated by script/cipher_kat.py.
+func TestKnownAnswers(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/cipher_kat.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []struct {
+		Method, Password, IV, Plaintext, Ciphertext string
+	}
+	if err = json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vectors {
+		iv, _ := hex.DecodeString(v.IV)
+		want, _ := hex.DecodeString(v.Ciphertext)
+		cipher, err := NewCipher(v.Method, v.Password)
+		if err != nil {
+			t.Error(v.Method, err)
+			continue
+		}
+		enc := cipher.Copy()
+		enc.iv = iv
+		if _, err = enc.initEncrypt(); err != nil {
+			t.Error(v.Method, err)
+			continue
+		}
+		got := make([]byte, len(v.Plaintext))
+		enc.encrypt(got, []byte(v.Plaintext))
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s encrypt got %x, want %x", v.Method, got, want)
+		}
+
+		// as sent on the wire
+		c := NewConn(&fakeConn{Reader: bytes.NewReader(append(iv, want...))}, cipher.Copy())
+		got = make([]byte, len(v.Plaintext))
+		if _, err = io.ReadFull(c, got); err != nil || string(got) != v.Plaintext {
+			t.Errorf("%s decrypt got %q, %v", v.Method, got, err)
+		}
+	}
+}
+
 var cipherKey = make([]byte, 64)
 var cipherIv = make([]byte, 64)
 
@@ -332,3 +420,87 @@ func BenchmarkChaCha20IETFDecrypt(b *testing.B) {
 func BenchmarkSalsa20Decrypt(b *testing.B) {
 	benchmarkCipherDecrypt(b, "salsa20")
 }
+
+func TestRegisterCipher(t *testing.T) {
+	if err := RegisterCipher("aes-256-cfb", 32, 16, newAESCFBStream); err == nil {
+		t.Error("registering a method twice should fail")
+	}
+	if err := RegisterCipher("test-aes-cfb", -1, 16, newAESCFBStream); err == nil {
+		t.Error("negative key length should fail")
+	}
+	if err := RegisterCipher("test-aes-cfb", 16, 16, newAESCFBStream); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterAEADCipher("test-aes-gcm", 16, 16, newAESGCM); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cipherMu.Lock()
+		delete(cipherMethod, "test-aes-cfb")
+		delete(cipherMethod, "test-aes-gcm")
+		cipherMu.Unlock()
+	}()
+	if err := CheckCipherMethod("test-aes-cfb"); err != nil {
+		t.Error(err)
+	}
+	testBlockCipher(t, "test-aes-cfb")
+
+	want := CipherInfo{Name: "test-aes-gcm", KeyLen: 16, SaltLen: 16, AEAD: true}
+	if ci, ok := LookupCipher("test-aes-gcm"); !ok || ci != want {
+		t.Errorf("lookup got %+v, want %+v", ci, want)
+	}
+	var found bool
+	list := ListCiphers()
+	for i, ci := range list {
+		if i > 0 && list[i-1].Name >= ci.Name {
+			t.Errorf("ciphers not sorted: %s before %s", list[i-1].Name, ci.Name)
+		}
+		if ci == want {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("registered cipher not listed")
+	}
+	if ci, _ := LookupCipher("rc4-md5"); !ci.Deprecated || ci.IVLen != 16 {
+		t.Errorf("rc4-md5 got %+v", ci)
+	}
+}
+
+func TestCipherWithKey(t *testing.T) {
+	key, err := GenerateKey("aes-256-gcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := DecodeKey("aes-256-gcm", key)
+	if err != nil || len(raw) != 32 {
+		t.Fatalf("decoded %d bytes, %v", len(raw), err)
+	}
+	if _, err = DecodeKey("aes-128-gcm", key); err == nil {
+		t.Error("key of the wrong length should fail")
+	}
+	if _, err = DecodeKey("aes-256-gcm", "not base64!"); err == nil {
+		t.Error("invalid base64 should fail")
+	}
+	if _, err = GenerateKey("table"); err == nil {
+		t.Error("table has no key length")
+	}
+	if _, err = newCipherFor("aes-256-gcm", "foobar", key); err == nil {
+		t.Error("password and key together should fail")
+	}
+
+	// a key derived from the password works the same
+	c, _ := NewCipher("aes-256-cfb", "foobar")
+	kc, err := NewCipherWithKey("aes-256-cfb", evpBytesToKey("foobar", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv, _ := c.initEncrypt()
+	kc.initDecrypt(iv)
+	buf := make([]byte, len(text))
+	c.encrypt(buf, []byte(text))
+	kc.decrypt(buf, buf)
+	if string(buf) != text {
+		t.Error("raw key should decrypt the data of its password")
+	}
+}
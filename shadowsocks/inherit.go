@@ -0,0 +1,277 @@
+package shadowsocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Listening sockets can be handed to a new process, either by a running
+// server doing a zero-downtime upgrade, or by systemd socket activation. In
+// both cases the sockets start at fd 3 in the new process.
+const (
+	listenFdsStart = 3
+
+	envListenFds = "SS_LISTEN_FDS" // number of sockets handed over by upgrade
+	envReadyFd   = "SS_READY_FD"   // pipe to notify the old process we are ready
+
+	envSystemdFds = "LISTEN_FDS"
+	envSystemdPid = "LISTEN_PID"
+)
+
+// How long the old process waits for the new one to become ready.
+var UpgradeTimeout = 30 * time.Second
+
+var inherited struct {
+	sync.Mutex
+	loaded    bool
+	listeners []net.Listener
+	conns     []net.PacketConn
+	ready     *os.File
+}
+
+func loadInherited() {
+	if inherited.loaded {
+		return
+	}
+	inherited.loaded = true
+
+	n := 0
+	if s := os.Getenv(envListenFds); s != "" {
+		n, _ = strconv.Atoi(s)
+		if fd, err := strconv.Atoi(os.Getenv(envReadyFd)); err == nil {
+			inherited.ready = os.NewFile(uintptr(fd), "ready")
+		}
+	} else if s := os.Getenv(envSystemdFds); s != "" {
+		if pid, _ := strconv.Atoi(os.Getenv(envSystemdPid)); pid == os.Getpid() {
+			n, _ = strconv.Atoi(s)
+		}
+	}
+	// don't pass them further to processes we start
+	for _, env := range []string{envListenFds, envReadyFd, envSystemdFds, envSystemdPid, "LISTEN_FDNAMES"} {
+		os.Unsetenv(env)
+	}
+
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "listener")
+		// Both FileListener and FilePacketConn dup the fd, so the original
+		// is always closed. Stream sockets are rejected by FilePacketConn
+		// and datagram sockets by FileListener.
+		if ln, err := net.FileListener(f); err == nil {
+			mainLog.Debug("inherited listener", F("addr", ln.Addr()))
+			inherited.listeners = append(inherited.listeners, ln)
+		} else if c, err := net.FilePacketConn(f); err == nil {
+			mainLog.Debug("inherited packet conn", F("addr", c.LocalAddr()))
+			inherited.conns = append(inherited.conns, c)
+		} else {
+			mainLog.Debug("ignore inherited fd", F("fd", fd), Err(err))
+		}
+		f.Close()
+	}
+}
+
+// addrMatch reports whether the listening address la serves addr, given in
+// the form passed to net.Listen. An empty or unspecified host in addr matches
+// any address with the same port.
+func addrMatch(la net.Addr, addr string) bool {
+	switch a := la.(type) {
+	case *net.UnixAddr:
+		return a.Name == addr
+	case *net.TCPAddr, *net.UDPAddr:
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return false
+		}
+		lhost, lport, _ := net.SplitHostPort(a.String())
+		if port != lport {
+			return false
+		}
+		ip := net.ParseIP(host)
+		if host == "" || (ip != nil && ip.IsUnspecified()) {
+			return true
+		}
+		return ip != nil && ip.Equal(net.ParseIP(lhost))
+	}
+	return false
+}
+
+// InheritedListener returns the listener for addr handed over by the parent
+// process or systemd, nil if there's none. Each listener is returned only
+// once.
+func InheritedListener(network, addr string) net.Listener {
+	inherited.Lock()
+	defer inherited.Unlock()
+	loadInherited()
+	for i, ln := range inherited.listeners {
+		if ln.Addr().Network() == network && addrMatch(ln.Addr(), addr) {
+			inherited.listeners = append(inherited.listeners[:i], inherited.listeners[i+1:]...)
+			return ln
+		}
+	}
+	return nil
+}
+
+// InheritedPacketConn is like InheritedListener, for udp sockets.
+func InheritedPacketConn(network, addr string) net.PacketConn {
+	inherited.Lock()
+	defer inherited.Unlock()
+	loadInherited()
+	for i, c := range inherited.conns {
+		if strings.HasPrefix(c.LocalAddr().Network(), network) && addrMatch(c.LocalAddr(), addr) {
+			inherited.conns = append(inherited.conns[:i], inherited.conns[i+1:]...)
+			return c
+		}
+	}
+	return nil
+}
+
+// ListenInherited returns the inherited listener for addr if there is one,
+// otherwise creates a new one.
+func ListenInherited(network, addr string) (net.Listener, error) {
+	if ln := InheritedListener(network, addr); ln != nil {
+		return ln, nil
+	}
+	return net.Listen(network, addr)
+}
+
+// ListenUDPInherited returns the inherited udp socket for addr if there is
+// one, otherwise creates a new one.
+func ListenUDPInherited(network string, laddr *net.UDPAddr) (*net.UDPConn, error) {
+	if c, ok := InheritedPacketConn(network, laddr.String()).(*net.UDPConn); ok {
+		return c, nil
+	}
+	return net.ListenUDP(network, laddr)
+}
+
+// UpgradeReady should be called once all the listeners are set up. It closes
+// inherited sockets nobody claimed, e.g. for ports removed from the config,
+// and tells the old process it can stop serving.
+func UpgradeReady() {
+	inherited.Lock()
+	defer inherited.Unlock()
+	loadInherited()
+	for _, ln := range inherited.listeners {
+		mainLog.Debug("closing unused inherited listener", F("addr", ln.Addr()))
+		ln.Close()
+	}
+	for _, c := range inherited.conns {
+		mainLog.Debug("closing unused inherited packet conn", F("addr", c.LocalAddr()))
+		c.Close()
+	}
+	inherited.listeners, inherited.conns = nil, nil
+	if inherited.ready != nil {
+		inherited.ready.Write([]byte{1})
+		inherited.ready.Close()
+		inherited.ready = nil
+	}
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// StartUpgrade starts a new copy of the running binary with the same
+// arguments, handing it the given listening sockets. It returns once the new
+// process called UpgradeReady, after which the caller should stop accepting
+// and drain its connections. On error the new process is killed and the
+// caller should continue serving.
+func StartUpgrade(listeners []net.Listener, conns []net.PacketConn) (pid int, err error) {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	add := func(s interface{}) error {
+		fs, ok := s.(filer)
+		if !ok {
+			return fmt.Errorf("shadowsocks: can't hand over socket type %T", s)
+		}
+		f, err := fs.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		return nil
+	}
+	for _, ln := range listeners {
+		if err = add(ln); err != nil {
+			return
+		}
+	}
+	for _, c := range conns {
+		if err = add(c); err != nil {
+			return
+		}
+	}
+	nsock := len(files)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	var env []string
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if name != envListenFds && name != envReadyFd && !strings.HasPrefix(name, "LISTEN_") {
+			env = append(env, kv)
+		}
+	}
+	cmd.Env = append(env,
+		envListenFds+"="+strconv.Itoa(nsock),
+		envReadyFd+"="+strconv.Itoa(listenFdsStart+nsock))
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	// Close our copy of the write end, so reading the pipe returns on error
+	// if the new process exits before getting ready.
+	w.Close()
+	files = files[:nsock]
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		if _, err := r.Read(b); err != nil {
+			ready <- errors.New("shadowsocks: new process exited before ready")
+			return
+		}
+		ready <- nil
+	}()
+	go cmd.Wait()
+
+	timer := time.NewTimer(UpgradeTimeout)
+	defer timer.Stop()
+	select {
+	case err = <-ready:
+	case <-timer.C:
+		err = errors.New("shadowsocks: timeout waiting for new process")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		return 0, err
+	}
+	// The new process serves the unix sockets now, closing ours on
+	// shutdown must not remove their path.
+	for _, ln := range listeners {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return cmd.Process.Pid, nil
+}
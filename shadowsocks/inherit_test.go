@@ -0,0 +1,82 @@
+package shadowsocks
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// envTestUpgrade is the unix socket the test binary serves when started by
+// StartUpgrade in TestUpgradeUnixListener.
+const envTestUpgrade = "SS_TEST_UPGRADE_SOCKET"
+
+func TestMain(m *testing.M) {
+	if path := os.Getenv(envTestUpgrade); path != "" {
+		upgradedProcess(path)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// upgradedProcess takes over the listener of path, then answers a single
+// connection.
+func upgradedProcess(path string) {
+	ln := InheritedListener("unix", path)
+	UpgradeReady()
+	if ln == nil {
+		os.Exit(1)
+	}
+	defer ln.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		os.Exit(1)
+	}
+	conn.Write([]byte("new"))
+	conn.Close()
+}
+
+func TestUpgradeUnixListener(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no upgrade on windows")
+	}
+	dir, err := ioutil.TempDir("", "ssupgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ss.sock")
+	lns, err := (&ListenConfig{Addresses: []string{"unix:" + path}}).listen("8388")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lns[0].Close()
+
+	os.Setenv(envTestUpgrade, path)
+	pid, err := StartUpgrade(lns, nil)
+	os.Unsetenv(envTestUpgrade)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := os.FindProcess(pid); err == nil {
+		defer p.Kill()
+	}
+	// the old process stops listening, the path stays for the new one
+	lns[0].Close()
+	if _, err = os.Stat(path); err != nil {
+		t.Fatalf("socket removed by the old process: %v", err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	buf, err := ioutil.ReadAll(conn)
+	if err != nil || string(buf) != "new" {
+		t.Errorf("got %q, %v from the new process", buf, err)
+	}
+}
@@ -0,0 +1,304 @@
+package shadowsocks
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// LimitConfig is the "limits" section of the server config.
+type LimitConfig struct {
+	MaxConnsPerIP   int `json:"max_conns_per_ip"`   // concurrent connections from a client ip, 0 for no limit
+	MaxConnsPerPort int `json:"max_conns_per_port"` // concurrent connections on a port, 0 for no limit
+
+	// A client ip is banned after ban_threshold failed handshakes within
+	// ban_window seconds, 0 disables banning. The ban lasts ban_time
+	// seconds, doubled for each ban in a row up to max_ban_time.
+	BanThreshold int `json:"ban_threshold"`
+	BanWindow    int `json:"ban_window"`   // default 60
+	BanTime      int `json:"ban_time"`     // default 60
+	MaxBanTime   int `json:"max_ban_time"` // default 86400
+}
+
+// PortLimitConfig is the "limits" of a port_password entry. A zero value
+// keeps the limit of the config. The max_conns_per_ip of the config still
+// applies to the connections of an ip on all the ports, and the bans stay
+// global.
+type PortLimitConfig struct {
+	MaxConnsPerIP   int `json:"max_conns_per_ip"`   // concurrent connections from a client ip on the port
+	MaxConnsPerPort int `json:"max_conns_per_port"` // concurrent connections on the port, instead of the config's
+}
+
+var (
+	ErrBanned           = errors.New("shadowsocks: client ip banned")
+	ErrTooManyConnsIP   = errors.New("shadowsocks: too many connections from client ip")
+	ErrTooManyConnsPort = errors.New("shadowsocks: too many connections on port")
+)
+
+const (
+	defaultBanWindow  = time.Minute
+	defaultBanTime    = time.Minute
+	defaultMaxBanTime = 24 * time.Hour
+	limiterSweep      = time.Minute // how often to drop stale ban entries
+)
+
+type limitConf struct {
+	maxPerIP     int
+	maxPerPort   int
+	banThreshold int
+	banWindow    time.Duration
+	banTime      time.Duration
+	maxBanTime   time.Duration
+}
+
+type banEntry struct {
+	failures    []time.Time // within the ban window
+	bannedUntil time.Time
+	bans        int // bans in a row, reset once the entry goes stale
+}
+
+// ConnLimiter limits the concurrent connections per client ip and per port,
+// and bans client ips failing handshakes repeatedly. The zero value and a
+// nil *ConnLimiter don't limit anything. It's safe for concurrent use and
+// can be reloaded while in use.
+type ConnLimiter struct {
+	sync.Mutex
+	conf       limitConf
+	portLimits map[string]PortLimitConfig
+	perIP      map[string]int
+	perPort    map[string]int
+	perPortIP  map[string]int // by port and ip, see portIPKey
+	bans       map[string]*banEntry
+	lastSweep  time.Time
+}
+
+// NewConnLimiter creates a ConnLimiter from config, nil doesn't limit.
+func NewConnLimiter(config *LimitConfig) *ConnLimiter {
+	l := &ConnLimiter{}
+	l.Load(config)
+	return l
+}
+
+// Load replaces the limits. Connection counts and bans are kept.
+func (l *ConnLimiter) Load(config *LimitConfig) {
+	var conf limitConf
+	if config != nil {
+		conf = limitConf{
+			maxPerIP:     config.MaxConnsPerIP,
+			maxPerPort:   config.MaxConnsPerPort,
+			banThreshold: config.BanThreshold,
+			banWindow:    defaultBanWindow,
+			banTime:      defaultBanTime,
+			maxBanTime:   defaultMaxBanTime,
+		}
+		if config.BanWindow > 0 {
+			conf.banWindow = time.Duration(config.BanWindow) * time.Second
+		}
+		if config.BanTime > 0 {
+			conf.banTime = time.Duration(config.BanTime) * time.Second
+		}
+		if config.MaxBanTime > 0 {
+			conf.maxBanTime = time.Duration(config.MaxBanTime) * time.Second
+		}
+	}
+	l.Lock()
+	l.conf = conf
+	l.Unlock()
+}
+
+// SetPortLimits sets the limits of port, overriding the config's, nil
+// removes them.
+func (l *ConnLimiter) SetPortLimits(port string, config *PortLimitConfig) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	if config == nil {
+		delete(l.portLimits, port)
+		return
+	}
+	if l.portLimits == nil {
+		l.portLimits = map[string]PortLimitConfig{}
+	}
+	l.portLimits[port] = *config
+}
+
+func portIPKey(port, ip string) string {
+	return port + " " + ip
+}
+
+// clientIP returns the ip of addr as the key of the limits, empty for
+// addresses without ip.
+func clientIP(addr net.Addr) string {
+	ip := addrIP(addr)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// Acquire counts a new connection from addr on port. It returns an error if
+// the client ip is banned or a limit is reached, otherwise Release must be
+// called when the connection is closed.
+func (l *ConnLimiter) Acquire(port string, addr net.Addr) error {
+	if l == nil {
+		return nil
+	}
+	ip := clientIP(addr)
+	l.Lock()
+	defer l.Unlock()
+	if e, ok := l.bans[ip]; ok && time.Now().Before(e.bannedUntil) {
+		return ErrBanned
+	}
+	maxPerPort := l.conf.maxPerPort
+	pl := l.portLimits[port]
+	if pl.MaxConnsPerPort > 0 {
+		maxPerPort = pl.MaxConnsPerPort
+	}
+	if maxPerPort > 0 && l.perPort[port] >= maxPerPort {
+		return ErrTooManyConnsPort
+	}
+	if ip != "" && l.conf.maxPerIP > 0 && l.perIP[ip] >= l.conf.maxPerIP {
+		return ErrTooManyConnsIP
+	}
+	if ip != "" && pl.MaxConnsPerIP > 0 && l.perPortIP[portIPKey(port, ip)] >= pl.MaxConnsPerIP {
+		return ErrTooManyConnsIP
+	}
+	if l.perPort == nil {
+		l.perPort = map[string]int{}
+		l.perIP = map[string]int{}
+		l.perPortIP = map[string]int{}
+	}
+	l.perPort[port]++
+	if ip != "" {
+		l.perIP[ip]++
+		l.perPortIP[portIPKey(port, ip)]++
+	}
+	return nil
+}
+
+// Release counts a connection acquired from addr on port as closed.
+func (l *ConnLimiter) Release(port string, addr net.Addr) {
+	if l == nil {
+		return
+	}
+	ip := clientIP(addr)
+	l.Lock()
+	defer l.Unlock()
+	if l.perPort[port]--; l.perPort[port] <= 0 {
+		delete(l.perPort, port)
+	}
+	if ip != "" {
+		if l.perIP[ip]--; l.perIP[ip] <= 0 {
+			delete(l.perIP, ip)
+		}
+		key := portIPKey(port, ip)
+		if l.perPortIP[key]--; l.perPortIP[key] <= 0 {
+			delete(l.perPortIP, key)
+		}
+	}
+}
+
+// Fail records a failed handshake from addr. It returns the ban duration if
+// the client ip gets banned, 0 otherwise.
+func (l *ConnLimiter) Fail(addr net.Addr) time.Duration {
+	ip := clientIP(addr)
+	if l == nil || ip == "" {
+		return 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.conf.banThreshold <= 0 {
+		return 0
+	}
+	now := time.Now()
+	l.sweep(now)
+	if l.bans == nil {
+		l.bans = map[string]*banEntry{}
+	}
+	e, ok := l.bans[ip]
+	if !ok {
+		e = &banEntry{}
+		l.bans[ip] = e
+	}
+	if now.Before(e.bannedUntil) {
+		return 0
+	}
+	// drop failures out of the window
+	i := 0
+	for i < len(e.failures) && now.Sub(e.failures[i]) > l.conf.banWindow {
+		i++
+	}
+	e.failures = append(e.failures[i:], now)
+	if len(e.failures) < l.conf.banThreshold {
+		return 0
+	}
+	d := l.conf.banTime
+	for n := 0; n < e.bans && d < l.conf.maxBanTime; n++ {
+		d *= 2
+	}
+	if d > l.conf.maxBanTime {
+		d = l.conf.maxBanTime
+	}
+	e.bans++
+	e.failures = nil
+	e.bannedUntil = now.Add(d)
+	return d
+}
+
+// sweep drops entries without recent failure or ban, so the ban duration
+// starts over for ips behaving for a while.
+func (l *ConnLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < limiterSweep {
+		return
+	}
+	l.lastSweep = now
+	for ip, e := range l.bans {
+		last := e.bannedUntil
+		if n := len(e.failures); n > 0 && e.failures[n-1].After(last) {
+			last = e.failures[n-1]
+		}
+		// keep the ban count for a while after the ban ends
+		if now.Sub(last) > l.conf.banWindow && now.Sub(e.bannedUntil) > l.conf.maxBanTime {
+			delete(l.bans, ip)
+		}
+	}
+}
+
+// Banned returns the banned client ips with the end of their ban.
+func (l *ConnLimiter) Banned() map[string]time.Time {
+	banned := map[string]time.Time{}
+	if l == nil {
+		return banned
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	for ip, e := range l.bans {
+		if now.Before(e.bannedUntil) {
+			banned[ip] = e.bannedUntil
+		}
+	}
+	return banned
+}
+
+// Unban lifts the ban of ip and forgets its failures. Returns false if ip
+// is not banned.
+func (l *ConnLimiter) Unban(ip string) bool {
+	if l == nil {
+		return false
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+	l.Lock()
+	defer l.Unlock()
+	e, ok := l.bans[ip]
+	if !ok {
+		return false
+	}
+	delete(l.bans, ip)
+	return time.Now().Before(e.bannedUntil)
+}
@@ -0,0 +1,180 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func testAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 12345}
+}
+
+func TestConnLimiterNil(t *testing.T) {
+	var l *ConnLimiter
+	if err := l.Acquire("8388", testAddr("192.0.2.1")); err != nil {
+		t.Error("nil limiter should not limit:", err)
+	}
+	l.Release("8388", testAddr("192.0.2.1"))
+	if d := l.Fail(testAddr("192.0.2.1")); d != 0 {
+		t.Error("nil limiter should not ban")
+	}
+	if len(l.Banned()) != 0 || l.Unban("192.0.2.1") {
+		t.Error("nil limiter should have no ban")
+	}
+}
+
+func TestConnLimiterConns(t *testing.T) {
+	l := NewConnLimiter(&LimitConfig{MaxConnsPerIP: 2, MaxConnsPerPort: 3})
+	a, b := testAddr("192.0.2.1"), testAddr("192.0.2.2")
+
+	for i := 0; i < 2; i++ {
+		if err := l.Acquire("8388", a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Acquire("8388", a); err != ErrTooManyConnsIP {
+		t.Error("should reach the per ip limit, got", err)
+	}
+	// other ports share the per ip limit
+	if err := l.Acquire("8389", a); err != ErrTooManyConnsIP {
+		t.Error("per ip limit should cover all ports, got", err)
+	}
+	if err := l.Acquire("8388", b); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Acquire("8388", b); err != ErrTooManyConnsPort {
+		t.Error("should reach the per port limit, got", err)
+	}
+	if err := l.Acquire("8389", b); err != nil {
+		t.Error("per port limit should not cover other ports:", err)
+	}
+
+	l.Release("8388", a)
+	if err := l.Acquire("8388", testAddr("192.0.2.3")); err != nil {
+		t.Error("released connection should free the limits:", err)
+	}
+
+	// addresses without ip only count for the port
+	l.Load(&LimitConfig{MaxConnsPerIP: 1})
+	unix := &net.UnixAddr{Name: "/tmp/ss.sock", Net: "unix"}
+	for i := 0; i < 3; i++ {
+		if err := l.Acquire("8390", unix); err != nil {
+			t.Error("unix address should not be limited per ip:", err)
+		}
+	}
+}
+
+func TestConnLimiterPortLimits(t *testing.T) {
+	l := NewConnLimiter(&LimitConfig{MaxConnsPerIP: 3, MaxConnsPerPort: 1})
+	a, b := testAddr("192.0.2.1"), testAddr("192.0.2.2")
+	l.SetPortLimits("8388", &PortLimitConfig{MaxConnsPerIP: 1, MaxConnsPerPort: 3})
+
+	if err := l.Acquire("8388", a); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Acquire("8388", a); err != ErrTooManyConnsIP {
+		t.Error("should reach the per ip limit of the port, got", err)
+	}
+	if err := l.Acquire("8389", a); err != nil {
+		t.Error("per ip limit of the port should not cover other ports:", err)
+	}
+	// the port allows more connections than the config
+	if err := l.Acquire("8388", b); err != nil {
+		t.Error("port limit should override the config's:", err)
+	}
+	if err := l.Acquire("8389", b); err != ErrTooManyConnsPort {
+		t.Error("other ports should keep the config's limit, got", err)
+	}
+	// the config's per ip limit still covers all the ports
+	l.SetPortLimits("8390", &PortLimitConfig{MaxConnsPerPort: 10})
+	if err := l.Acquire("8390", a); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Acquire("8390", a); err != ErrTooManyConnsIP {
+		t.Error("config per ip limit should apply, got", err)
+	}
+
+	l.SetPortLimits("8388", nil)
+	l.Release("8388", a)
+	if err := l.Acquire("8388", b); err != ErrTooManyConnsPort {
+		t.Error("removed port limits should fall back to the config's, got", err)
+	}
+}
+
+func TestConnLimiterBan(t *testing.T) {
+	l := NewConnLimiter(&LimitConfig{BanThreshold: 3})
+	l.conf.banTime = 50 * time.Millisecond
+	l.conf.maxBanTime = 150 * time.Millisecond
+	a := testAddr("192.0.2.1")
+
+	ban := func() time.Duration {
+		var d time.Duration
+		for i := 0; i < 3; i++ {
+			d = l.Fail(a)
+		}
+		return d
+	}
+
+	if d := ban(); d != 50*time.Millisecond {
+		t.Fatalf("first ban should last ban_time, got %v", d)
+	}
+	if err := l.Acquire("8388", a); err != ErrBanned {
+		t.Error("banned ip should be refused, got", err)
+	}
+	if err := l.Acquire("8388", testAddr("192.0.2.2")); err != nil {
+		t.Error("other ips should not be banned:", err)
+	}
+	if _, ok := l.Banned()["192.0.2.1"]; !ok {
+		t.Error("banned ip should be listed")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := l.Acquire("8388", a); err != nil {
+		t.Error("ban should expire:", err)
+	}
+	if d := ban(); d != 100*time.Millisecond {
+		t.Errorf("second ban should be doubled, got %v", d)
+	}
+	time.Sleep(110 * time.Millisecond)
+	if d := ban(); d != 150*time.Millisecond {
+		t.Errorf("ban should be capped by max_ban_time, got %v", d)
+	}
+
+	if !l.Unban("192.0.2.1") {
+		t.Error("unban should lift the ban")
+	}
+	if err := l.Acquire("8388", a); err != nil {
+		t.Error("unbanned ip should be accepted:", err)
+	}
+	if l.Unban("192.0.2.1") {
+		t.Error("unban of ip not banned should fail")
+	}
+	// the ban count starts over after unban
+	if d := ban(); d != 50*time.Millisecond {
+		t.Errorf("ban after unban should last ban_time, got %v", d)
+	}
+}
+
+func TestConnLimiterBanWindow(t *testing.T) {
+	l := NewConnLimiter(&LimitConfig{BanThreshold: 2})
+	l.conf.banWindow = 30 * time.Millisecond
+	a := testAddr("192.0.2.1")
+
+	l.Fail(a)
+	time.Sleep(40 * time.Millisecond)
+	if d := l.Fail(a); d != 0 {
+		t.Error("failures out of the window should not count")
+	}
+	if d := l.Fail(a); d == 0 {
+		t.Error("failures within the window should ban")
+	}
+
+	l.Load(nil)
+	b := testAddr("192.0.2.2")
+	for i := 0; i < 5; i++ {
+		if d := l.Fail(b); d != 0 {
+			t.Fatal("banning should be disabled without threshold")
+		}
+	}
+}
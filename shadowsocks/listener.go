@@ -0,0 +1,142 @@
+package shadowsocks
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// handshakeTimeout limits reading the target address of accepted
+// connections if no timeout is configured.
+const handshakeTimeout = 30 * time.Second
+
+// ServerConn is a connection accepted by Listener, with the target address
+// already read.
+type ServerConn struct {
+	*Conn
+	host string
+	port int
+}
+
+// Target returns the address the client asked to connect to. host is a
+// domain name or an ip address.
+func (c *ServerConn) Target() (host string, port int) {
+	return c.host, c.port
+}
+
+// Listener accepts shadowsocks connections, so that programs can serve
+// clients and route their connections themselves. The target addresses are
+// read in background, so a slow client doesn't hold up the others.
+// Connections failing the handshake are dropped.
+type Listener struct {
+	net.Listener
+	cipher *Cipher
+
+	conns      chan *ServerConn
+	handshakes *ConnGroup // connections whose target address is being read
+	err        error      // set before done is closed
+	done       chan struct{}
+	once       sync.Once
+}
+
+// Listen listens on addr and accepts shadowsocks connections encrypted with
+// cipher.
+func Listen(network, addr string, cipher *Cipher) (*Listener, error) {
+	if cipher == nil {
+		return nil, ErrNilCipher
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(ln, cipher), nil
+}
+
+// NewListener accepts shadowsocks connections encrypted with cipher on ln.
+// Accept returns *ServerConn.
+func NewListener(ln net.Listener, cipher *Cipher) *Listener {
+	l := &Listener{
+		Listener:   ln,
+		cipher:     cipher,
+		conns:      make(chan *ServerConn),
+		handshakes: NewConnGroup(),
+		done:       make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *Listener) acceptLoop() {
+	var delay time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// e.g. too many open files, retry like net/http
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				tcpLog.Error("accept error", Err(err), F("retry", delay))
+				time.Sleep(delay)
+				continue
+			}
+			l.close(err)
+			return
+		}
+		delay = 0
+		if !l.handshakes.Add(conn) {
+			// closed
+			conn.Close()
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *Listener) handshake(conn net.Conn) {
+	c := NewConn(conn, l.cipher.Copy())
+	c.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	addr, err := getRequest(c)
+	l.handshakes.Done(conn)
+	if err != nil {
+		tcpLog.Info("error getting request", ClientAddr(c.RemoteAddr()), Err(err))
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	select {
+	case l.conns <- &ServerConn{Conn: c, host: host, port: port}:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *Listener) close(err error) {
+	l.once.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+// Accept returns the next connection with its target address read.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Close stops listening. Connections still in the handshake are closed.
+func (l *Listener) Close() error {
+	err := l.Listener.Close()
+	l.close(&net.OpError{Op: "accept", Net: l.Addr().Network(), Addr: l.Addr(), Err: net.ErrClosed})
+	l.handshakes.CloseAll()
+	return err
+}
@@ -0,0 +1,70 @@
+package shadowsocks
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestListener(t *testing.T) {
+	cipher, _ := NewCipher("aes-128-cfb", "foobar")
+	ln, err := Listen("tcp", "127.0.0.1:0", cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// a client not sending its request doesn't hold up the others
+	slow, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+
+	for _, target := range []string{"example.com:443", "192.0.2.1:80"} {
+		c, err := Dial(target, ln.Addr().String(), cipher.Copy())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Write([]byte("hi"))
+
+		accepted, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, port := accepted.(*ServerConn).Target()
+		if got := net.JoinHostPort(host, strconv.Itoa(port)); got != target {
+			t.Errorf("target got %s, want %s", got, target)
+		}
+		accepted.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != "hi" {
+			t.Errorf("payload got %q, %v", buf, err)
+		}
+		accepted.Close()
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := ln.Accept()
+		done <- err
+	}()
+	ln.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("accept should fail after close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("accept not unblocked by close")
+	}
+
+	// the slow client is dropped, not left to the handshake timeout
+	slow.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := slow.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection in the handshake should be closed, got %v", err)
+	}
+}
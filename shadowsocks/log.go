@@ -1,24 +1,25 @@
 package shadowsocks
 
 import (
-	"log"
-	"os"
+	"fmt"
+	"strings"
 )
 
+// DebugLog writes debug messages of the main subsystem when true.
+//
+// Deprecated: use Log with a subsystem instead.
 type DebugLog bool
 
 var Debug DebugLog
 
-var dbgLog = log.New(os.Stdout, "[DEBUG] ", log.Ldate | log.Ltime | log.Lshortfile | log.Lmicroseconds)
-
 func (d DebugLog) Printf(format string, args ...interface{}) {
 	if d {
-		dbgLog.Printf(format, args...)
+		Log(LogMain).Debug(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
 	}
 }
 
 func (d DebugLog) Println(args ...interface{}) {
 	if d {
-		dbgLog.Println(args...)
+		Log(LogMain).Debug(strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
 	}
 }
@@ -0,0 +1,421 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogConfig is the "log" section of the config.
+type LogConfig struct {
+	Level string `json:"level"` // debug, info, warn, error or off, default info
+	// Levels per subsystem: tcp, udp, obfs, manager and main.
+	Levels map[string]string `json:"levels"`
+	Format string            `json:"format"` // text or json, default text
+	File   string            `json:"file"`   // default stderr
+	// Size in MB after which the file is rotated, 0 to never rotate.
+	MaxSize    int `json:"max_size"`
+	MaxBackups int `json:"max_backups"` // rotated files to keep, default 3
+	// Anonymize client addresses, also enabled by the -A option.
+	Sanitize bool `json:"sanitize"`
+}
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelOff
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "off"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelOff {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return LevelWarn, nil
+	}
+	return LevelInfo, fmt.Errorf("shadowsocks: invalid log level %q", s)
+}
+
+// Log subsystems.
+const (
+	LogMain    = "main"    // startup, reload and shutdown
+	LogTCP     = "tcp"     // tcp connections
+	LogUDP     = "udp"     // udp relay
+	LogObfs    = "obfs"    // obfs connections
+	LogManager = "manager" // manager api and port management
+)
+
+var logSubsystems = []string{LogMain, LogTCP, LogUDP, LogObfs, LogManager}
+
+var (
+	mainLog = Log(LogMain)
+	tcpLog  = Log(LogTCP)
+	udpLog  = Log(LogUDP)
+	obfsLog = Log(LogObfs)
+	mgrLog  = Log(LogManager)
+)
+
+// Field is a key value pair attached to a log entry.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns a field.
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+// Err returns an "error" field.
+func Err(err error) Field {
+	return Field{"error", err}
+}
+
+// ClientAddr returns a "client" field with the client address, anonymized if
+// sanitizing is enabled.
+func ClientAddr(addr net.Addr) Field {
+	return Field{"client", sanitizedAddr{addr}}
+}
+
+type sanitizedAddr struct {
+	addr net.Addr
+}
+
+func (a sanitizedAddr) String() string {
+	return SanitizeAddr(a.addr)
+}
+
+// SanitizeAddr returns addr as a string, or a placeholder if sanitizing is
+// enabled.
+func SanitizeAddr(addr net.Addr) string {
+	logState.RLock()
+	sanitize := logState.sanitize
+	logState.RUnlock()
+	if sanitize {
+		return "x.x.x.x:zzzz"
+	}
+	if addr == nil {
+		return "<nil>"
+	}
+	return addr.String()
+}
+
+// Logger writes leveled, structured log entries.
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+	// Enabled reports whether entries of level are written, to skip
+	// building expensive fields.
+	Enabled(level Level) bool
+	// With returns a logger adding fields to every entry.
+	With(fields ...Field) Logger
+}
+
+// Log returns the logger of subsystem. Loggers follow SetupLog, so they can
+// be kept in package variables.
+func Log(subsystem string) Logger {
+	return &logger{sub: subsystem}
+}
+
+var logState = struct {
+	sync.RWMutex
+	def      Level
+	levels   map[string]Level
+	json     bool
+	sanitize bool
+	w        io.Writer
+	closer   io.Closer
+}{def: LevelInfo, w: os.Stderr}
+
+// serializes writes, so that entries are not interleaved
+var logWriteMu sync.Mutex
+
+// SetupLog applies config, nil for the defaults. The old settings are kept
+// on error.
+func SetupLog(config *LogConfig) error {
+	if config == nil {
+		config = &LogConfig{}
+	}
+	def := LevelInfo
+	var err error
+	if config.Level != "" {
+		if def, err = ParseLevel(config.Level); err != nil {
+			return err
+		}
+	}
+	levels := make(map[string]Level, len(config.Levels))
+	for sub, s := range config.Levels {
+		known := false
+		for _, name := range logSubsystems {
+			known = known || sub == name
+		}
+		if !known {
+			return fmt.Errorf("shadowsocks: unknown log subsystem %q", sub)
+		}
+		if levels[sub], err = ParseLevel(s); err != nil {
+			return err
+		}
+	}
+	var isJSON bool
+	switch config.Format {
+	case "", "text":
+	case "json":
+		isJSON = true
+	default:
+		return fmt.Errorf("shadowsocks: invalid log format %q", config.Format)
+	}
+	var w io.Writer = os.Stderr
+	var closer io.Closer
+	if config.File != "" {
+		rw, err := newRotateWriter(config.File, int64(config.MaxSize)<<20, config.MaxBackups)
+		if err != nil {
+			return err
+		}
+		w, closer = rw, rw
+	}
+
+	logState.Lock()
+	old := logState.closer
+	logState.def, logState.levels, logState.json = def, levels, isJSON
+	logState.sanitize = config.Sanitize
+	logState.w, logState.closer = w, closer
+	logState.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+type logger struct {
+	sub    string
+	fields []Field
+}
+
+func (l *logger) Enabled(level Level) bool {
+	logState.RLock()
+	defer logState.RUnlock()
+	min, ok := logState.levels[l.sub]
+	if !ok {
+		min = logState.def
+	}
+	return level >= min && level < LevelOff
+}
+
+func (l *logger) With(fields ...Field) Logger {
+	all := make([]Field, 0, len(l.fields)+len(fields))
+	all = append(all, l.fields...)
+	return &logger{l.sub, append(all, fields...)}
+}
+
+func (l *logger) Debug(msg string, fields ...Field) { l.log(LevelDebug, msg, fields) }
+func (l *logger) Info(msg string, fields ...Field)  { l.log(LevelInfo, msg, fields) }
+func (l *logger) Warn(msg string, fields ...Field)  { l.log(LevelWarn, msg, fields) }
+func (l *logger) Error(msg string, fields ...Field) { l.log(LevelError, msg, fields) }
+
+func (l *logger) log(level Level, msg string, fields []Field) {
+	if !l.Enabled(level) {
+		return
+	}
+	logState.RLock()
+	isJSON := logState.json
+	logState.RUnlock()
+	// encode without the lock, fields may call SanitizeAddr
+	var buf bytes.Buffer
+	if isJSON {
+		encodeJSON(&buf, time.Now(), level, l.sub, msg, l.fields, fields)
+	} else {
+		encodeText(&buf, time.Now(), level, l.sub, msg, l.fields, fields)
+	}
+	// hold the read lock while writing, so the writer is not closed by
+	// SetupLog meanwhile
+	logState.RLock()
+	logWriteMu.Lock()
+	logState.w.Write(buf.Bytes())
+	logWriteMu.Unlock()
+	logState.RUnlock()
+}
+
+// fieldValue converts errors and stringers, e.g. addresses, to strings.
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func encodeText(buf *bytes.Buffer, t time.Time, level Level, sub, msg string, fieldLists ...[]Field) {
+	buf.WriteString(t.Format("2006/01/02 15:04:05.000000"))
+	fmt.Fprintf(buf, " %-5s [%s] %s", strings.ToUpper(level.String()), sub, msg)
+	for _, fields := range fieldLists {
+		for _, f := range fields {
+			buf.WriteByte(' ')
+			buf.WriteString(f.Key)
+			buf.WriteByte('=')
+			s := fmt.Sprint(fieldValue(f.Value))
+			if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+				s = strconv.Quote(s)
+			}
+			buf.WriteString(s)
+		}
+	}
+	buf.WriteByte('\n')
+}
+
+func encodeJSON(buf *bytes.Buffer, t time.Time, level Level, sub, msg string, fieldLists ...[]Field) {
+	entry := map[string]interface{}{
+		"time":      t.Format(time.RFC3339Nano),
+		"level":     level.String(),
+		"subsystem": sub,
+		"msg":       msg,
+	}
+	for _, fields := range fieldLists {
+		for _, f := range fields {
+			if _, ok := entry[f.Key]; ok {
+				continue
+			}
+			v := fieldValue(f.Value)
+			if _, err := json.Marshal(v); err != nil {
+				v = fmt.Sprint(v)
+			}
+			entry[f.Key] = v
+		}
+	}
+	// json.Marshal sorts the keys, put the fixed ones first for readability
+	keys := make([]string, 0, len(entry))
+	for k := range entry {
+		switch k {
+		case "time", "level", "subsystem", "msg":
+		default:
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	buf.WriteByte('{')
+	for i, k := range append([]string{"time", "level", "subsystem", "msg"}, keys...) {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		kb, _ := json.Marshal(k)
+		vb, _ := json.Marshal(entry[k])
+		buf.Write(kb)
+		buf.WriteByte(':')
+		buf.Write(vb)
+	}
+	buf.WriteString("}\n")
+}
+
+// rotateWriter writes to a file, renaming it to file.1, file.2 and so on
+// once it reaches maxSize.
+type rotateWriter struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+	closed     bool
+}
+
+func newRotateWriter(path string, maxSize int64, maxBackups int) (*rotateWriter, error) {
+	if maxBackups <= 0 {
+		maxBackups = 3
+	}
+	w := &rotateWriter{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotateWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size = f, fi.Size()
+	return nil
+}
+
+func (w *rotateWriter) rotate() error {
+	w.f.Close()
+	w.f = nil
+	for i := w.maxBackups - 1; i > 0; i-- {
+		os.Rename(w.path+"."+strconv.Itoa(i), w.path+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(w.path, w.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return w.open()
+}
+
+func (w *rotateWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, errors.New("shadowsocks: log file closed")
+	}
+	if w.f == nil {
+		// reopen after a failed rotation
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotateWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
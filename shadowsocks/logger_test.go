@@ -0,0 +1,133 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogEncode(t *testing.T) {
+	tm := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	fields := []Field{F("port", 8388), F("host", "example.com:80"), Err(errors.New("connection refused"))}
+
+	var buf bytes.Buffer
+	encodeText(&buf, tm, LevelInfo, LogTCP, "error connecting", fields)
+	want := `2017/01/02 03:04:05.000000 INFO  [tcp] error connecting port=8388 host=example.com:80 error="connection refused"` + "\n"
+	if buf.String() != want {
+		t.Errorf("text got %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	encodeJSON(&buf, tm, LevelWarn, LogUDP, "read error", fields, []Field{F("msg", "ignored")})
+	want = `{"time":"2017-01-02T03:04:05Z","level":"warn","subsystem":"udp","msg":"read error",` +
+		`"error":"connection refused","host":"example.com:80","port":8388}` + "\n"
+	if buf.String() != want {
+		t.Errorf("json got %s, want %s", buf.String(), want)
+	}
+}
+
+// readLog sets up logging to a file in dir, calls fn and returns the lines
+// written.
+func readLog(t *testing.T, config *LogConfig, fn func()) []string {
+	dir, err := ioutil.TempDir("", "sslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer SetupLog(nil)
+	config.File = filepath.Join(dir, "ss.log")
+	if err := SetupLog(config); err != nil {
+		t.Fatal(err)
+	}
+	fn()
+	data, _ := ioutil.ReadFile(config.File)
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestLogLevels(t *testing.T) {
+	lines := readLog(t, &LogConfig{Level: "warn", Levels: map[string]string{"udp": "debug", "obfs": "off"}}, func() {
+		Log(LogTCP).Info("tcp info")
+		Log(LogTCP).Warn("tcp warn")
+		Log(LogUDP).Debug("udp debug")
+		Log(LogObfs).Error("obfs error")
+		Log(LogManager).With(F("port", "8388")).Error("manager error")
+	})
+	want := []string{"tcp warn", "udp debug", "manager error port=8388"}
+	if len(lines) != len(want) {
+		t.Fatalf("got lines %q", lines)
+	}
+	for i, line := range lines {
+		if !strings.HasSuffix(line, want[i]) {
+			t.Errorf("line %d got %q, want suffix %q", i, line, want[i])
+		}
+	}
+
+	for _, config := range []*LogConfig{
+		{Level: "verbose"},
+		{Levels: map[string]string{"http": "debug"}},
+		{Format: "xml"},
+	} {
+		if err := SetupLog(config); err == nil {
+			t.Errorf("%+v should be invalid", config)
+		}
+	}
+}
+
+func TestLogSanitize(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}
+	lines := readLog(t, &LogConfig{Format: "json", Sanitize: true}, func() {
+		Log(LogTCP).Info("new client", ClientAddr(addr))
+	})
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["client"] != "x.x.x.x:zzzz" {
+		t.Errorf("client address should be sanitized, got %v", entry["client"])
+	}
+	if SanitizeAddr(addr) != addr.String() {
+		t.Error("address should not be sanitized after reset")
+	}
+}
+
+func TestRotateWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ss.log")
+	w, err := newRotateWriter(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	for name, want := range map[string]string{
+		"ss.log":   "dddddddd\n",
+		"ss.log.1": "cccccccc\n",
+		"ss.log.2": "bbbbbbbb\n",
+	} {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		if string(data) != want {
+			t.Errorf("%s got %q, want %q", name, data, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("should keep only max_backups rotated files")
+	}
+	if _, err := w.Write([]byte("x")); err == nil {
+		t.Error("write after close should fail")
+	}
+}
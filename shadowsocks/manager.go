@@ -0,0 +1,224 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServeManager serves the manager api on conn until it's closed, see
+// https://github.com/shadowsocks/shadowsocks/wiki/Manage-Multiple-Users
+// Besides add:, remove:, ping and ping-stop, it supports denied, bans and
+// unban:.
+func (s *Server) ServeManager(conn *net.UDPConn) error {
+	s.manager.Lock()
+	s.manager.conn = conn
+	s.manager.Unlock()
+	// add a report address set for ping response
+	// according to https://github.com/shadowsocks/shadowsocks/wiki/Manage-Multiple-Users#example-code
+	ctx := make(chan bool, 1)
+	defer close(ctx)
+	go func() {
+		timer := time.NewTicker(10 * time.Second)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx:
+				return
+			case <-timer.C:
+				s.sendStats(conn)
+			}
+		}
+	}()
+
+	for {
+		// room for an add: with a key, the method and the limits
+		data := make([]byte, 1024)
+		_, remote, err := conn.ReadFromUDP(data)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			mgrLog.Error("failed to read manager message", Err(err))
+			continue
+		}
+		command := string(data)
+		var res []byte
+		switch {
+		case strings.HasPrefix(command, "add:"):
+			res = s.handleAddPort(bytes.Trim(data[4:], "\x00\r\n "))
+		case strings.HasPrefix(command, "remove:"):
+			res = s.handleRemovePort(bytes.Trim(data[7:], "\x00\r\n "))
+		case strings.HasPrefix(command, "denied"):
+			res = s.reportDenied()
+		case strings.HasPrefix(command, "bans"):
+			res = s.reportBans()
+		case strings.HasPrefix(command, "unban:"):
+			res = s.handleUnban(bytes.Trim(data[6:], "\x00\r\n "))
+		case strings.HasPrefix(command, "ping-stop"): // add the stop ping command
+			conn.WriteToUDP(handlePing(), remote)
+			s.manager.Lock()
+			delete(s.manager.reports, remote.String())
+			s.manager.Unlock()
+		case strings.HasPrefix(command, "ping"):
+			conn.WriteToUDP(handlePing(), remote)
+			s.manager.Lock()
+			s.manager.reports[remote.String()] = remote // append the host into the report list
+			s.manager.Unlock()
+		}
+		if len(res) == 0 {
+			continue
+		}
+		_, err = conn.WriteToUDP(res, remote)
+		if err != nil {
+			mgrLog.Error("failed to write manager message", Err(err))
+			continue
+		}
+	}
+}
+
+func (s *Server) sendStats(conn *net.UDPConn) {
+	res := s.reportStat()
+	s.manager.Lock()
+	defer s.manager.Unlock()
+	for _, addr := range s.manager.reports {
+		conn.WriteToUDP(res, addr)
+	}
+}
+
+// flushStats logs the traffic stats and sends them to the manager clients,
+// so the last traffic is not lost on exit.
+func (s *Server) flushStats() {
+	for port, traffic := range s.pm.getTrafficStats() {
+		mgrLog.Info("bytes transferred", F("port", port), F("bytes", traffic))
+	}
+	s.manager.Lock()
+	conn := s.manager.conn
+	s.manager.Unlock()
+	if conn != nil {
+		s.sendStats(conn)
+	}
+}
+
+func (s *Server) handleAddPort(payload []byte) []byte {
+	var params struct {
+		ServerPort interface{}      `json:"server_port"` // may be string or int
+		Password   string           `json:"password"`
+		Key        string           `json:"key"`
+		Method     string           `json:"method"` // the method of the config if empty
+		Limits     *PortLimitConfig `json:"limits"`
+	}
+	json.Unmarshal(payload, &params)
+	if params.ServerPort == nil || params.Password == "" && params.Key == "" {
+		// don't print the payload, it contains the password
+		mgrLog.Warn("failed to parse add request")
+		return []byte("err")
+	}
+	port := parsePortNum(params.ServerPort)
+	if port == "" {
+		return []byte("err")
+	}
+	user := &PortUser{Password: params.Password, Key: params.Key, Method: params.Method, Limits: params.Limits}
+	if err := s.AddPortUser(port, user); err != nil {
+		mgrLog.Error("error adding port", F("port", port), Err(err))
+		return []byte("err")
+	}
+	return []byte("ok")
+}
+
+func (s *Server) handleRemovePort(payload []byte) []byte {
+	var params struct {
+		ServerPort interface{} `json:"server_port"` // may be string or int
+		Force      bool        `json:"force"`       // close connections without draining
+	}
+	json.Unmarshal(payload, &params)
+	if params.ServerPort == nil {
+		mgrLog.Warn("failed to parse remove request", F("payload", string(payload)))
+		return []byte("err")
+	}
+	port := parsePortNum(params.ServerPort)
+	if port == "" {
+		return []byte("err")
+	}
+	mgrLog.Info("closing port", F("port", port))
+	// removing a port not served is not an error
+	s.RemoveUser(port, params.Force)
+	return []byte("ok")
+}
+
+func handlePing() []byte {
+	return []byte("pong")
+}
+
+// reportStat get the stat:trafficStat and return avery 10 sec as for the protocol
+// https://github.com/shadowsocks/shadowsocks/wiki/Manage-Multiple-Users
+func (s *Server) reportStat() []byte {
+	stats := s.pm.getTrafficStats()
+	var buf bytes.Buffer
+	buf.WriteString("stat: ")
+	ret, _ := json.Marshal(stats)
+	buf.Write(ret)
+	return buf.Bytes()
+}
+
+// reportDenied returns the number of connections and udp requests denied by
+// the acl for each port.
+func (s *Server) reportDenied() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("denied: ")
+	ret, _ := json.Marshal(s.pm.getDeniedStats())
+	buf.Write(ret)
+	return buf.Bytes()
+}
+
+// reportBans returns the client ips banned for failing handshakes, with the
+// end of their ban.
+func (s *Server) reportBans() []byte {
+	bans := map[string]string{}
+	for ip, until := range s.limiter.Banned() {
+		bans[ip] = until.UTC().Format(time.RFC3339)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("bans: ")
+	ret, _ := json.Marshal(bans)
+	buf.Write(ret)
+	return buf.Bytes()
+}
+
+func (s *Server) handleUnban(payload []byte) []byte {
+	var params struct {
+		IP string `json:"ip"`
+	}
+	json.Unmarshal(payload, &params)
+	if params.IP == "" {
+		mgrLog.Warn("failed to parse unban request", F("payload", string(payload)))
+		return []byte("err")
+	}
+	if !s.limiter.Unban(params.IP) {
+		return []byte("err")
+	}
+	mgrLog.Info("unbanned client", F("ip", params.IP))
+	return []byte("ok")
+}
+
+func parsePortNum(in interface{}) string {
+	var port string
+	switch in.(type) {
+	case string:
+		// try to convert to number then convert back, to ensure valid value
+		portNum, err := strconv.Atoi(in.(string))
+		if portNum == 0 || err != nil {
+			return ""
+		}
+		port = strconv.Itoa(portNum)
+	case float64:
+		port = strconv.Itoa(int(in.(float64)))
+	default:
+		return ""
+	}
+	return port
+}
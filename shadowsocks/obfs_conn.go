@@ -130,7 +130,7 @@ func (oc *ObfsConn) FakeResponse() {
 
 func (oc *ObfsConn) InitDecrypt(iv []byte) (err error) {
     if oc.dec != nil {
-        Printn("decrypt already init!")
+        obfsLog.Debug("decrypt already init")
         return nil
     }
     if oc.Cipher == nil {
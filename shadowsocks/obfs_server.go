@@ -0,0 +1,322 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// obfsListener is the port shared by the users of the obfs server.
+type obfsListener struct {
+	sync.Mutex
+	port      string
+	listeners []net.Listener
+	closing   bool // set on shutdown, the listeners are closed
+	conns     *ConnGroup
+}
+
+// obfsUser is the port_password entry of an obfs user, found by the password
+// sent in the obfs header.
+type obfsUser struct {
+	port   string
+	cipher *Cipher
+}
+
+// NewObfsServer creates a server like NewServer, except that the users share
+// obfs_port, each one found by the password sent in the http header of the
+// obfs protocol. The ports of port_password only name the users in the
+// stats, the limits, the access log and the manager commands, they are not
+// listened on. The users need a password and a stream cipher method, keys
+// and the aead methods are not supported, and neither is the udp relay. The
+// listen config applies to obfs_port.
+func NewObfsServer(config *Config) (*Server, error) {
+	config, err := prepareServerConfig(config, true)
+	if err != nil {
+		return nil, err
+	}
+	if config.UDP {
+		mainLog.Warn("the obfs server doesn't support the udp relay, ignore the udp option")
+	}
+	s, err := newServer(config)
+	if err != nil {
+		return nil, err
+	}
+	s.UDP = false
+	s.obfs = &obfsListener{port: strconv.Itoa(config.ObfsPort), conns: NewConnGroup()}
+	return s, nil
+}
+
+// checkObfsConfig checks the users of the prepared config c can share the
+// obfs port: the password finds the user, so it must be unique.
+func checkObfsConfig(c *Config) error {
+	if c.ObfsPort <= 0 {
+		return errors.New("shadowsocks: obfs_port not set")
+	}
+	passwords := make(map[string]string, len(c.PortUsers))
+	for port, user := range c.PortUsers {
+		if err := checkObfsUser(user); err != nil {
+			return fmt.Errorf("shadowsocks: port %s: %v", port, err)
+		}
+		if other, ok := passwords[user.Password]; ok {
+			return fmt.Errorf("shadowsocks: ports %s and %s share a password, the obfs server can't tell them apart", other, port)
+		}
+		passwords[user.Password] = port
+	}
+	return nil
+}
+
+// checkObfsUser checks user, with its method set, is supported by the obfs
+// protocol.
+func checkObfsUser(user *PortUser) error {
+	if user.Key != "" || user.Password == "" {
+		return errors.New("obfs doesn't support keys, use a password")
+	}
+	if ci, _ := LookupCipher(user.Method); ci.AEAD {
+		return fmt.Errorf("obfs doesn't support aead method %s", user.Method)
+	}
+	return nil
+}
+
+// listenObfs listens on the obfs port, which maybe inherited from the parent
+// process, and serves it in background.
+func (s *Server) listenObfs() error {
+	listen := s.getConfig().Listen
+	lns, err := listen.listen(s.obfs.port)
+	if err != nil {
+		obfsLog.Error("error listening port", F("port", s.obfs.port), Err(err))
+		return err
+	}
+	s.obfs.Lock()
+	defer s.obfs.Unlock()
+	if s.obfs.closing {
+		for _, ln := range lns {
+			ln.Close()
+		}
+		return errors.New("shadowsocks: server closed")
+	}
+	s.obfs.listeners = lns
+	for _, ln := range lns {
+		obfsLog.Info("server listening port", F("port", s.obfs.port), F("addr", ln.Addr()))
+		go s.serveObfs(s.proxyProto.Listener(listen.socket().listener(ln)))
+	}
+	return nil
+}
+
+// closeObfs stops the listeners of the obfs port and returns its
+// connections.
+func (s *Server) closeObfs() *ConnGroup {
+	s.obfs.Lock()
+	defer s.obfs.Unlock()
+	s.obfs.closing = true
+	for _, ln := range s.obfs.listeners {
+		ln.Close()
+	}
+	return s.obfs.conns
+}
+
+func (s *Server) serveObfs(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			// listener closed on shutdown
+			obfsLog.Debug("accept error", F("port", s.obfs.port), Err(err))
+			return
+		}
+		if !s.obfs.conns.Add(conn) {
+			conn.Close()
+			continue
+		}
+		go func(conn net.Conn) {
+			s.handleObfsConnection(ObfsNewConn(conn))
+			s.obfs.conns.Done(conn)
+		}(conn)
+	}
+}
+
+// getObfsRequest reads the obfs header and the first data, which hold the
+// password and the target address. port is the user of the password, data
+// the request data following the address.
+func (s *Server) getObfsRequest(oc *ObfsConn) (host, port string, data []byte, err error) {
+	SetReadTimeout(oc)
+	buf := ObfsLeakyBuf.Get()
+	defer ObfsLeakyBuf.Put(buf)
+	n, err := oc.Read(buf)
+	if err != nil {
+		return
+	}
+	parts := strings.SplitN(string(buf[:n]), "\r\n\r\n", 2)
+	if len(parts) < 2 {
+		err = errors.New("obfs header not complete")
+		return
+	}
+	obfs, err := ParseObfsHeader(&parts[0])
+	if err != nil {
+		return
+	}
+	user, ok := s.pm.getObfs(obfs.Pass)
+	if !ok {
+		// don't print the password
+		err = errors.New("password not exist in config")
+		return
+	}
+	port = user.port
+	oc.Cipher = user.cipher.Copy()
+
+	encrypted := buf[len(parts[0])+4 : n]
+	if len(obfs.RandHead) > 0 {
+		encrypted = append(obfs.RandHead, encrypted...)
+	}
+	ivLen := oc.GetIvLen()
+	if len(encrypted) < ivLen {
+		err = errors.New("iv not complete")
+		return
+	}
+	// copied, buf goes back to the pool while the cipher keeps the iv
+	iv := append([]byte(nil), encrypted[:ivLen]...)
+	if err = oc.InitDecrypt(iv); err != nil {
+		return
+	}
+	payload := make([]byte, len(encrypted)-ivLen)
+	if err = oc.DecryptByte(payload, encrypted[ivLen:]); err != nil {
+		return
+	}
+
+	if len(payload) < idType+1 {
+		err = errors.New("address type not complete")
+		return
+	}
+	var reqStart, reqEnd int
+	addrType := payload[idType]
+	switch addrType & AddrMask {
+	case typeIPv4:
+		reqStart, reqEnd = idIP0, lenIPv4
+	case typeIPv6:
+		reqStart, reqEnd = idIP0, lenIPv6
+	case typeDm:
+		if len(payload) < idDmLen+1 {
+			err = errors.New("domain length not complete")
+			return
+		}
+		reqStart, reqEnd = idDm0, int(payload[idDmLen])+lenDmBase
+	default:
+		err = fmt.Errorf("addr type %d not supported", addrType&AddrMask)
+		return
+	}
+	if len(payload) < reqEnd {
+		err = errors.New("address not complete")
+		return
+	}
+	switch addrType & AddrMask {
+	case typeIPv4:
+		host = net.IP(payload[idIP0 : idIP0+net.IPv4len]).String()
+	case typeIPv6:
+		host = net.IP(payload[idIP0 : idIP0+net.IPv6len]).String()
+	case typeDm:
+		host = string(payload[reqStart : reqEnd-2])
+	}
+	targetPort := binary.BigEndian.Uint16(payload[reqEnd-2 : reqEnd])
+	host = net.JoinHostPort(host, strconv.Itoa(int(targetPort)))
+	data = payload[reqEnd:]
+	return
+}
+
+func (s *Server) handleObfsConnection(oc *ObfsConn) {
+	var host, port string
+	start := time.Now()
+	id := NewConnID()
+
+	if cnt, next := atomic.AddInt32(&s.connCnt, 1), atomic.LoadInt32(&s.nextLogConnCnt); cnt >= next {
+		if atomic.CompareAndSwapInt32(&s.nextLogConnCnt, next, next+logCntDelta) {
+			obfsLog.Info("number of client connections reaches limit", F("count", next))
+		}
+	}
+	obfsLog.Debug("new client", F("conn", id), ClientAddr(oc.RemoteAddr()), F("local", oc.LocalAddr()))
+	closed := false
+	defer func() {
+		obfsLog.Debug("closed pipe", F("conn", id), ClientAddr(oc.RemoteAddr()), F("host", host))
+		atomic.AddInt32(&s.connCnt, -1)
+		if !closed {
+			oc.Close()
+		}
+	}()
+
+	host, port, data, err := s.getObfsRequest(oc)
+	if err != nil {
+		obfsLog.Info("error getting host", ClientAddr(oc.RemoteAddr()), Err(err))
+		if d := s.limiter.Fail(oc.RemoteAddr()); d > 0 {
+			obfsLog.Warn("banned client after failed handshakes", ClientAddr(oc.RemoteAddr()), F("duration", d))
+		}
+		oc.FakeResponse()
+		return
+	}
+	// the limits of the user apply once it's known
+	if err := s.limiter.Acquire(port, oc.RemoteAddr()); err != nil {
+		if err == ErrBanned {
+			obfsLog.Debug("refused client", ClientAddr(oc.RemoteAddr()), F("user", port), Err(err))
+		} else {
+			obfsLog.Warn("refused client", ClientAddr(oc.RemoteAddr()), F("user", port), Err(err))
+		}
+		return
+	}
+	defer s.limiter.Release(port, oc.RemoteAddr())
+	// so removing the user drains or closes its connections
+	conns := s.pm.connGroup(port)
+	if !conns.Add(oc.Conn) {
+		return
+	}
+	defer conns.Done(oc.Conn)
+
+	// ensure the host does not contain some illegal characters, NUL may panic on Win32
+	if strings.ContainsRune(host, 0x00) {
+		obfsLog.Warn("invalid domain name", ClientAddr(oc.RemoteAddr()))
+		return
+	}
+	remote, err := s.dialRemote(port, host)
+	if err != nil {
+		reason := "dial error"
+		if IsACLDenied(err) {
+			reason = "denied"
+			obfsLog.Info("connection denied", F("user", port), Err(err))
+			s.pm.addDenied(port)
+		} else if ne, ok := err.(*net.OpError); ok && (ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE) {
+			// EMFILE is process reaches open file limits, ENFILE is system limit
+			obfsLog.Error("dial error", F("host", host), Err(err))
+		} else {
+			obfsLog.Info("error connecting", F("host", host), Err(err))
+		}
+		s.logAccess(id, start, port, oc.RemoteAddr(), host, 0, 0, reason)
+		return
+	}
+	if s.proxyProto.ShouldSend(remote.RemoteAddr()) {
+		if err = WriteProxyHeader(remote, oc.RemoteAddr(), oc.LocalAddr()); err != nil {
+			obfsLog.Info("error sending proxy protocol header", F("host", host), Err(err))
+			remote.Close()
+			s.logAccess(id, start, port, oc.RemoteAddr(), host, 0, 0, "remote error")
+			return
+		}
+	}
+	if len(data) > 0 {
+		if _, err = remote.Write(data); err != nil {
+			obfsLog.Info("error writing request data", F("host", host), Err(err))
+			remote.Close()
+			s.logAccess(id, start, port, oc.RemoteAddr(), host, 0, 0, "remote error")
+			return
+		}
+		s.pm.addTraffic(port, len(data))
+	}
+	obfsLog.Debug("piping", F("conn", id), ClientAddr(oc.RemoteAddr()), F("host", host))
+	up, down, reason := Relay(oc, remote, func(traffic int) {
+		s.pm.addTraffic(port, traffic)
+	})
+	closed = true
+	// the request data read with the obfs header
+	up += int64(len(data))
+	s.logAccess(id, start, port, oc.RemoteAddr(), host, up, down, reason)
+}
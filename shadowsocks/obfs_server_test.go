@@ -0,0 +1,143 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// obfsEcho sends msg to the echo server through the obfs server at addr,
+// with the request in the first write like the obfs clients, and returns the
+// reply.
+func obfsEcho(addr, password, method, echoAddr, msg string) (string, error) {
+	header := "GET / HTTP/1.1\r\nHost: example.com\r\nCookie: " + ObfsPassKey + "=" + password
+	return obfsEchoHeader(addr, header, password, method, echoAddr, msg)
+}
+
+// obfsEchoHeader is obfsEcho sending the given http header.
+func obfsEchoHeader(addr, header, password, method, echoAddr, msg string) (string, error) {
+	cipher, err := NewCipher(method, password)
+	if err != nil {
+		return "", err
+	}
+	rawaddr, err := RawAddr(echoAddr)
+	if err != nil {
+		return "", err
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	enc := cipher.Copy()
+	iv, err := enc.initEncrypt()
+	if err != nil {
+		return "", err
+	}
+	payload := append(rawaddr, msg...)
+	req := []byte(header + "\r\n\r\n")
+	req = append(req, iv...)
+	encrypted := make([]byte, len(payload))
+	enc.encrypt(encrypted, payload)
+	if _, err = conn.Write(append(req, encrypted...)); err != nil {
+		return "", err
+	}
+
+	resHeader := make([]byte, ObfsResHeaderLen)
+	if _, err = io.ReadFull(conn, resHeader); err != nil {
+		return "", err
+	}
+	if !bytes.Equal(resHeader, ObfsResponseHeader) {
+		return "", errors.New("got the fake response")
+	}
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(NewConn(conn, cipher.Copy()), buf)
+	return string(buf), err
+}
+
+func TestObfsServer(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	obfsPort := freePort(t)
+	config := &Config{
+		PortPassword: map[string]string{"1001": "foobar", "1002": "barfoo"},
+		Method:       "aes-128-cfb",
+		ObfsPort:     mustAtoi(obfsPort),
+	}
+
+	bad := []*Config{
+		{PortPassword: map[string]string{"1001": "foobar"}},
+		{PortPassword: map[string]string{"1001": "foobar", "1002": "foobar"}, ObfsPort: 8088},
+		{PortPassword: map[string]string{"1001": "foobar"}, Method: "aes-128-gcm", ObfsPort: 8088},
+		{PortUsers: map[string]*PortUser{"1001": {Key: "AAECAwQFBgcICQoLDA0ODw=="}}, ObfsPort: 8088},
+	}
+	for _, c := range bad {
+		if _, err := NewObfsServer(c); err == nil {
+			t.Errorf("%+v should fail", c)
+		}
+	}
+
+	s, err := NewObfsServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr := "127.0.0.1:" + obfsPort
+
+	for _, password := range []string{"foobar", "barfoo"} {
+		if got, err := obfsEcho(addr, password, "aes-128-cfb", echo.Addr().String(), "hello"); err != nil || got != "hello" {
+			t.Fatalf("echo with %s got %q, %v", password, got, err)
+		}
+	}
+	if _, err := obfsEcho(addr, "nobody", "aes-128-cfb", echo.Addr().String(), "hello"); err == nil {
+		t.Error("unknown password should fail")
+	}
+	if _, err := obfsEchoHeader(addr, "GET / HTTP/1.1", "foobar", "aes-128-cfb", echo.Addr().String(), "hello"); err == nil {
+		t.Error("malformed header should fail")
+	}
+	stats := s.Stats()
+	if stats.Traffic["1001"] == 0 || stats.Traffic["1002"] == 0 {
+		t.Errorf("traffic should be counted by user, got %v", stats.Traffic)
+	}
+	if lns, _ := s.Listeners(); len(lns) != 1 {
+		t.Errorf("got %d listeners, want the obfs one", len(lns))
+	}
+
+	// the users are not listened on, and are changed without restarting
+	if _, err := net.Dial("tcp", "127.0.0.1:1001"); err == nil {
+		t.Error("user port should not be listening")
+	}
+	config.PortPassword = map[string]string{"1001": "barfoo", "1003": "foobar"}
+	if err = s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := obfsEcho(addr, "barfoo", "aes-128-cfb", echo.Addr().String(), "hello"); err != nil || got != "hello" {
+		t.Fatalf("echo after reload got %q, %v", got, err)
+	}
+	stats = s.Stats()
+	if _, ok := stats.Traffic["1002"]; ok || stats.Traffic["1001"] == 0 {
+		t.Errorf("the password of 1002 should be 1001's, got %v", stats.Traffic)
+	}
+
+	if err = s.AddPortUser("1004", &PortUser{Password: "foobar"}); err == nil {
+		t.Error("password of another user should fail")
+	}
+	if err = s.AddPortUser("1004", &PortUser{Password: "secret", Method: "chacha20-ietf-poly1305"}); err == nil {
+		t.Error("aead method should fail")
+	}
+	if err = s.RemoveUser("1003", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obfsEcho(addr, "foobar", "aes-128-cfb", echo.Addr().String(), "hello"); err == nil {
+		t.Error("removed user should fail")
+	}
+}
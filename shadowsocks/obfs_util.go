@@ -39,8 +39,13 @@ var (
     ObfsResHeaderLen    = len(ObfsResponseHeader)
 )
 
+// Printn logs an info message of the obfs subsystem.
+//
+// Deprecated: use Log(LogObfs) instead.
 func Printn(format string, content... interface{}) (n int, err error) {
-    return fmt.Printf(format + "\n", content...)
+    msg := fmt.Sprintf(format, content...)
+    obfsLog.Info(msg)
+    return len(msg) + 1, nil
 }
 
 // parse obfs header
@@ -53,7 +58,6 @@ type ObfsHeader struct {
 func ParseObfsHeader(header *string) (obfs *ObfsHeader, err error) {
     if header == nil {
         err = fmt.Errorf("obfs heder[%p] nullptr", header)
-        Printn("%s", err.Error())
         return nil, err
     }
     str_arr := strings.Split(*header, "\r\n")
@@ -61,7 +65,6 @@ func ParseObfsHeader(header *string) (obfs *ObfsHeader, err error) {
     min_len := 2
     if arr_len < min_len {
         err = fmt.Errorf("obfs fields len[%d] while min len[%d]", arr_len, min_len)
-        Printn("%s", err.Error())
         return nil, err
     }
 
@@ -95,7 +98,6 @@ func ParseObfsHeader(header *string) (obfs *ObfsHeader, err error) {
         expect_len := 2
         if farr_len != expect_len {
             err = fmt.Errorf("fields len[%d] while expect [%d]", farr_len, expect_len)
-            Printn("%s", err.Error())
             return nil, err
         }
         fields_str := fields_arr[1]
@@ -106,9 +108,9 @@ func ParseObfsHeader(header *string) (obfs *ObfsHeader, err error) {
             split_len := len(split_arr)
             expect_len := 2
             if split_len != expect_len {
-                err = fmt.Errorf("key value string[%s] split size[%d] error! obfs header:%s",
-                        key_val_str, *header)
-                Printn("%s", err.Error())
+                // don't print the header or the item, they may contain the password
+                err = fmt.Errorf("obfs header item split size[%d] while expect [%d]",
+                        split_len, expect_len)
                 return nil, err
             }
             key := strings.TrimSpace(split_arr[0])
@@ -120,7 +122,6 @@ func ParseObfsHeader(header *string) (obfs *ObfsHeader, err error) {
     }
     if pass == "" {
         err = fmt.Errorf("no pass from obfs header")
-        Printn("%s", err.Error())
         return nil, err
     }
 
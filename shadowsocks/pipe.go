@@ -1,19 +1,26 @@
 package shadowsocks
 
 import (
+	"io"
 	"net"
 	"time"
 )
 
 func SetReadTimeout(c net.Conn) {
-	if readTimeout != 0 {
-		c.SetReadDeadline(time.Now().Add(readTimeout))
+	if timeout := getReadTimeout(); timeout != 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
 	}
 }
 
 // PipeThenClose copies data from src to dst, closes dst when done.
 func PipeThenClose(src, dst net.Conn, addTraffic func(int)) {
 	defer dst.Close()
+	pipe(src, dst, addTraffic)
+}
+
+// pipe copies data from src to dst until reading or writing fails. readErr
+// is nil on EOF.
+func pipe(src, dst net.Conn, addTraffic func(int)) (readErr, writeErr error) {
 	buf := leakyBuf.Get()
 	defer leakyBuf.Put(buf)
 	for {
@@ -28,8 +35,8 @@ func PipeThenClose(src, dst net.Conn, addTraffic func(int)) {
 			// Note: avoid overwrite err returned by Read.
 			_, err := dst.Write(buf[0:n])
             if err != nil {
-				Debug.Println("write:", err)
-				break
+				tcpLog.Debug("write error", Err(err))
+				return nil, err
 			}
 		}
 		if err != nil {
@@ -37,10 +44,13 @@ func PipeThenClose(src, dst net.Conn, addTraffic func(int)) {
 			// identify this specific error. So just leave the error along for now.
 			// More info here: https://code.google.com/p/go/issues/detail?id=4373
 			/*
-				if bool(Debug) && err != io.EOF {
-					Debug.Println("read:", err)
+				if err != io.EOF {
+					tcpLog.Debug("read error", Err(err))
 				}
 			*/
+			if err != io.EOF {
+				readErr = err
+			}
 			break
 		}
 	}
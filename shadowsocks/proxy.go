@@ -1,6 +1,7 @@
 package shadowsocks
 
 import (
+	"context"
 	"errors"
 	"strings"
 	"fmt"
@@ -12,6 +13,9 @@ type Dialer struct {
 	cipher *Cipher
 	server string
 	support_udp bool
+	// Forward connects to the server, e.g. a net.Dialer with socket options,
+	// an OutboundDialer or a ProxyChain. nil uses the default OutboundDialer.
+	Forward ContextDialer
 }
 
 type ProxyConn struct {
@@ -27,20 +31,29 @@ type ProxyAddr struct {
 var ErrNilCipher = errors.New("cipher can't be nil")
 
 func NewDialer(server string, cipher *Cipher) (dialer *Dialer, err error) {
-	// Currently shadowsocks-go do not support UDP
 	if cipher == nil {
 		return nil, ErrNilCipher
 	}
 	return &Dialer {
 		cipher: cipher,
 		server: server,
-		support_udp: false,
+		support_udp: true,
 	}, nil
 }
 
 func (d *Dialer) Dial(network, addr string) (c net.Conn, err error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the server, ctx covers connecting to
+// the server and sending the address.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (c net.Conn, err error) {
 	if strings.HasPrefix(network, "tcp") {
-		conn, err := Dial(addr, d.server, d.cipher.Copy())
+		rawaddr, err := RawAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := DialWithRawAddrContext(ctx, d.Forward, rawaddr, d.server, d.cipher.Copy())
 		if err != nil {
 			return nil, err
 		}
@@ -52,9 +65,36 @@ func (d *Dialer) Dial(network, addr string) (c net.Conn, err error) {
 			},
 		}, nil
 	}
+	if strings.HasPrefix(network, "udp") && d.support_udp {
+		return d.dialUDP(network, addr)
+	}
 	return nil, fmt.Errorf("unsupported connection type: %s", network)
 }
 
+// connect requests addr from the server over c, an established connection to
+// the server, e.g. through other proxies.
+func (d *Dialer) connect(c net.Conn, network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, fmt.Errorf("unsupported connection type: %s", network)
+	}
+	rawaddr, err := RawAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := NewConn(c, d.cipher.Copy())
+	if _, err = conn.Write(rawaddr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &ProxyConn {
+		Conn: conn,
+		raddr: &ProxyAddr {
+			network: network,
+			address: addr,
+		},
+	}, nil
+}
+
 func (c *ProxyConn) LocalAddr() net.Addr {
 	return c.Conn.LocalAddr()
 }
@@ -0,0 +1,332 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyProtocolConfig is the "proxy_protocol" section of the server config.
+type ProxyProtocolConfig struct {
+	// Connections from these addresses or CIDRs, e.g. load balancers, must
+	// start with a PROXY protocol v1 or v2 header giving the real client
+	// address. Other connections are served as usual.
+	Trusted []string `json:"trusted"`
+	// Outbound connections to these addresses or CIDRs start with a PROXY
+	// protocol v2 header giving the client address.
+	SendTo []string `json:"send_to"`
+}
+
+// How long to wait for the PROXY protocol header.
+var ProxyHeaderTimeout = 10 * time.Second
+
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	proxyV1MaxLen = 107
+	proxyV2Local  = 0x20
+	proxyV2Proxy  = 0x21
+	proxyV2TCP4   = 0x11
+	proxyV2TCP6   = 0x21
+	proxyV2UDP4   = 0x12
+	proxyV2UDP6   = 0x22
+)
+
+// ProxyProtocol parses PROXY protocol headers on inbound connections and
+// writes them on outbound ones. The zero value and a nil *ProxyProtocol do
+// neither. It's safe for concurrent use and can be reloaded while in use.
+type ProxyProtocol struct {
+	sync.RWMutex
+	trusted []*net.IPNet
+	sendTo  []*net.IPNet
+}
+
+// NewProxyProtocol creates a ProxyProtocol from config.
+func NewProxyProtocol(config *ProxyProtocolConfig) (*ProxyProtocol, error) {
+	p := &ProxyProtocol{}
+	if err := p.Load(config); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Load replaces the settings. The old settings are kept on error.
+func (p *ProxyProtocol) Load(config *ProxyProtocolConfig) error {
+	var trusted, sendTo []*net.IPNet
+	if config != nil {
+		var err error
+		if trusted, err = parseCIDRs(config.Trusted); err != nil {
+			return err
+		}
+		if sendTo, err = parseCIDRs(config.SendTo); err != nil {
+			return err
+		}
+	}
+	p.Lock()
+	p.trusted, p.sendTo = trusted, sendTo
+	p.Unlock()
+	return nil
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func (p *ProxyProtocol) match(field func(*ProxyProtocol) []*net.IPNet, addr net.Addr) bool {
+	if p == nil {
+		return false
+	}
+	p.RLock()
+	nets := field(p)
+	p.RUnlock()
+	if len(nets) == 0 {
+		return false
+	}
+	ip := addrIP(addr)
+	return ip != nil && netMatch(nets, ip)
+}
+
+func (p *ProxyProtocol) isTrusted(addr net.Addr) bool {
+	return p.match(func(p *ProxyProtocol) []*net.IPNet { return p.trusted }, addr)
+}
+
+// ShouldSend reports whether outbound connections to addr should start with
+// a PROXY protocol header.
+func (p *ProxyProtocol) ShouldSend(addr net.Addr) bool {
+	return p.match(func(p *ProxyProtocol) []*net.IPNet { return p.sendTo }, addr)
+}
+
+// Listener wraps ln, so that accepted connections from trusted sources
+// report the client address given in their PROXY protocol header as
+// RemoteAddr. The header is read on the first Read or RemoteAddr call, not
+// in Accept, so that a slow client can't block the accept loop.
+func (p *ProxyProtocol) Listener(ln net.Listener) net.Listener {
+	return &proxyProtoListener{ln, p}
+}
+
+type proxyProtoListener struct {
+	net.Listener
+	p *ProxyProtocol
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil || !l.p.isTrusted(c.RemoteAddr()) {
+		return c, err
+	}
+	return &proxyProtoConn{Conn: c}, nil
+}
+
+// proxyProtoConn is a connection from a trusted source, starting with a
+// PROXY protocol header.
+type proxyProtoConn struct {
+	net.Conn
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+
+	mu           sync.Mutex
+	readDeadline time.Time // set by the user, restored after reading the header
+}
+
+func (c *proxyProtoConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+		c.remoteAddr, c.localAddr, c.err = ReadProxyHeader(c.Conn)
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.mu.Unlock()
+		if c.err != nil {
+			tcpLog.Info("invalid proxy protocol header", ClientAddr(c.Conn.RemoteAddr()), Err(c.err))
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr returns the client address given in the header, or the address
+// of the peer if the header is invalid or has no address.
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remoteAddr
+}
+
+// LocalAddr returns the destination address given in the header, or the
+// local address of the connection.
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.localAddr == nil {
+		return c.Conn.LocalAddr()
+	}
+	return c.localAddr
+}
+
+func (c *proxyProtoConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtoConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// ReadProxyHeader reads a PROXY protocol v1 or v2 header from r, without
+// reading past it. The addresses are nil for the UNKNOWN protocol of v1 and
+// the LOCAL command of v2, which are used for health checks.
+func ReadProxyHeader(r io.Reader) (src, dst net.Addr, err error) {
+	buf := make([]byte, 12, proxyV1MaxLen)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return
+	}
+	if bytes.Equal(buf, proxyV2Sig) {
+		return readProxyV2(r)
+	}
+	if !bytes.HasPrefix(buf, proxyV1Prefix) {
+		return nil, nil, errors.New("shadowsocks: missing proxy protocol header")
+	}
+	// v1 is a line, read byte by byte to not read past it
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(buf, []byte("\r\n")) {
+		if len(buf) == proxyV1MaxLen {
+			return nil, nil, errors.New("shadowsocks: proxy protocol v1 header too long")
+		}
+		if _, err = io.ReadFull(r, b); err != nil {
+			return
+		}
+		buf = append(buf, b[0])
+	}
+	return parseProxyV1(string(buf[len(proxyV1Prefix) : len(buf)-2]))
+}
+
+func parseProxyV1(line string) (src, dst net.Addr, err error) {
+	fields := strings.Split(line, " ")
+	if len(fields) > 0 && fields[0] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, nil, fmt.Errorf("shadowsocks: invalid proxy protocol v1 header %q", line)
+	}
+	parse := func(ipStr, portStr string) (*net.TCPAddr, error) {
+		ip := net.ParseIP(ipStr)
+		port, err := strconv.Atoi(portStr)
+		if ip == nil || err != nil || port < 0 || port > 0xffff ||
+			(fields[0] == "TCP4") != (ip.To4() != nil) {
+			return nil, fmt.Errorf("shadowsocks: invalid proxy protocol v1 address %s %s", ipStr, portStr)
+		}
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	}
+	s, err := parse(fields[1], fields[3])
+	if err != nil {
+		return
+	}
+	d, err := parse(fields[2], fields[4])
+	if err != nil {
+		return
+	}
+	return s, d, nil
+}
+
+func readProxyV2(r io.Reader) (src, dst net.Addr, err error) {
+	hdr := make([]byte, 4)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return
+	}
+	// ignore the TLVs following the addresses
+	body := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+	switch hdr[0] {
+	case proxyV2Local:
+		return nil, nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, nil, fmt.Errorf("shadowsocks: unsupported proxy protocol v2 version/command %#x", hdr[0])
+	}
+	var iplen int
+	switch hdr[1] {
+	case proxyV2TCP4, proxyV2UDP4:
+		iplen = net.IPv4len
+	case proxyV2TCP6, proxyV2UDP6:
+		iplen = net.IPv6len
+	default:
+		// unspecified or unix addresses
+		return nil, nil, nil
+	}
+	if len(body) < 2*iplen+4 {
+		return nil, nil, errors.New("shadowsocks: proxy protocol v2 address too short")
+	}
+	srcIP := net.IP(body[:iplen])
+	dstIP := net.IP(body[iplen : 2*iplen])
+	srcPort := int(binary.BigEndian.Uint16(body[2*iplen:]))
+	dstPort := int(binary.BigEndian.Uint16(body[2*iplen+2:]))
+	if hdr[1] == proxyV2UDP4 || hdr[1] == proxyV2UDP6 {
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}, nil
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
+
+// WriteProxyHeader writes a PROXY protocol v2 header for a TCP connection
+// from src to dst. If the addresses are not both IPv4 or IPv6, e.g. IPv4
+// clients on an IPv6 listener, IPv6 is used for both.
+func WriteProxyHeader(w io.Writer, src, dst net.Addr) error {
+	srcIP, dstIP := addrIP(src), addrIP(dst)
+	if srcIP == nil || dstIP == nil {
+		return fmt.Errorf("shadowsocks: can't write proxy protocol header for %s -> %s", src, dst)
+	}
+	_, srcPort, _ := net.SplitHostPort(src.String())
+	_, dstPort, _ := net.SplitHostPort(dst.String())
+	sp, _ := strconv.Atoi(srcPort)
+	dp, _ := strconv.Atoi(dstPort)
+
+	buf := make([]byte, 0, 16+36)
+	buf = append(buf, proxyV2Sig...)
+	buf = append(buf, proxyV2Proxy)
+	if src4, dst4 := srcIP.To4(), dstIP.To4(); src4 != nil && dst4 != nil {
+		buf = append(buf, proxyV2TCP4, 0, 12)
+		buf = append(buf, src4...)
+		buf = append(buf, dst4...)
+	} else {
+		buf = append(buf, proxyV2TCP6, 0, 36)
+		buf = append(buf, srcIP.To16()...)
+		buf = append(buf, dstIP.To16()...)
+	}
+	buf = append(buf, byte(sp>>8), byte(sp), byte(dp>>8), byte(dp))
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,151 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		header   string
+		src, dst string
+		ok       bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", "198.51.100.1:443", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", "[2001:db8::2]:443", true},
+		{"PROXY UNKNOWN\r\n", "", "", true},
+		{"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", "", true},
+		{"PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n", "", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\n", "", "", false},
+		{"PROXY TCP4 192.0.2.1\r\n", "", "", false},
+		{"PROXY " + strings.Repeat("x", 120) + "\r\n", "", "", false},
+		{"GET / HTTP/1.1\r\n\r\n", "", "", false},
+	}
+	for _, tt := range tests {
+		r := strings.NewReader(tt.header + "payload")
+		src, dst, err := ReadProxyHeader(r)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: error %v, should be ok %v", tt.header, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if tt.src == "" {
+			if src != nil || dst != nil {
+				t.Errorf("%q: should have no address, got %v %v", tt.header, src, dst)
+			}
+		} else if src.String() != tt.src || dst.String() != tt.dst {
+			t.Errorf("%q: got %v %v", tt.header, src, dst)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "payload" {
+			t.Errorf("%q: should not read past the header, rest %q", tt.header, rest)
+		}
+	}
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	tests := []struct {
+		src, dst string
+	}{
+		{"192.0.2.1:56324", "198.51.100.1:443"},
+		{"[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		// mixed families are sent as IPv6
+		{"192.0.2.1:56324", "[2001:db8::2]:443"},
+	}
+	for _, tt := range tests {
+		src, _ := net.ResolveTCPAddr("tcp", tt.src)
+		dst, _ := net.ResolveTCPAddr("tcp", tt.dst)
+		var buf bytes.Buffer
+		if err := WriteProxyHeader(&buf, src, dst); err != nil {
+			t.Fatal(err)
+		}
+		buf.WriteString("payload")
+		gotSrc, gotDst, err := ReadProxyHeader(&buf)
+		if err != nil {
+			t.Errorf("%s -> %s: %v", tt.src, tt.dst, err)
+			continue
+		}
+		if !addrIP(gotSrc).Equal(src.IP) || gotSrc.(*net.TCPAddr).Port != src.Port ||
+			!addrIP(gotDst).Equal(dst.IP) || gotDst.(*net.TCPAddr).Port != dst.Port {
+			t.Errorf("%s -> %s: got %v -> %v", tt.src, tt.dst, gotSrc, gotDst)
+		}
+		if buf.String() != "payload" {
+			t.Errorf("should not read past the header, rest %q", buf.String())
+		}
+	}
+
+	// LOCAL command with a TLV, used by health checks
+	local := append([]byte{}, proxyV2Sig...)
+	local = append(local, proxyV2Local, 0, 0, 3, 1, 2, 3)
+	src, dst, err := ReadProxyHeader(bytes.NewReader(local))
+	if err != nil || src != nil || dst != nil {
+		t.Errorf("LOCAL command: got %v %v %v", src, dst, err)
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	p, err := NewProxyProtocol(&ProxyProtocolConfig{Trusted: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = p.Listener(ln)
+	defer ln.Close()
+
+	send := func(data string) {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		c.Write([]byte(data))
+		c.Close()
+	}
+
+	go send("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello")
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RemoteAddr().String() != "192.0.2.1:56324" {
+		t.Errorf("RemoteAddr should be the client in the header, got %s", c.RemoteAddr())
+	}
+	if data, _ := ioutil.ReadAll(c); string(data) != "hello" {
+		t.Errorf("got %q after the header", data)
+	}
+	c.Close()
+
+	// trusted sources must send the header
+	go send("hello")
+	c, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 5)); err == nil {
+		t.Error("connection without header from trusted source should fail")
+	}
+	c.Close()
+
+	// untrusted sources are served as is
+	p.Load(&ProxyProtocolConfig{Trusted: []string{"192.0.2.0/24"}})
+	go send("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")
+	c, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host, _, _ := net.SplitHostPort(c.RemoteAddr().String()); host != "127.0.0.1" {
+		t.Errorf("untrusted source should keep its address, got %s", c.RemoteAddr())
+	}
+	if data, _ := ioutil.ReadAll(c); !bytes.HasPrefix(data, []byte("PROXY")) {
+		t.Errorf("header from untrusted source should not be parsed, got %q", data)
+	}
+	c.Close()
+}
@@ -0,0 +1,162 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+)
+
+var errPacketHeader = errors.New("shadowsocks: invalid udp address header")
+
+// packetAddr returns the address header of addr prepended to each datagram:
+// the ip address if host is one, otherwise the domain name.
+func packetAddr(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return RawAddr(addr)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, errors.New("shadowsocks: invalid port " + addr)
+	}
+	var buf []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = append([]byte{typeIPv4}, ip4...)
+	} else {
+		buf = append([]byte{typeIPv6}, ip...)
+	}
+	return append(buf, byte(port>>8), byte(port)), nil
+}
+
+// parsePacketAddr parses the address header at the start of b, returns the
+// address and the header length.
+func parsePacketAddr(b []byte) (addr net.Addr, n int, err error) {
+	if len(b) < 1 {
+		return nil, 0, errPacketHeader
+	}
+	switch b[idType] & AddrMask {
+	case typeIPv4:
+		n = lenIPv4
+	case typeIPv6:
+		n = lenIPv6
+	case typeDm:
+		if len(b) < idDmLen+1 {
+			return nil, 0, errPacketHeader
+		}
+		n = int(b[idDmLen]) + lenDmBase
+	default:
+		return nil, 0, errPacketHeader
+	}
+	if len(b) < n {
+		return nil, 0, errPacketHeader
+	}
+	port := int(binary.BigEndian.Uint16(b[n-2 : n]))
+	if b[idType]&AddrMask == typeDm {
+		host := string(b[idDm0 : idDm0+int(b[idDmLen])])
+		return &ProxyAddr{network: "udp", address: net.JoinHostPort(host, strconv.Itoa(port))}, n, nil
+	}
+	ip := make(net.IP, n-3)
+	copy(ip, b[idIP0:n-2])
+	return &net.UDPAddr{IP: ip, Port: port}, n, nil
+}
+
+// ProxyPacketConn is a net.PacketConn relaying datagrams to any destination
+// through the udp relay of a shadowsocks server. The source address of the
+// datagrams read is an *net.UDPAddr, or a *ProxyAddr if the server replies
+// with the domain name of the request.
+type ProxyPacketConn struct {
+	*SecurePacketConn
+	server *net.UDPAddr
+}
+
+// ReadFrom reads a datagram relayed by the server. Datagrams from other
+// sources or failing to decrypt are dropped, and the payload is truncated to
+// the size of b.
+func (c *ProxyPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, src, err := c.SecurePacketConn.ReadFrom(buf)
+		if _, ok := err.(net.Error); ok {
+			// closed or timed out
+			return 0, nil, err
+		} else if err != nil {
+			continue
+		}
+		if ua, ok := src.(*net.UDPAddr); !ok || !ua.IP.Equal(c.server.IP) || ua.Port != c.server.Port {
+			continue
+		}
+		addr, hlen, err := parsePacketAddr(buf[:n])
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[hlen:n]), addr, nil
+	}
+}
+
+// WriteTo sends b to addr through the server.
+func (c *ProxyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	header, err := packetAddr(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	if _, err = c.SecurePacketConn.WriteTo(append(header, b...), c.server); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ProxyUDPConn is the udp net.Conn returned by Dialer.Dial, sending to a
+// single destination.
+type ProxyUDPConn struct {
+	*ProxyPacketConn
+	raddr *ProxyAddr
+}
+
+func (c *ProxyUDPConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *ProxyUDPConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.raddr)
+}
+
+func (c *ProxyUDPConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// ListenPacket returns a net.PacketConn sending datagrams to any destination
+// through the server.
+func (d *Dialer) ListenPacket() (net.PacketConn, error) {
+	server, err := net.ResolveUDPAddr("udp", d.server)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyPacketConn{
+		SecurePacketConn: NewSecurePacketConn(c, d.cipher.Copy()),
+		server:           server,
+	}, nil
+}
+
+func (d *Dialer) dialUDP(network, addr string) (net.Conn, error) {
+	if _, err := packetAddr(addr); err != nil {
+		return nil, err
+	}
+	c, err := d.ListenPacket()
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyUDPConn{
+		ProxyPacketConn: c.(*ProxyPacketConn),
+		raddr:           &ProxyAddr{network: network, address: addr},
+	}, nil
+}
@@ -0,0 +1,174 @@
+package shadowsocks
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPacketAddr(t *testing.T) {
+	for _, addr := range []string{"192.0.2.1:53", "[2001:db8::1]:443", "example.com:8388"} {
+		header, err := packetAddr(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, n, err := parsePacketAddr(append(header, "payload"...))
+		if err != nil || n != len(header) || got.String() != addr {
+			t.Errorf("%s got %v, %d, %v", addr, got, n, err)
+		}
+	}
+	for _, addr := range []string{"example.com", "192.0.2.1:65536"} {
+		if _, err := packetAddr(addr); err == nil {
+			t.Errorf("%s should be invalid", addr)
+		}
+	}
+	for _, b := range [][]byte{{}, {typeIPv4, 192, 0}, {typeDm, 10, 'a'}, {5, 0, 0}} {
+		if _, _, err := parsePacketAddr(b); err == nil {
+			t.Errorf("%v should be invalid", b)
+		}
+	}
+}
+
+func udpEchoServer(t *testing.T) net.PacketConn {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			c.WriteTo(buf[:n], addr)
+		}
+	}()
+	return c
+}
+
+func TestDialerUDP(t *testing.T) {
+	echo := udpEchoServer(t)
+	defer echo.Close()
+	port := freePort(t)
+	s, err := NewServer(&Config{ServerPort: mustAtoi(port), Password: "foobar", Method: "aes-128-cfb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UDP = true
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cipher, _ := NewCipher("aes-128-cfb", "foobar")
+	d, err := NewDialer("127.0.0.1:"+port, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.Dial("udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err = c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("udp conn got %q, %v", buf[:n], err)
+	}
+
+	pc, err := d.ListenPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(2 * time.Second))
+	_, echoPort, _ := net.SplitHostPort(echo.LocalAddr().String())
+	dst := &ProxyAddr{"udp", net.JoinHostPort("localhost", echoPort)}
+	if _, err = pc.WriteTo([]byte("by name"), dst); err != nil {
+		t.Fatal(err)
+	}
+	n, src, err := pc.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "by name" {
+		t.Fatalf("packet conn got %q, %v", buf[:n], err)
+	}
+	// the server replies with the domain name or the address it resolved to
+	if _, srcPort, _ := net.SplitHostPort(src.String()); srcPort != echoPort {
+		t.Errorf("reply should come from %v, got %v", dst, src)
+	}
+}
+
+func TestUDPBadDatagram(t *testing.T) {
+	echo := udpEchoServer(t)
+	defer echo.Close()
+	port := freePort(t)
+	s, err := NewServer(&Config{ServerPort: mustAtoi(port), Password: "foobar", Method: "chacha20-ietf-poly1305"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UDP = true
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// datagrams too short or failing authentication don't stop the relay
+	raw, err := net.Dial("udp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	raw.Write([]byte("short"))
+	raw.Write(make([]byte, 100))
+	cipher, _ := NewCipher("chacha20-ietf-poly1305", "foobar")
+	d, err := NewDialer("127.0.0.1:"+port, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.Dial("udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err = c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("udp conn after bad datagrams got %q, %v", buf[:n], err)
+	}
+
+	// same for the client, with a server sending garbage first
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	d, err = NewDialer(server.LocalAddr().String(), cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := d.ListenPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(2 * time.Second))
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: pc.LocalAddr().(*net.UDPAddr).Port}
+	server.WriteTo(make([]byte, 100), client)
+	header, _ := packetAddr(echo.LocalAddr().String())
+	if _, err = NewSecurePacketConn(server, cipher.Copy()).WriteTo(append(header, "reply"...), client); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err = pc.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "reply" {
+		t.Errorf("packet conn after a bad datagram got %q, %v", buf[:n], err)
+	}
+}
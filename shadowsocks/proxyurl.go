@@ -0,0 +1,67 @@
+package shadowsocks
+
+import (
+	"context"
+	"net"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+var (
+	_ proxy.Dialer        = (*Dialer)(nil)
+	_ proxy.ContextDialer = (*Dialer)(nil)
+)
+
+func init() {
+	proxy.RegisterDialerType("ss", dialerFromURL)
+}
+
+// dialerFromURL creates a Dialer for proxy.FromURL, see parseSSURL for the
+// url format. The Dialer connects to the server with forward, unless it's
+// proxy.Direct.
+func dialerFromURL(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	d, err := parseSSURL(u)
+	if err != nil {
+		return nil, &url.Error{Op: "proxy", URL: u.Redacted(), Err: err}
+	}
+	switch f := forward.(type) {
+	case nil:
+	case ContextDialer:
+		if forward != proxy.Direct {
+			d.Forward = f
+		}
+	default:
+		d.Forward = forwardDialer{forward}
+	}
+	return d, nil
+}
+
+// forwardDialer adds DialContext to a proxy.Dialer. The dial keeps going in
+// background when ctx is done, the connection is closed once it's made.
+type forwardDialer struct {
+	proxy.Dialer
+}
+
+func (f forwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := f.Dial(network, addr)
+		done <- result{c, err}
+	}()
+	select {
+	case r := <-done:
+		return r.c, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.c != nil {
+				r.c.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,81 @@
+package shadowsocks
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+func TestDialerFromURL(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	socks := socks5Server(t, "user", "socks pass")
+	defer socks.Close()
+	ss := ssServer(t, "aes-128-cfb", "ss pass")
+	defer ss.Close()
+
+	viaSocks, err := proxy.SOCKS5("tcp", socks.Addr().String(), &proxy.Auth{User: "user", Password: "socks pass"}, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("ss://aes-128-cfb:ss%20pass@" + ss.Addr().String())
+	for _, forward := range []proxy.Dialer{proxy.Direct, viaSocks} {
+		d, err := proxy.FromURL(u, forward)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := d.(proxy.ContextDialer).DialContext(context.Background(), "tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := []byte("hello")
+		c.Write(msg)
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != string(msg) {
+			t.Errorf("echo got %q, %v", buf, err)
+		}
+		c.Close()
+	}
+
+	for _, s := range []string{"ss://aes-128-cfb@127.0.0.1:8388", "ss://aes-128-cfb:pass@127.0.0.1", "ss://nosuch:pass@127.0.0.1:8388"} {
+		u, _ := url.Parse(s)
+		if _, err := proxy.FromURL(u, proxy.Direct); err == nil {
+			t.Errorf("%s should be invalid", s)
+		}
+	}
+}
+
+// hangingDialer never connects.
+type hangingDialer struct{}
+
+func (hangingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (hangingDialer) Dial(network, addr string) (net.Conn, error) {
+	select {}
+}
+
+func TestDialerContext(t *testing.T) {
+	cipher, _ := NewCipher("aes-128-cfb", "foobar")
+	d, _ := NewDialer("192.0.2.1:8388", cipher)
+	for _, forward := range []ContextDialer{hangingDialer{}, forwardDialer{hangingDialer{}}} {
+		d.Forward = forward
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		start := time.Now()
+		_, err := d.DialContext(ctx, "tcp", "example.com:80")
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Errorf("%T: dial should be canceled, got %v", forward, err)
+		}
+		if time.Since(start) > time.Second {
+			t.Errorf("%T: cancel took %v", forward, time.Since(start))
+		}
+	}
+}
@@ -0,0 +1,554 @@
+package shadowsocks
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ResolverConfig is the "dns" section of the server config.
+type ResolverConfig struct {
+	// Nameservers are tried in order, in the form
+	// [udp://|tcp://|tls://]host[:port][#tls server name]. The system
+	// resolver is used if empty.
+	Nameservers []string            `json:"nameservers"`
+	Timeout     int                 `json:"timeout"`      // seconds per query, default 5
+	CacheSize   int                 `json:"cache_size"`   // default 1024, negative to disable
+	MaxTTL      int                 `json:"max_ttl"`      // seconds, default 3600
+	NegativeTTL int                 `json:"negative_ttl"` // seconds, default 10
+	PreferIPv6  bool                `json:"prefer_ipv6"`
+	IPv4Only    bool                `json:"ipv4_only"`
+	Hosts       map[string][]string `json:"hosts"` // static name to addresses
+}
+
+const (
+	defaultDNSTimeout  = 5 * time.Second
+	defaultCacheSize   = 1024
+	defaultMaxTTL      = time.Hour
+	defaultNegativeTTL = 10 * time.Second
+	systemResolverTTL  = time.Minute // the system resolver doesn't tell the ttl
+)
+
+type nameserver struct {
+	network    string // udp, tcp or tls
+	addr       string
+	serverName string // for tls
+}
+
+func parseNameserver(s string) (ns nameserver, err error) {
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return ns, fmt.Errorf("shadowsocks: invalid nameserver %s: %v", s, err)
+	}
+	ns.network = u.Scheme
+	port := "53"
+	switch u.Scheme {
+	case "udp", "tcp":
+	case "tls":
+		port = "853"
+		ns.serverName = u.Fragment
+		if ns.serverName == "" {
+			ns.serverName = u.Hostname()
+		}
+	default:
+		return ns, fmt.Errorf("shadowsocks: nameserver %s: unsupported protocol %s", s, u.Scheme)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	if u.Hostname() == "" {
+		return ns, fmt.Errorf("shadowsocks: nameserver %s: missing address", s)
+	}
+	ns.addr = net.JoinHostPort(u.Hostname(), port)
+	return ns, nil
+}
+
+type resolverConf struct {
+	nameservers []nameserver
+	timeout     time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	preferIPv6  bool
+	ipv4Only    bool
+	hosts       map[string][]net.IP
+}
+
+type cacheEntry struct {
+	name   string
+	ips    []net.IP
+	err    error
+	expire time.Time
+}
+
+// dnsCache is a lru cache of lookup results.
+type dnsCache struct {
+	sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List // front is the most recently used
+}
+
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{size: size, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (c *dnsCache) get(name string) (*cacheEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[name]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expire) {
+		c.lru.Remove(e)
+		delete(c.entries, name)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return entry, true
+}
+
+func (c *dnsCache) put(entry *cacheEntry) {
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[entry.name]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	for c.lru.Len() >= c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*cacheEntry).name)
+	}
+	c.entries[entry.name] = c.lru.PushFront(entry)
+}
+
+func (c *dnsCache) len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.lru.Len()
+}
+
+// Resolver looks up domain names for outbound connections. A nil *Resolver
+// and the zero value use the system resolver without caching. It's safe for
+// concurrent use and can be reloaded while in use.
+type Resolver struct {
+	sync.RWMutex
+	conf  *resolverConf
+	cache *dnsCache // nil if caching is disabled
+}
+
+// NewResolver creates a Resolver from config, a nil config uses the system
+// resolver without caching.
+func NewResolver(config *ResolverConfig) (*Resolver, error) {
+	r := &Resolver{}
+	if err := r.Load(config); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Load replaces the settings of the resolver and clears its cache. The old
+// settings are kept on error.
+func (r *Resolver) Load(config *ResolverConfig) error {
+	var conf *resolverConf
+	var cache *dnsCache
+	if config != nil {
+		conf = &resolverConf{
+			timeout:     defaultDNSTimeout,
+			maxTTL:      defaultMaxTTL,
+			negativeTTL: defaultNegativeTTL,
+			preferIPv6:  config.PreferIPv6,
+			ipv4Only:    config.IPv4Only,
+			hosts:       map[string][]net.IP{},
+		}
+		if config.PreferIPv6 && config.IPv4Only {
+			return errors.New("shadowsocks: dns: prefer_ipv6 and ipv4_only are exclusive")
+		}
+		for _, s := range config.Nameservers {
+			ns, err := parseNameserver(s)
+			if err != nil {
+				return err
+			}
+			conf.nameservers = append(conf.nameservers, ns)
+		}
+		for name, addrs := range config.Hosts {
+			for _, addr := range addrs {
+				ip := net.ParseIP(addr)
+				if ip == nil {
+					return fmt.Errorf("shadowsocks: dns: invalid address %s for host %s", addr, name)
+				}
+				conf.hosts[normalizeName(name)] = append(conf.hosts[normalizeName(name)], ip)
+			}
+		}
+		if config.Timeout > 0 {
+			conf.timeout = time.Duration(config.Timeout) * time.Second
+		}
+		if config.MaxTTL > 0 {
+			conf.maxTTL = time.Duration(config.MaxTTL) * time.Second
+		}
+		if config.NegativeTTL > 0 {
+			conf.negativeTTL = time.Duration(config.NegativeTTL) * time.Second
+		}
+		switch {
+		case config.CacheSize == 0:
+			cache = newDNSCache(defaultCacheSize)
+		case config.CacheSize > 0:
+			cache = newDNSCache(config.CacheSize)
+		}
+	}
+	r.Lock()
+	r.conf, r.cache = conf, cache
+	r.Unlock()
+	return nil
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// LookupIP returns the addresses of host, in the preferred order: IPv4 first
+// unless prefer_ipv6 is set, no IPv6 addresses if ipv4_only is set.
+func (r *Resolver) LookupIP(host string) ([]net.IP, error) {
+	return r.LookupIPContext(context.Background(), host)
+}
+
+// LookupIPContext is LookupIP giving up when ctx is done, the queries to the
+// nameservers end by the deadline of ctx.
+func (r *Resolver) LookupIPContext(ctx context.Context, host string) ([]net.IP, error) {
+	var conf *resolverConf
+	var cache *dnsCache
+	if r != nil {
+		r.RLock()
+		conf, cache = r.conf, r.cache
+		r.RUnlock()
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if conf == nil {
+		ips, err := systemLookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		return sortIPs(ips, false, false), nil
+	}
+
+	name := normalizeName(host)
+	if ips, ok := conf.hosts[name]; ok {
+		return sortIPs(ips, conf.preferIPv6, conf.ipv4Only), nil
+	}
+	if cache != nil {
+		if entry, ok := cache.get(name); ok {
+			mainLog.Debug("dns cache hit", F("host", name))
+			return entry.ips, entry.err
+		}
+	}
+	ips, ttl, err := conf.lookup(ctx, name)
+	if err != nil {
+		if !isNotFound(err) {
+			// don't cache temporary failures
+			return nil, err
+		}
+		ttl = conf.negativeTTL
+	} else {
+		ips = sortIPs(ips, conf.preferIPv6, conf.ipv4Only)
+		if ttl > conf.maxTTL {
+			ttl = conf.maxTTL
+		}
+	}
+	if cache != nil && ttl > 0 {
+		cache.put(&cacheEntry{name: name, ips: ips, err: err, expire: time.Now().Add(ttl)})
+	}
+	return ips, err
+}
+
+// sortIPs orders ips by address family, keeping the order within a family.
+func sortIPs(ips []net.IP, preferIPv6, ipv4Only bool) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else if !ipv4Only {
+			v6 = append(v6, ip)
+		}
+	}
+	if preferIPv6 {
+		return append(v6, v4...)
+	}
+	return append(v4, v6...)
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// systemLookup resolves host with the system resolver.
+func systemLookup(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// lookup queries the nameservers in turn until one answers or ctx is done.
+func (conf *resolverConf) lookup(ctx context.Context, name string) (ips []net.IP, ttl time.Duration, err error) {
+	if len(conf.nameservers) == 0 {
+		ips, err = systemLookup(ctx, name)
+		if err != nil {
+			return
+		}
+		if conf.ipv4Only {
+			if ips = sortIPs(ips, false, true); len(ips) == 0 {
+				return nil, 0, notFound(name)
+			}
+		}
+		return ips, systemResolverTTL, nil
+	}
+
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	if conf.ipv4Only {
+		types = types[:1]
+	}
+	for _, ns := range conf.nameservers {
+		ips, ttl, err = conf.query(ctx, ns, name, types)
+		if err == nil || isNotFound(err) {
+			return
+		}
+		if ctx.Err() != nil {
+			return nil, 0, err
+		}
+		mainLog.Debug("dns query error", F("host", name), F("nameserver", ns.network+"://"+ns.addr), Err(err))
+	}
+	return
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+// query sends a question for each type in parallel to ns and merges the
+// answers. The name is not found only if no type has an answer.
+func (conf *resolverConf) query(ctx context.Context, ns nameserver, name string, types []dnsmessage.Type) (ips []net.IP, ttl time.Duration, err error) {
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	results := make(chan result, len(types))
+	for _, t := range types {
+		go func(t dnsmessage.Type) {
+			var res result
+			res.ips, res.ttl, res.err = conf.exchange(ctx, ns, name, t)
+			results <- res
+		}(t)
+	}
+	nerr := 0
+	for range types {
+		res := <-results
+		if res.err != nil {
+			if !isNotFound(res.err) {
+				err = res.err
+			}
+			nerr++
+			continue
+		}
+		if len(ips) == 0 || res.ttl < ttl {
+			ttl = res.ttl
+		}
+		ips = append(ips, res.ips...)
+	}
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+	if err == nil {
+		err = notFound(name)
+	}
+	return nil, 0, err
+}
+
+// maxCNAMEChain limits the cname records followed from the queried name.
+const maxCNAMEChain = 8
+
+// exchange sends a single question to ns and returns the addresses in the
+// answer, following the cname chain given in the same answer. Records of
+// other names are ignored, so a response can't put addresses of any name in
+// the cache.
+func (conf *resolverConf) exchange(ctx context.Context, ns nameserver, name string, t dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, 0, notFound(name)
+	}
+	// unpredictable, a spoofed udp response has to guess it
+	var idBuf [2]byte
+	if _, err = rand.Read(idBuf[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBuf[:])
+	req := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: qname, Type: t, Class: dnsmessage.ClassINET},
+		},
+	}
+	b, err := req.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := conf.roundTrip(ctx, ns.network, ns, b, id)
+	if err == nil && resp.Truncated && ns.network == "udp" {
+		// retry over tcp for the full answer
+		resp, err = conf.roundTrip(ctx, "tcp", ns, b, id)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if q := resp.Questions; len(q) != 1 || normalizeName(q[0].Name.String()) != name ||
+		q[0].Type != t || q[0].Class != dnsmessage.ClassINET {
+		return nil, 0, &net.DNSError{Err: "response to another question", Name: name, Server: ns.addr, IsTemporary: true}
+	}
+
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, notFound(name)
+	default:
+		return nil, 0, &net.DNSError{Err: "server failure: " + resp.RCode.String(), Name: name, Server: ns.addr, IsTemporary: true}
+	}
+
+	// the addresses may be given for name or the aliases it leads to
+	owners := map[string]bool{name: true}
+	for owner := name; len(owners) <= maxCNAMEChain; {
+		next := ""
+		for _, ans := range resp.Answers {
+			if body, ok := ans.Body.(*dnsmessage.CNAMEResource); ok && normalizeName(ans.Header.Name.String()) == owner {
+				next = normalizeName(body.CNAME.String())
+				break
+			}
+		}
+		if next == "" || owners[next] {
+			break
+		}
+		owners[next], owner = true, next
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+	for _, ans := range resp.Answers {
+		if ans.Header.Type != t || ans.Header.Class != dnsmessage.ClassINET || !owners[normalizeName(ans.Header.Name.String())] {
+			continue
+		}
+		var ip net.IP
+		switch body := ans.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		default:
+			continue
+		}
+		rrTTL := time.Duration(ans.Header.TTL) * time.Second
+		if len(ips) == 0 || rrTTL < ttl {
+			ttl = rrTTL
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		return nil, 0, notFound(name)
+	}
+	return ips, ttl, nil
+}
+
+// roundTrip sends req to ns and reads the response, within the query timeout
+// or by the deadline of ctx if earlier.
+func (conf *resolverConf) roundTrip(ctx context.Context, network string, ns nameserver, req []byte, id uint16) (*dnsmessage.Message, error) {
+	deadline := time.Now().Add(conf.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	dialNetwork := network
+	if network == "tls" {
+		dialNetwork = "tcp"
+	}
+	dialer := &net.Dialer{Deadline: deadline}
+	c, err := dialer.DialContext(ctx, dialNetwork, ns.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(deadline)
+	if network == "tls" {
+		tc := tls.Client(c, &tls.Config{ServerName: ns.serverName})
+		if err = tc.Handshake(); err != nil {
+			return nil, err
+		}
+		c = tc
+	}
+
+	var buf []byte
+	if network == "udp" {
+		if _, err = c.Write(req); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, 1232) // safe size for udp without edns
+		for {
+			n, err := c.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			// ignore stray responses
+			if n >= 2 && binary.BigEndian.Uint16(buf) == id {
+				buf = buf[:n]
+				break
+			}
+		}
+	} else {
+		msg := make([]byte, 2+len(req))
+		binary.BigEndian.PutUint16(msg, uint16(len(req)))
+		copy(msg[2:], req)
+		if _, err = c.Write(msg); err != nil {
+			return nil, err
+		}
+		var lenBuf [2]byte
+		if _, err = io.ReadFull(c, lenBuf[:]); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+		if _, err = io.ReadFull(c, buf); err != nil {
+			return nil, err
+		}
+	}
+
+	var resp dnsmessage.Message
+	if err = resp.Unpack(buf); err != nil {
+		return nil, err
+	}
+	if resp.ID != id || !resp.Response {
+		return nil, errors.New("shadowsocks: dns: mismatched response")
+	}
+	return &resp, nil
+}
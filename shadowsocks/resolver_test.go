@@ -0,0 +1,381 @@
+package shadowsocks
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS is an in-process nameserver answering over udp and tcp from a
+// fixed zone, counting the queries it gets.
+type fakeDNS struct {
+	sync.Mutex
+	zone     map[string][]net.IP // name with trailing dot
+	ttl      uint32
+	truncate bool // answer udp queries with the truncated bit
+	queries  int
+	udp      net.PacketConn
+	tcp      net.Listener
+
+	rewrite func(msg *dnsmessage.Message) // changes the responses if set
+}
+
+func newFakeDNS(t *testing.T, zone map[string][]string) *fakeDNS {
+	s := &fakeDNS{zone: map[string][]net.IP{}, ttl: 300}
+	for name, addrs := range zone {
+		for _, addr := range addrs {
+			s.zone[name+"."] = append(s.zone[name+"."], net.ParseIP(addr))
+		}
+	}
+	// tcp on the same port as udp, retry if the port is taken for tcp
+	var err error
+	for i := 0; i < 10; i++ {
+		if s.udp, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if s.tcp, err = net.Listen("tcp", s.udp.LocalAddr().String()); err == nil {
+			break
+		}
+		s.udp.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+func (s *fakeDNS) addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+func (s *fakeDNS) Close() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+func (s *fakeDNS) count() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.queries
+}
+
+func (s *fakeDNS) answer(req []byte, truncate bool) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(req); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	s.Lock()
+	s.queries++
+	rewrite := s.rewrite
+	s.Unlock()
+	q := msg.Questions[0]
+	msg.Response = true
+	msg.Truncated = truncate
+	ips, ok := s.zone[q.Name.String()]
+	if !ok {
+		msg.RCode = dnsmessage.RCodeNameError
+	}
+	if !truncate {
+		for _, ip := range ips {
+			h := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: s.ttl}
+			if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+				var a dnsmessage.AResource
+				copy(a.A[:], ip4)
+				msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: h, Body: &a})
+			} else if ip.To4() == nil && q.Type == dnsmessage.TypeAAAA {
+				var a dnsmessage.AAAAResource
+				copy(a.AAAA[:], ip)
+				msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: h, Body: &a})
+			}
+		}
+	}
+	if rewrite != nil {
+		rewrite(&msg)
+	}
+	b, _ := msg.Pack()
+	return b
+}
+
+func (s *fakeDNS) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.Lock()
+		truncate := s.truncate
+		s.Unlock()
+		if resp := s.answer(buf[:n], truncate); resp != nil {
+			s.udp.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *fakeDNS) serveTCP() {
+	for {
+		c, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			var l [2]byte
+			if _, err := io.ReadFull(c, l[:]); err != nil {
+				return
+			}
+			req := make([]byte, binary.BigEndian.Uint16(l[:]))
+			if _, err := io.ReadFull(c, req); err != nil {
+				return
+			}
+			resp := s.answer(req, false)
+			binary.BigEndian.PutUint16(l[:], uint16(len(resp)))
+			c.Write(append(l[:], resp...))
+		}(c)
+	}
+}
+
+func ipStrings(ips []net.IP) string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return strings.Join(s, ",")
+}
+
+var testZone = map[string][]string{
+	"dual.example.com": {"2001:db8::1", "192.0.2.1"},
+	"v6.example.com":   {"2001:db8::2"},
+}
+
+func TestResolverLookup(t *testing.T) {
+	dns := newFakeDNS(t, testZone)
+	defer dns.Close()
+
+	tests := []struct {
+		config ResolverConfig
+		host   string
+		ips    string
+	}{
+		{ResolverConfig{}, "dual.example.com", "192.0.2.1,2001:db8::1"},
+		{ResolverConfig{PreferIPv6: true}, "dual.example.com", "2001:db8::1,192.0.2.1"},
+		{ResolverConfig{IPv4Only: true}, "dual.example.com", "192.0.2.1"},
+		{ResolverConfig{}, "DUAL.example.com.", "192.0.2.1,2001:db8::1"},
+		{ResolverConfig{}, "v6.example.com", "2001:db8::2"},
+		{ResolverConfig{IPv4Only: true}, "v6.example.com", ""},
+		{ResolverConfig{}, "none.example.com", ""},
+		{ResolverConfig{Hosts: map[string][]string{"dual.example.com": {"192.0.2.9"}}}, "dual.example.com", "192.0.2.9"},
+		{ResolverConfig{}, "192.0.2.5", "192.0.2.5"},
+	}
+	for _, tt := range tests {
+		for _, network := range []string{"udp", "tcp"} {
+			config := tt.config
+			config.Nameservers = []string{network + "://" + dns.addr()}
+			r, err := NewResolver(&config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ips, err := r.LookupIP(tt.host)
+			if tt.ips == "" {
+				if !isNotFound(err) {
+					t.Errorf("%s %s: should be not found, got %v %v", network, tt.host, ips, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s %s: %v", network, tt.host, err)
+			} else if ipStrings(ips) != tt.ips {
+				t.Errorf("%s %s: got %s, should be %s", network, tt.host, ipStrings(ips), tt.ips)
+			}
+		}
+	}
+}
+
+func TestResolverCache(t *testing.T) {
+	dns := newFakeDNS(t, testZone)
+	defer dns.Close()
+
+	r, err := NewResolver(&ResolverConfig{
+		Nameservers: []string{dns.addr()},
+		CacheSize:   1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.LookupIP("dual.example.com")
+	r.LookupIP("dual.example.com")
+	if n := dns.count(); n != 2 {
+		t.Errorf("cached lookup should not query, got %d queries for A and AAAA", n)
+	}
+	// negative answers are cached too
+	r.LookupIP("none.example.com")
+	r.LookupIP("none.example.com")
+	if n := dns.count(); n != 4 {
+		t.Errorf("negative answer should be cached, got %d queries", n)
+	}
+	// cache size is 1, so dual.example.com is evicted
+	if n := r.cache.len(); n != 1 {
+		t.Errorf("cache should be bounded to 1 entry, got %d", n)
+	}
+	r.LookupIP("dual.example.com")
+	if n := dns.count(); n != 6 {
+		t.Errorf("evicted entry should be queried again, got %d queries", n)
+	}
+
+	// expired entries are queried again
+	entry, _ := r.cache.get("dual.example.com")
+	entry.expire = time.Now().Add(-time.Second)
+	r.LookupIP("dual.example.com")
+	if n := dns.count(); n != 8 {
+		t.Errorf("expired entry should be queried again, got %d queries", n)
+	}
+
+	// reloading clears the cache
+	r.Load(&ResolverConfig{Nameservers: []string{dns.addr()}})
+	r.LookupIP("dual.example.com")
+	if n := dns.count(); n != 10 {
+		t.Errorf("reload should clear cache, got %d queries", n)
+	}
+}
+
+func TestResolverTruncated(t *testing.T) {
+	dns := newFakeDNS(t, testZone)
+	defer dns.Close()
+	dns.Lock()
+	dns.truncate = true
+	dns.Unlock()
+
+	r, _ := NewResolver(&ResolverConfig{Nameservers: []string{dns.addr()}, IPv4Only: true})
+	ips, err := r.LookupIP("dual.example.com")
+	if err != nil || ipStrings(ips) != "192.0.2.1" {
+		t.Errorf("truncated answer should be retried over tcp, got %v %v", ips, err)
+	}
+}
+
+func TestResolverFallback(t *testing.T) {
+	dns := newFakeDNS(t, testZone)
+	defer dns.Close()
+
+	// nothing listens on the first nameserver
+	c, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	dead := c.LocalAddr().String()
+	c.Close()
+
+	r, _ := NewResolver(&ResolverConfig{Nameservers: []string{dead, dns.addr()}, Timeout: 1})
+	ips, err := r.LookupIP("v6.example.com")
+	if err != nil || ipStrings(ips) != "2001:db8::2" {
+		t.Errorf("should fall back to the second nameserver, got %v %v", ips, err)
+	}
+}
+
+func TestResolverSpoofedAnswer(t *testing.T) {
+	dns := newFakeDNS(t, testZone)
+	defer dns.Close()
+	r, _ := NewResolver(&ResolverConfig{Nameservers: []string{dns.addr()}, IPv4Only: true})
+	resource := func(name string, body dnsmessage.ResourceBody) dnsmessage.Resource {
+		h := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: 300}
+		return dnsmessage.Resource{Header: h, Body: body}
+	}
+	a := func(name string, ip byte) dnsmessage.Resource {
+		res := resource(name, &dnsmessage.AResource{A: [4]byte{192, 0, 2, ip}})
+		res.Header.Type = dnsmessage.TypeA
+		return res
+	}
+	cname := func(name, target string) dnsmessage.Resource {
+		res := resource(name, &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)})
+		res.Header.Type = dnsmessage.TypeCNAME
+		return res
+	}
+
+	// only the records of the name and its aliases are taken
+	dns.Lock()
+	dns.rewrite = func(msg *dnsmessage.Message) {
+		msg.RCode = dnsmessage.RCodeSuccess
+		msg.Answers = []dnsmessage.Resource{
+			a("other.example.com.", 66),
+			cname("www.example.com.", "cdn.example.net."),
+			a("CDN.example.net.", 7),
+			cname("cdn.example.net.", "www.example.com."),
+		}
+	}
+	dns.Unlock()
+	ips, err := r.LookupIP("www.example.com")
+	if err != nil || ipStrings(ips) != "192.0.2.7" {
+		t.Errorf("should only take the address of the cname, got %v %v", ips, err)
+	}
+	if ips, err = r.LookupIP("unrelated.example.com"); !isNotFound(err) {
+		t.Errorf("records of other names should be ignored, got %v %v", ips, err)
+	}
+
+	// a response to another question is an error, not cached
+	dns.Lock()
+	dns.rewrite = func(msg *dnsmessage.Message) {
+		msg.RCode = dnsmessage.RCodeSuccess
+		msg.Questions[0].Name = dnsmessage.MustNewName("other.example.com.")
+		msg.Answers = []dnsmessage.Resource{a("other.example.com.", 66)}
+	}
+	dns.Unlock()
+	if ips, err = r.LookupIP("dual.example.com"); err == nil || isNotFound(err) {
+		t.Errorf("response to another question should fail, got %v %v", ips, err)
+	}
+	dns.Lock()
+	dns.rewrite = nil
+	dns.Unlock()
+	if ips, err = r.LookupIP("dual.example.com"); err != nil || ipStrings(ips) != "192.0.2.1" {
+		t.Errorf("failure should not be cached, got %v %v", ips, err)
+	}
+}
+
+func TestResolverContext(t *testing.T) {
+	// the nameserver never answers, the query times out after 5s
+	ns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	r, _ := NewResolver(&ResolverConfig{Nameservers: []string{ns.LocalAddr().String(), ns.LocalAddr().String()}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if ips, err := r.LookupIPContext(ctx, "dual.example.com"); err == nil {
+		t.Fatalf("lookup should time out, got %v", ips)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("lookup returned after %v, should stop by the deadline of ctx", elapsed)
+	}
+}
+
+func TestParseNameserver(t *testing.T) {
+	tests := []struct {
+		s, network, addr, serverName string
+	}{
+		{"8.8.8.8", "udp", "8.8.8.8:53", ""},
+		{"tcp://8.8.8.8:5353", "tcp", "8.8.8.8:5353", ""},
+		{"[2001:4860:4860::8888]:53", "udp", "[2001:4860:4860::8888]:53", ""},
+		{"tls://1.1.1.1", "tls", "1.1.1.1:853", "1.1.1.1"},
+		{"tls://1.1.1.1#cloudflare-dns.com", "tls", "1.1.1.1:853", "cloudflare-dns.com"},
+	}
+	for _, tt := range tests {
+		ns, err := parseNameserver(tt.s)
+		if err != nil {
+			t.Errorf("%s: %v", tt.s, err)
+			continue
+		}
+		if ns.network != tt.network || ns.addr != tt.addr || ns.serverName != tt.serverName {
+			t.Errorf("%s: got %+v", tt.s, ns)
+		}
+	}
+	if _, err := parseNameserver("https://dns.google"); err == nil {
+		t.Error("unsupported protocol should fail")
+	}
+}
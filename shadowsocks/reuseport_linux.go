@@ -0,0 +1,4 @@
+package shadowsocks
+
+// soReusePort is SO_REUSEPORT, missing from syscall on linux.
+const soReusePort = 0xf
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package shadowsocks
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reusePort() (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, errors.New("shadowsocks: listen: reuse_port is not supported on this system")
+}
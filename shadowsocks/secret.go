@@ -0,0 +1,109 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Passwords and keys of the config can be references to secrets kept out of
+// it: env:VAR is the environment variable, file:/path the content of the
+// file and exec:command the output of the command, its arguments separated
+// by spaces. Trailing newlines are trimmed. The resolved values are secrets
+// like the passwords, so they're never logged, nor are they in the errors.
+
+const secretExecTimeout = 10 * time.Second
+
+// ResolveSecret returns the value s refers to, or s itself if it's not a
+// reference.
+func ResolveSecret(s string) (string, error) {
+	var v string
+	switch {
+	case strings.HasPrefix(s, "env:"):
+		name := s[len("env:"):]
+		var ok bool
+		if v, ok = os.LookupEnv(name); !ok {
+			return "", fmt.Errorf("environment variable %s not set", name)
+		}
+	case strings.HasPrefix(s, "file:"):
+		data, err := ioutil.ReadFile(s[len("file:"):])
+		if err != nil {
+			return "", err
+		}
+		v = string(data)
+	case strings.HasPrefix(s, "exec:"):
+		args := strings.Fields(s[len("exec:"):])
+		if len(args) == 0 {
+			return "", errors.New("no command to exec")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), secretExecTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("command %s: %v", args[0], err)
+		}
+		v = string(out)
+	default:
+		return s, nil
+	}
+	v = strings.TrimRight(v, "\r\n")
+	if v == "" {
+		return "", errors.New("empty secret")
+	}
+	return v, nil
+}
+
+// ResolveSecrets replaces the references of the passwords and keys of
+// config with the secrets. ParseConfig does it for the config files, call it
+// for configs built otherwise, e.g. from the command line.
+func (config *Config) ResolveSecrets() error {
+	resolve := func(s *string, where string) error {
+		v, err := ResolveSecret(*s)
+		if err != nil {
+			return fmt.Errorf("shadowsocks: %s: %v", where, err)
+		}
+		*s = v
+		return nil
+	}
+	if err := resolve(&config.Password, "password"); err != nil {
+		return err
+	}
+	if err := resolve(&config.Key, "key"); err != nil {
+		return err
+	}
+	for port, password := range config.PortPassword {
+		if err := resolve(&password, "port_password "+port); err != nil {
+			return err
+		}
+		config.PortPassword[port] = password
+	}
+	for port, user := range config.PortUsers {
+		if err := resolve(&user.Password, "port_password "+port); err != nil {
+			return err
+		}
+		if err := resolve(&user.Key, "port_password "+port+" key"); err != nil {
+			return err
+		}
+	}
+	for i, entry := range config.ServerPassword {
+		where := fmt.Sprintf("server_password %d", i)
+		if len(entry) > 1 {
+			if err := resolve(&entry[1], where); err != nil {
+				return err
+			}
+		}
+		if len(entry) > 3 {
+			if err := resolve(&entry[3], where+" key"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package shadowsocks
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	os.Setenv("SS_TEST_SECRET", "from env")
+	defer os.Unsetenv("SS_TEST_SECRET")
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "secret")
+	ioutil.WriteFile(file, []byte("from file\n"), 0600)
+	empty := filepath.Join(dir, "empty")
+	ioutil.WriteFile(empty, []byte("\n"), 0600)
+
+	tests := []struct {
+		ref, want string
+	}{
+		{"plain password", "plain password"},
+		{"", ""},
+		{"env:SS_TEST_SECRET", "from env"},
+		{"file:" + file, "from file"},
+	}
+	if runtime.GOOS != "windows" {
+		tests = append(tests, struct{ ref, want string }{"exec:echo from exec", "from exec"})
+	}
+	for _, tt := range tests {
+		if got, err := ResolveSecret(tt.ref); err != nil || got != tt.want {
+			t.Errorf("%s got %q, %v", tt.ref, got, err)
+		}
+	}
+	for _, ref := range []string{"env:SS_TEST_NO_SUCH", "file:" + filepath.Join(dir, "nosuch"), "file:" + empty, "exec:"} {
+		if _, err := ResolveSecret(ref); err == nil {
+			t.Errorf("%s should fail", ref)
+		}
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	os.Setenv("SS_TEST_SECRET", "from env")
+	defer os.Unsetenv("SS_TEST_SECRET")
+	config := &Config{
+		Password:       "env:SS_TEST_SECRET",
+		PortPassword:   map[string]string{"8387": "env:SS_TEST_SECRET", "8388": "foobar"},
+		PortUsers:      map[string]*PortUser{"8389": {Key: "env:SS_TEST_SECRET"}},
+		ServerPassword: [][]string{{"127.0.0.1:8387", "env:SS_TEST_SECRET"}, {"127.0.0.1:8388", "", "", "env:SS_TEST_SECRET"}},
+	}
+	if err := config.ResolveSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if config.Password != "from env" || config.PortPassword["8387"] != "from env" || config.PortPassword["8388"] != "foobar" ||
+		config.PortUsers["8389"].Key != "from env" || config.ServerPassword[0][1] != "from env" || config.ServerPassword[1][3] != "from env" {
+		t.Errorf("secrets not resolved: %+v", config)
+	}
+
+	config = &Config{PortPassword: map[string]string{"8387": "env:SS_TEST_NO_SUCH"}}
+	err := config.ResolveSecrets()
+	if err == nil || !strings.Contains(err.Error(), "8387") {
+		t.Errorf("error should tell the port, got %v", err)
+	}
+}
+
+func TestObfsServerReloadSecret(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	obfsPort := freePort(t)
+	file := filepath.Join(dir, "config.json")
+	data := `{"port_password": {"1001": "env:SS_TEST_OBFS_SECRET"}, "method": "aes-128-cfb", "obfs_port": ` + obfsPort + `}`
+	if err = ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SS_TEST_OBFS_SECRET", "foobar")
+	defer os.Unsetenv("SS_TEST_OBFS_SECRET")
+	loader := &ConfigLoader{File: file}
+	config, err := loader.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewObfsServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr := "127.0.0.1:" + obfsPort
+	if got, err := obfsEcho(addr, "foobar", "aes-128-cfb", echo.Addr().String(), "hello"); err != nil || got != "hello" {
+		t.Fatalf("echo got %q, %v", got, err)
+	}
+
+	// the reference is resolved again on reload
+	os.Setenv("SS_TEST_OBFS_SECRET", "barfoo")
+	if config, err = loader.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := obfsEcho(addr, "barfoo", "aes-128-cfb", echo.Addr().String(), "hello"); err != nil || got != "hello" {
+		t.Errorf("echo with the new password got %q, %v", got, err)
+	}
+	if _, err := obfsEcho(addr, "foobar", "aes-128-cfb", echo.Addr().String(), "hello"); err == nil {
+		t.Error("old password should fail after reload")
+	}
+}
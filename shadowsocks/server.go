@@ -0,0 +1,1005 @@
+package shadowsocks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const defaultDrainTimeout = 30 * time.Second
+
+// ServerStats is a snapshot of the counters of a Server.
+type ServerStats struct {
+	Traffic map[string]int64 // bytes relayed by port
+	Denied  map[string]int64 // connections and udp requests denied by the acl, by port
+	Conns   int              // tcp connections in progress
+}
+
+// Server serves the ports of a Config like the shadowsocks-server command,
+// so it can be embedded in other programs. The acl, dns, outbound, proxy
+// chains, proxy protocol, limits and access log of the config apply to all
+// the ports, and are replaced by Reload.
+type Server struct {
+	// UDP enables the udp relay on each port, set it before Start. It's
+	// the udp option of the config initially.
+	UDP bool
+
+	acl        *ACL
+	resolver   *Resolver
+	outbound   *OutboundDialer
+	proxyProto *ProxyProtocol
+	limiter    *ConnLimiter
+	accessLog  *AccessLog
+	// chainOutbound connects to the first hop of the chains, the acl
+	// doesn't apply to the proxies themselves.
+	chainOutbound *OutboundDialer
+	chains        struct {
+		sync.RWMutex
+		byPort map[string]*ProxyChain
+		def    *ProxyChain
+	}
+
+	configMu sync.Mutex
+	config   *Config
+
+	pm             *passwdManager
+	obfs           *obfsListener // set by NewObfsServer
+	connCnt        int32
+	nextLogConnCnt int32
+
+	manager struct {
+		sync.Mutex
+		conn *net.UDPConn
+		// the addresses that asked for periodic stat reports with ping
+		reports map[string]*net.UDPAddr
+	}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewServer creates a server for the ports of config, either port_password
+// or server_port and password or key. The method defaults to
+// DefaultCipherMethod. The config is not modified.
+func NewServer(config *Config) (*Server, error) {
+	config, err := prepareServerConfig(config, false)
+	if err != nil {
+		return nil, err
+	}
+	return newServer(config)
+}
+
+// newServer creates a server for the prepared config.
+func newServer(config *Config) (*Server, error) {
+	var err error
+	s := &Server{
+		UDP:            config.UDP,
+		acl:            &ACL{},
+		resolver:       &Resolver{},
+		proxyProto:     &ProxyProtocol{},
+		limiter:        &ConnLimiter{},
+		accessLog:      &AccessLog{},
+		config:         config,
+		pm:             newPasswdManager(),
+		done:           make(chan struct{}),
+		nextLogConnCnt: logCntDelta,
+	}
+	s.outbound = &OutboundDialer{ACL: s.acl, Resolver: s.resolver}
+	s.chainOutbound = &OutboundDialer{Resolver: s.resolver}
+	s.manager.reports = make(map[string]*net.UDPAddr)
+
+	if err = s.acl.Load(config.ACL); err != nil {
+		return nil, err
+	}
+	if err = s.resolver.Load(config.DNS); err != nil {
+		return nil, err
+	}
+	if err = s.outbound.Load(config.Outbound); err != nil {
+		return nil, err
+	}
+	if err = s.proxyProto.Load(config.ProxyProtocol); err != nil {
+		return nil, err
+	}
+	s.limiter.Load(config.Limits)
+	if err = s.accessLog.Load(config.AccessLog); err != nil {
+		return nil, err
+	}
+	s.chainOutbound.Load(config.Outbound)
+	if err = s.loadProxyChains(config); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// prepareServerConfig returns a copy of config with the defaults applied and
+// all the ports, the single one if any, moved to PortUsers with their
+// method. The passwords and keys are checked against the methods, and
+// against the obfs protocol for the obfs server.
+func prepareServerConfig(config *Config, obfs bool) (*Config, error) {
+	c := *config
+	if c.Method == "" {
+		c.Method = DefaultCipherMethod
+	}
+	if err := CheckCipherMethod(c.Method); err != nil {
+		return nil, err
+	}
+	c.PortPassword = nil
+	c.PortUsers = make(map[string]*PortUser, len(config.PortPassword)+len(config.PortUsers))
+	if len(config.PortPassword) == 0 && len(config.PortUsers) == 0 {
+		if c.ServerPort == 0 || c.Password == "" && c.Key == "" {
+			return nil, errors.New("shadowsocks: must specify both port and password or key")
+		}
+		c.PortUsers[strconv.Itoa(c.ServerPort)] = &PortUser{Password: c.Password, Key: c.Key}
+	} else {
+		if c.Password != "" || c.Key != "" || c.ServerPort != 0 {
+			mainLog.Warn("given port_password, ignore server_port, password and key option")
+		}
+		for port, password := range config.PortPassword {
+			c.PortUsers[port] = &PortUser{Password: password}
+		}
+		for port, user := range config.PortUsers {
+			if _, ok := c.PortUsers[port]; ok {
+				return nil, fmt.Errorf("shadowsocks: port %s given twice", port)
+			}
+			u := *user
+			c.PortUsers[port] = &u
+		}
+	}
+	nports := len(c.PortUsers)
+	if obfs {
+		nports = 1 // only obfs_port is listened on
+	}
+	if err := c.Listen.check(nports); err != nil {
+		return nil, err
+	}
+	if c.FastOpen {
+		var lc ListenConfig
+		if c.Listen != nil {
+			lc = *c.Listen
+		}
+		lc.Socket = lc.Socket.withFastOpen()
+		c.Listen = &lc
+	}
+	for port, user := range c.PortUsers {
+		if user.Method == "" {
+			user.Method = c.Method
+		} else if err := CheckCipherMethod(user.Method); err != nil {
+			return nil, fmt.Errorf("shadowsocks: port %s: %v", port, err)
+		}
+		if _, err := newCipherFor(user.Method, user.Password, user.Key); err != nil {
+			return nil, fmt.Errorf("shadowsocks: port %s: %v", port, err)
+		}
+	}
+	if obfs {
+		if err := checkObfsConfig(&c); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+func (s *Server) getConfig() *Config {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	return s.config
+}
+
+// Start listens on all the ports, which maybe inherited from the parent
+// process, and serves them in background. If a port can't be listened on,
+// the server is closed and the error returned. Once ctx is done, the server
+// is shut down as with Shutdown, given the drain timeout.
+func (s *Server) Start(ctx context.Context) error {
+	if s.obfs != nil {
+		if err := s.listenObfs(); err != nil {
+			s.Close()
+			return err
+		}
+	}
+	for port, user := range s.getConfig().PortUsers {
+		s.limiter.SetPortLimits(port, user.Limits)
+		if err := s.listen(port, *user); err != nil {
+			s.Close()
+			return err
+		}
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), s.DrainTimeout())
+			s.Shutdown(ctx)
+			cancel()
+		case <-s.done:
+		}
+	}()
+	return nil
+}
+
+// Reload applies config to the running server. The ports added or with a new
+// password are (re)started, the ones removed are closed after draining their
+// connections. Like the commands on SIGHUP, the sections that fail to load
+// are logged and keep their old settings.
+func (s *Server) Reload(config *Config) error {
+	config, err := prepareServerConfig(config, s.obfs != nil)
+	if err != nil {
+		return err
+	}
+	if err = s.acl.Load(config.ACL); err != nil {
+		mainLog.Error("error loading acl, keep using the old one", Err(err))
+	}
+	if err = s.resolver.Load(config.DNS); err != nil {
+		mainLog.Error("error loading dns config, keep using the old one", Err(err))
+	}
+	if err = s.outbound.Load(config.Outbound); err != nil {
+		mainLog.Error("error loading outbound config, keep using the old one", Err(err))
+	}
+	if err = s.proxyProto.Load(config.ProxyProtocol); err != nil {
+		mainLog.Error("error loading proxy protocol config, keep using the old one", Err(err))
+	}
+	s.limiter.Load(config.Limits)
+	if err = s.accessLog.Load(config.AccessLog); err != nil {
+		mainLog.Error("error loading access log config, keep using the old one", Err(err))
+	}
+	s.chainOutbound.Load(config.Outbound)
+	if err = s.loadProxyChains(config); err != nil {
+		mainLog.Error("error loading proxy chains, keep using the old ones", Err(err))
+	}
+
+	s.configMu.Lock()
+	old := s.config
+	s.config = config
+	s.configMu.Unlock()
+	// only the ports added or with another user are restarted, see
+	// updatePortPasswd, or all of them for new listen addresses
+	relisten := !reflect.DeepEqual(old.Listen, config.Listen)
+	if s.obfs != nil {
+		// the users don't have listeners of their own
+		if relisten || old.ObfsPort != config.ObfsPort {
+			mgrLog.Warn("listen config or obfs_port changed, restart the server to apply")
+		}
+		relisten = false
+	} else if relisten {
+		mgrLog.Info("listen config changed, restarting all ports")
+	}
+	var added, changed, removed int
+	for port, user := range config.PortUsers {
+		if pl, ok := s.pm.get(port); !ok {
+			added++
+		} else if relisten || !pl.user.sameCipher(*user) {
+			changed++
+		}
+		if err = s.updatePortPasswd(port, *user, relisten); err != nil {
+			mgrLog.Error("error updating port", F("port", port), Err(err))
+		}
+	}
+	// port password only in the old config should be closed
+	for port := range old.PortUsers {
+		if _, ok := config.PortUsers[port]; !ok {
+			mgrLog.Info("closing port as it's deleted", F("port", port))
+			s.pm.del(port, false, s.DrainTimeout())
+			s.limiter.SetPortLimits(port, nil)
+			removed++
+		}
+	}
+	mgrLog.Info("ports reloaded", F("added", added), F("changed", changed), F("removed", removed),
+		F("unchanged", len(config.PortUsers)-added-changed))
+	return nil
+}
+
+// AddUser starts serving port with password. If the port is already served
+// with another password, it's restarted: existing connections keep going
+// with the old password.
+func (s *Server) AddUser(port, password string) error {
+	return s.AddPortUser(port, &PortUser{Password: password})
+}
+
+// AddPortUser is like AddUser, with a password or a key, and the method
+// and the limits of the port. The method defaults to the one of the config.
+func (s *Server) AddPortUser(port string, user *PortUser) error {
+	u := *user
+	if u.Method == "" {
+		u.Method = s.getConfig().Method
+	}
+	if _, err := newCipherFor(u.Method, u.Password, u.Key); err != nil {
+		return err
+	}
+	if s.obfs != nil {
+		if err := checkObfsUser(&u); err != nil {
+			return err
+		}
+		if other, ok := s.pm.getObfs(u.Password); ok && other.port != port {
+			return fmt.Errorf("shadowsocks: password of port %s shared with port %s", port, other.port)
+		}
+	}
+	return s.updatePortPasswd(port, u, false)
+}
+
+// RemoveUser stops serving port. Existing connections of that port are closed
+// immediately if force is set, otherwise they are given the drain timeout to
+// finish first.
+func (s *Server) RemoveUser(port string, force bool) error {
+	if _, ok := s.pm.get(port); !ok {
+		return fmt.Errorf("shadowsocks: port %s not found", port)
+	}
+	s.pm.del(port, force, s.DrainTimeout())
+	s.limiter.SetPortLimits(port, nil)
+	return nil
+}
+
+// Stats returns the current counters.
+func (s *Server) Stats() ServerStats {
+	return ServerStats{
+		Traffic: s.pm.getTrafficStats(),
+		Denied:  s.pm.getDeniedStats(),
+		Conns:   int(atomic.LoadInt32(&s.connCnt)),
+	}
+}
+
+// Banned returns the client ips banned for failing handshakes, with the end
+// of their ban.
+func (s *Server) Banned() map[string]time.Time {
+	return s.limiter.Banned()
+}
+
+// Unban lifts the ban of ip, returns false if it's not banned.
+func (s *Server) Unban(ip string) bool {
+	return s.limiter.Unban(ip)
+}
+
+// DrainTimeout returns how long in-flight connections are waited for when
+// removing a port or shutting down.
+func (s *Server) DrainTimeout() time.Duration {
+	config := s.getConfig()
+	switch {
+	case config.DrainTimeout < 0:
+		return 0
+	case config.DrainTimeout == 0:
+		return defaultDrainTimeout
+	}
+	return time.Duration(config.DrainTimeout) * time.Second
+}
+
+// Listeners returns the listening sockets of all ports, to hand them over to
+// a new process with StartUpgrade.
+func (s *Server) Listeners() ([]net.Listener, []net.PacketConn) {
+	lns, conns := s.pm.listeners()
+	if s.obfs != nil {
+		s.obfs.Lock()
+		lns = append(lns, s.obfs.listeners...)
+		s.obfs.Unlock()
+	}
+	return lns, conns
+}
+
+// closeAll stops all the listeners and returns the connection groups of all
+// ports, the obfs one included.
+func (s *Server) closeAll() map[string]*ConnGroup {
+	groups := s.pm.closeAll()
+	if s.obfs != nil {
+		groups[s.obfs.port] = s.closeObfs()
+	}
+	return groups
+}
+
+// Shutdown stops accepting new connections and waits for the in-flight ones
+// to finish until ctx is done, then closes the remaining ones. The final
+// traffic stats are logged and sent to the manager clients. It returns the
+// error of ctx if connections had to be closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	groups := s.closeAll()
+	s.closeOnce.Do(func() { close(s.done) })
+	var err error
+	for port, conns := range groups {
+		if n := conns.Len(); n > 0 {
+			mainLog.Info("waiting for connections to finish", F("port", port), F("count", n))
+		}
+		if !conns.WaitContext(ctx) {
+			mainLog.Info("closed remaining connections", F("port", port), F("count", conns.CloseAll()))
+			err = ctx.Err()
+		}
+	}
+	s.flushStats()
+	return err
+}
+
+// Close stops all the ports and closes their connections immediately.
+func (s *Server) Close() error {
+	groups := s.closeAll()
+	s.closeOnce.Do(func() { close(s.done) })
+	for _, conns := range groups {
+		conns.CloseAll()
+	}
+	return nil
+}
+
+func (s *Server) loadProxyChains(config *Config) error {
+	named := make(map[string]*ProxyChain, len(config.ProxyChains))
+	for name, hops := range config.ProxyChains {
+		chain, err := NewProxyChain(hops)
+		if err != nil {
+			return fmt.Errorf("proxy chain %s: %v", name, err)
+		}
+		chain.Dialer, chain.ACL, chain.Resolver = s.chainOutbound, s.acl, s.resolver
+		named[name] = chain
+	}
+	lookup := func(name string) (*ProxyChain, error) {
+		if name == "" || name == "direct" {
+			return nil, nil
+		}
+		chain, ok := named[name]
+		if !ok {
+			return nil, fmt.Errorf("proxy chain %s not defined", name)
+		}
+		return chain, nil
+	}
+	def, err := lookup(config.Chain)
+	if err != nil {
+		return err
+	}
+	byPort := make(map[string]*ProxyChain, len(config.PortChain))
+	for port, name := range config.PortChain {
+		if byPort[port], err = lookup(name); err != nil {
+			return err
+		}
+	}
+	s.chains.Lock()
+	s.chains.byPort, s.chains.def = byPort, def
+	s.chains.Unlock()
+	return nil
+}
+
+// dialRemote connects to host for port, through its proxy chain if any.
+func (s *Server) dialRemote(port, host string) (net.Conn, error) {
+	s.chains.RLock()
+	chain, ok := s.chains.byPort[port]
+	if !ok {
+		chain = s.chains.def
+	}
+	s.chains.RUnlock()
+	if chain == nil {
+		return s.outbound.Dial("tcp", host)
+	}
+	return chain.Dial("tcp", host)
+}
+
+func getRequest(conn *Conn) (host string, err error) {
+	SetReadTimeout(conn)
+
+	// buf size should at least have the same size with the largest possible
+	// request size (when addrType is 3, domain name has at most 256 bytes)
+	// 1(addrType) + 1(lenByte) + 255(max length address) + 2(port) + 10(hmac-sha1)
+	buf := make([]byte, 269)
+	// read till we get possible domain length field
+	if _, err = io.ReadFull(conn, buf[:idType+1]); err != nil {
+		return
+	}
+
+	var reqStart, reqEnd int
+	addrType := buf[idType]
+	switch addrType & AddrMask {
+	case typeIPv4:
+		reqStart, reqEnd = idIP0, lenIPv4
+	case typeIPv6:
+		reqStart, reqEnd = idIP0, lenIPv6
+	case typeDm:
+		if _, err = io.ReadFull(conn, buf[idType+1:idDmLen+1]); err != nil {
+			return
+		}
+		reqStart, reqEnd = idDm0, int(buf[idDmLen])+lenDmBase
+	default:
+		err = fmt.Errorf("addr type %d not supported", addrType&AddrMask)
+		return
+	}
+
+	if _, err = io.ReadFull(conn, buf[reqStart:reqEnd]); err != nil {
+		return
+	}
+
+	// Return string for typeIP is not most efficient, but browsers (Chrome,
+	// Safari, Firefox) all seems using typeDm exclusively. So this is not a
+	// big problem.
+	switch addrType & AddrMask {
+	case typeIPv4:
+		host = net.IP(buf[idIP0 : idIP0+net.IPv4len]).String()
+	case typeIPv6:
+		host = net.IP(buf[idIP0 : idIP0+net.IPv6len]).String()
+	case typeDm:
+		host = string(buf[idDm0 : idDm0+int(buf[idDmLen])])
+	}
+	// parse port
+	port := binary.BigEndian.Uint16(buf[reqEnd-2 : reqEnd])
+	host = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	return
+}
+
+const logCntDelta = 100
+
+// logAccess writes the access log record of a tcp session.
+func (s *Server) logAccess(id string, start time.Time, port string, client net.Addr, host string, up, down int64, reason string) {
+	s.accessLog.Log(&AccessRecord{
+		ID:          id,
+		Network:     "tcp",
+		Start:       start,
+		End:         time.Now(),
+		Port:        port,
+		Client:      client.String(),
+		Destination: host,
+		BytesUp:     up,
+		BytesDown:   down,
+		CloseReason: reason,
+	})
+}
+
+func (s *Server) handleConnection(conn *Conn, port string) {
+	var host string
+	start := time.Now()
+	id := NewConnID()
+
+	if cnt, next := atomic.AddInt32(&s.connCnt, 1), atomic.LoadInt32(&s.nextLogConnCnt); cnt >= next {
+		// nextLogConnCnt maybe added twice for current peak connection
+		// number level, this is accurate enough.
+		if atomic.CompareAndSwapInt32(&s.nextLogConnCnt, next, next+logCntDelta) {
+			tcpLog.Info("number of client connections reaches limit", F("count", next))
+		}
+	}
+
+	tcpLog.Debug("new client", F("conn", id), ClientAddr(conn.RemoteAddr()), F("local", conn.LocalAddr()))
+	closed := false
+	defer func() {
+		tcpLog.Debug("closed pipe", F("conn", id), ClientAddr(conn.RemoteAddr()), F("host", host))
+		atomic.AddInt32(&s.connCnt, -1)
+		if !closed {
+			conn.Close()
+		}
+	}()
+
+	if err := s.limiter.Acquire(port, conn.RemoteAddr()); err != nil {
+		if err == ErrBanned {
+			tcpLog.Debug("refused client", ClientAddr(conn.RemoteAddr()), F("port", port), Err(err))
+		} else {
+			tcpLog.Warn("refused client", ClientAddr(conn.RemoteAddr()), F("port", port), Err(err))
+		}
+		return
+	}
+	defer s.limiter.Release(port, conn.RemoteAddr())
+
+	host, err := getRequest(conn)
+	if err != nil {
+		tcpLog.Info("error getting request", ClientAddr(conn.RemoteAddr()), F("local", conn.LocalAddr()), Err(err))
+		if d := s.limiter.Fail(conn.RemoteAddr()); d > 0 {
+			tcpLog.Warn("banned client after failed handshakes", ClientAddr(conn.RemoteAddr()), F("duration", d))
+		}
+		closed = true
+		return
+	}
+	// ensure the host does not contain some illegal characters, NUL may panic on Win32
+	if strings.ContainsRune(host, 0x00) {
+		tcpLog.Warn("invalid domain name", ClientAddr(conn.RemoteAddr()))
+		closed = true
+		return
+	}
+	tcpLog.Debug("connecting", F("host", host))
+	remote, err := s.dialRemote(port, host)
+	if err != nil {
+		reason := "dial error"
+		if IsACLDenied(err) {
+			reason = "denied"
+			tcpLog.Info("connection denied", F("port", port), Err(err))
+			s.pm.addDenied(port)
+		} else if ne, ok := err.(*net.OpError); ok && (ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE) {
+			// log too many open file error
+			// EMFILE is process reaches open file limits, ENFILE is system limit
+			tcpLog.Error("dial error", Err(err))
+		} else {
+			tcpLog.Info("error connecting", F("host", host), Err(err))
+		}
+		s.logAccess(id, start, port, conn.RemoteAddr(), host, 0, 0, reason)
+		return
+	}
+	defer func() {
+		if !closed {
+			remote.Close()
+		}
+	}()
+	if s.proxyProto.ShouldSend(remote.RemoteAddr()) {
+		if err = WriteProxyHeader(remote, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+			tcpLog.Info("error sending proxy protocol header", F("host", host), Err(err))
+			s.logAccess(id, start, port, conn.RemoteAddr(), host, 0, 0, "remote error")
+			return
+		}
+	}
+	tcpLog.Debug("piping", F("conn", id), ClientAddr(conn.RemoteAddr()), F("host", host))
+	up, down, reason := Relay(conn, remote, func(traffic int) {
+		s.pm.addTraffic(port, traffic)
+	})
+	closed = true
+	s.logAccess(id, start, port, conn.RemoteAddr(), host, up, down, reason)
+	return
+}
+
+// portListener is the listening sockets of a port, one for each address
+// of the listen config, or more with reuse_port.
+type portListener struct {
+	user      PortUser
+	listeners []net.Listener
+}
+
+func (pl *portListener) close() {
+	for _, ln := range pl.listeners {
+		ln.Close()
+	}
+}
+
+type udpListener struct {
+	user      PortUser
+	listeners []*net.UDPConn
+}
+
+func (pl *udpListener) close() {
+	for _, ln := range pl.listeners {
+		ln.Close()
+	}
+}
+
+// passwdManager keeps the listeners and the stats of the ports.
+type passwdManager struct {
+	sync.Mutex
+	closing      bool // set on shutdown, no more ports can be added
+	portListener map[string]*portListener
+	udpListener  map[string]*udpListener
+	portConns    map[string]*ConnGroup
+	trafficStats map[string]int64
+	aclDenied    map[string]int64    // connections denied by the acl
+	obfsUsers    map[string]obfsUser // users of the obfs server by password
+}
+
+func newPasswdManager() *passwdManager {
+	return &passwdManager{
+		portListener: map[string]*portListener{},
+		udpListener:  map[string]*udpListener{},
+		portConns:    map[string]*ConnGroup{},
+		trafficStats: map[string]int64{},
+		aclDenied:    map[string]int64{},
+		obfsUsers:    map[string]obfsUser{},
+	}
+}
+
+// add registers the listeners of port, it returns false if the server is
+// shutting down.
+func (pm *passwdManager) add(port string, user PortUser, listeners []net.Listener) bool {
+	pm.Lock()
+	defer pm.Unlock()
+	if pm.closing {
+		return false
+	}
+	pm.portListener[port] = &portListener{user, listeners}
+	if _, ok := pm.trafficStats[port]; !ok {
+		pm.trafficStats[port] = 0
+	}
+	return true
+}
+
+// addObfs registers the user of port on the obfs port, replacing the
+// previous user of port. It returns false if the server is shutting down.
+func (pm *passwdManager) addObfs(port string, user PortUser, cipher *Cipher) bool {
+	pm.Lock()
+	defer pm.Unlock()
+	if pm.closing {
+		return false
+	}
+	if pl, ok := pm.portListener[port]; ok && pm.obfsUsers[pl.user.Password].port == port {
+		delete(pm.obfsUsers, pl.user.Password)
+	}
+	pm.portListener[port] = &portListener{user: user}
+	// a password taken from another port on reload, e.g. when swapping
+	// passwords, belongs to port from now on
+	pm.obfsUsers[user.Password] = obfsUser{port, cipher}
+	if _, ok := pm.trafficStats[port]; !ok {
+		pm.trafficStats[port] = 0
+	}
+	return true
+}
+
+func (pm *passwdManager) getObfs(password string) (user obfsUser, ok bool) {
+	pm.Lock()
+	user, ok = pm.obfsUsers[password]
+	pm.Unlock()
+	return
+}
+
+func (pm *passwdManager) addUDP(port string, user PortUser, listeners []*net.UDPConn) bool {
+	pm.Lock()
+	defer pm.Unlock()
+	if pm.closing {
+		return false
+	}
+	pm.udpListener[port] = &udpListener{user, listeners}
+	return true
+}
+
+func (pm *passwdManager) get(port string) (pl *portListener, ok bool) {
+	pm.Lock()
+	pl, ok = pm.portListener[port]
+	pm.Unlock()
+	return
+}
+
+func (pm *passwdManager) getUDP(port string) (pl *udpListener, ok bool) {
+	pm.Lock()
+	pl, ok = pm.udpListener[port]
+	pm.Unlock()
+	return
+}
+
+// connGroup returns the connections accepted on port. The group outlives
+// listener restarts caused by password update, so del can reach connections
+// accepted with an old password too.
+func (pm *passwdManager) connGroup(port string) *ConnGroup {
+	pm.Lock()
+	defer pm.Unlock()
+	g, ok := pm.portConns[port]
+	if !ok {
+		g = NewConnGroup()
+		pm.portConns[port] = g
+	}
+	return g
+}
+
+// del stops listening on port. Existing connections of that port are closed
+// immediately if force is set, otherwise they are given drainTimeout to
+// finish first.
+func (pm *passwdManager) del(port string, force bool, drainTimeout time.Duration) {
+	pm.Lock()
+	pl, ok := pm.portListener[port]
+	if !ok {
+		pm.Unlock()
+		return
+	}
+	pl.close()
+	if upl, ok := pm.udpListener[port]; ok {
+		upl.close()
+	}
+	if pm.obfsUsers[pl.user.Password].port == port {
+		delete(pm.obfsUsers, pl.user.Password)
+	}
+	conns := pm.portConns[port]
+	delete(pm.portListener, port)
+	delete(pm.udpListener, port)
+	delete(pm.portConns, port)
+	delete(pm.trafficStats, port)
+	delete(pm.aclDenied, port)
+	pm.Unlock()
+	if conns != nil {
+		go drainConns(port, conns, force, drainTimeout)
+	}
+}
+
+func drainConns(port string, conns *ConnGroup, force bool, timeout time.Duration) {
+	if !force && conns.Wait(timeout) {
+		return
+	}
+	if n := conns.CloseAll(); n > 0 {
+		mgrLog.Info("closed remaining connections", F("port", port), F("count", n))
+	}
+}
+
+// closeAll stops all the listeners and returns the connection groups of all
+// ports, used when shutting down.
+func (pm *passwdManager) closeAll() map[string]*ConnGroup {
+	pm.Lock()
+	defer pm.Unlock()
+	pm.closing = true
+	for _, pl := range pm.portListener {
+		pl.close()
+	}
+	for _, upl := range pm.udpListener {
+		upl.close()
+	}
+	groups := make(map[string]*ConnGroup, len(pm.portConns))
+	for port, g := range pm.portConns {
+		groups[port] = g
+	}
+	return groups
+}
+
+// listeners returns the listening sockets of all ports.
+func (pm *passwdManager) listeners() (lns []net.Listener, conns []net.PacketConn) {
+	pm.Lock()
+	defer pm.Unlock()
+	for _, pl := range pm.portListener {
+		lns = append(lns, pl.listeners...)
+	}
+	for _, upl := range pm.udpListener {
+		for _, c := range upl.listeners {
+			conns = append(conns, c)
+		}
+	}
+	return
+}
+
+func (pm *passwdManager) addTraffic(port string, n int) {
+	pm.Lock()
+	pm.trafficStats[port] = pm.trafficStats[port] + int64(n)
+	pm.Unlock()
+	return
+}
+
+func (pm *passwdManager) addDenied(port string) {
+	pm.Lock()
+	pm.aclDenied[port]++
+	pm.Unlock()
+}
+
+func (pm *passwdManager) getDeniedStats() map[string]int64 {
+	pm.Lock()
+	copy := make(map[string]int64, len(pm.aclDenied))
+	for k, v := range pm.aclDenied {
+		copy[k] = v
+	}
+	pm.Unlock()
+	return copy
+}
+
+func (pm *passwdManager) getTrafficStats() map[string]int64 {
+	pm.Lock()
+	copy := make(map[string]int64)
+	for k, v := range pm.trafficStats {
+		copy[k] = v
+	}
+	pm.Unlock()
+	return copy
+}
+
+// Update port password would first close a port and restart listening on that
+// port. A different approach would be directly change the password used by
+// that port, but that requires **sharing** password between the port listener
+// and password manager. The same goes for the method, while the limits are
+// applied to the running port. With restart, the port is restarted even with
+// the same user, for new listen addresses.
+func (s *Server) updatePortPasswd(port string, user PortUser, restart bool) error {
+	s.pm.Lock()
+	closing := s.pm.closing
+	s.pm.Unlock()
+	if closing {
+		return errors.New("shadowsocks: server closed")
+	}
+	s.limiter.SetPortLimits(port, user.Limits)
+	pl, ok := s.pm.get(port)
+	if !ok {
+		mgrLog.Info("new port added", F("port", port))
+	} else {
+		if !restart && pl.user.sameCipher(user) {
+			return nil
+		}
+		if s.obfs != nil {
+			mgrLog.Info("updating password of user", F("port", port))
+		} else {
+			mgrLog.Info("closing port to update password", F("port", port))
+		}
+		pl.close()
+		if upl, ok := s.pm.getUDP(port); ok {
+			upl.close()
+		}
+	}
+	// listen will add the new port listener to passwdManager.
+	// So there maybe concurrent access to passwdManager and we need lock to protect it.
+	if err := s.listen(port, user); err != nil {
+		if ok {
+			// the old listener is gone, drop the port
+			s.pm.del(port, false, s.DrainTimeout())
+		}
+		s.limiter.SetPortLimits(port, nil)
+		return err
+	}
+	return nil
+}
+
+// listen listens on port, and on the udp port if enabled, and serves it in
+// background.
+func (s *Server) listen(port string, user PortUser) error {
+	cipher, err := newCipherFor(user.Method, user.Password, user.Key)
+	if err != nil {
+		mainLog.Error("error generating cipher for port", F("port", port), Err(err))
+		return err
+	}
+	if s.obfs != nil {
+		if !s.pm.addObfs(port, user, cipher) {
+			return errors.New("shadowsocks: server closed")
+		}
+		obfsLog.Info("user added", F("port", port), F("method", user.Method))
+		return nil
+	}
+	listen := s.getConfig().Listen
+	lns, err := listen.listen(port)
+	if err != nil {
+		mainLog.Error("error listening port", F("port", port), Err(err))
+		return err
+	}
+	pl := &portListener{user, lns}
+	if !s.pm.add(port, user, lns) {
+		pl.close()
+		return errors.New("shadowsocks: server closed")
+	}
+	for _, ln := range lns {
+		mainLog.Info("server listening port", F("port", port), F("addr", ln.Addr()), F("method", user.Method))
+		go s.serve(s.proxyProto.Listener(listen.socket().listener(ln)), port, cipher)
+	}
+	if s.UDP {
+		s.listenUDP(port, user, cipher)
+	}
+	return nil
+}
+
+func (s *Server) serve(ln net.Listener, port string, cipher *Cipher) {
+	conns := s.pm.connGroup(port)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			// listener maybe closed to update password
+			tcpLog.Debug("accept error", F("port", port), Err(err))
+			return
+		}
+		if !conns.Add(conn) {
+			// port is being removed
+			conn.Close()
+			continue
+		}
+		go func(conn net.Conn, c *Conn) {
+			s.handleConnection(c, port)
+			conns.Done(conn)
+		}(conn, NewConn(conn, cipher.Copy()))
+	}
+}
+
+// listenUDP starts the udp relay of port, errors are only logged.
+func (s *Server) listenUDP(port string, user PortUser, cipher *Cipher) {
+	conns := s.getConfig().Listen.listenUDP(port)
+	if len(conns) == 0 {
+		return
+	}
+	upl := &udpListener{user, conns}
+	if !s.pm.addUDP(port, user, conns) {
+		upl.close()
+		return
+	}
+	for _, conn := range conns {
+		udpLog.Info("listening udp port", F("port", port), F("addr", conn.LocalAddr()))
+		go s.serveUDP(conn, port, cipher)
+	}
+}
+
+func (s *Server) serveUDP(conn *net.UDPConn, port string, cipher *Cipher) {
+	defer conn.Close()
+	SecurePacketConn := NewSecurePacketConn(conn, cipher.Copy())
+	relay := &UDPRelay{
+		ACL:      s.acl,
+		Resolver: s.resolver,
+		AddTraffic: func(traffic int) {
+			s.pm.addTraffic(port, traffic)
+		},
+		OnDeny: func(err error) {
+			s.pm.addDenied(port)
+		},
+		AccessLog: s.accessLog,
+		Port:      port,
+	}
+	for {
+		if err := relay.ReadAndHandle(SecurePacketConn); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// closed to update the password or on shutdown
+				return
+			}
+			// e.g. a datagram failing authentication, only that one is dropped
+			udpLog.Debug("read error", F("port", port), Err(err))
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package shadowsocks
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// echoThrough sends msg to the echo server through the socks5 server at
+// socksAddr and returns the reply.
+func echoThrough(socksAddr, echoAddr, msg string) (string, error) {
+	chain, err := NewProxyChain([]string{"socks5://" + socksAddr})
+	if err != nil {
+		return "", err
+	}
+	c, err := chain.Dial("tcp", echoAddr)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	if _, err = io.WriteString(c, msg); err != nil {
+		return "", err
+	}
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(c, buf)
+	return string(buf), err
+}
+
+func TestServerClient(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	port := freePort(t)
+
+	if _, err := NewServer(&Config{Method: "aes-128-cfb"}); err == nil {
+		t.Error("server without port should fail")
+	}
+	s, err := NewServer(&Config{PortPassword: map[string]string{port: "foobar"}, Method: "aes-128-cfb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := NewClient(&Config{Server: "127.0.0.1", ServerPort: mustAtoi(port), Password: "foobar", Method: "aes-128-cfb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Serve(ln)
+	defer c.Close()
+
+	if got, err := echoThrough(ln.Addr().String(), echo.Addr().String(), "hello"); err != nil || got != "hello" {
+		t.Fatalf("echo got %q, %v", got, err)
+	}
+	if stats := s.Stats(); stats.Traffic[port] == 0 {
+		t.Errorf("traffic should be counted, got %v", stats.Traffic)
+	}
+
+	// a new password restarts the port, the client has the old one
+	if err = s.AddUser(port, "barfoo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := echoThrough(ln.Addr().String(), echo.Addr().String(), "hello"); err == nil {
+		t.Error("client with the old password should fail")
+	}
+
+	if err = s.RemoveUser(port, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Stats().Traffic[port]; ok {
+		t.Error("removed port should have no stats")
+	}
+	if err = s.RemoveUser(port, true); err == nil {
+		t.Error("removing a port twice should fail")
+	}
+	if _, err := net.Dial("tcp", "127.0.0.1:"+port); err == nil {
+		t.Error("removed port should not be listening")
+	}
+}
+
+func TestClientReload(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	port := freePort(t)
+	s, err := NewServer(&Config{PortPassword: map[string]string{port: "foobar"}, Method: "aes-128-cfb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := NewClient(&Config{Server: "127.0.0.1", ServerPort: mustAtoi(port), Password: "barfoo", Method: "aes-128-cfb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Serve(ln)
+	defer c.Close()
+	if _, err := echoThrough(ln.Addr().String(), echo.Addr().String(), "hello"); err == nil {
+		t.Error("client with the wrong password should fail")
+	}
+
+	if err = c.Reload(&Config{Server: "127.0.0.1", ServerPort: mustAtoi(port), Password: "foobar", Method: "aes-128-cfb"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := echoThrough(ln.Addr().String(), echo.Addr().String(), "hello"); err != nil || got != "hello" {
+		t.Fatalf("echo after reload got %q, %v", got, err)
+	}
+	// an invalid config keeps the servers
+	if err = c.Reload(&Config{Server: "127.0.0.1", ServerPort: mustAtoi(port), Password: "foobar", Method: "aes-128-xyz"}); err == nil {
+		t.Error("reload with an unknown method should fail")
+	}
+	if got, err := echoThrough(ln.Addr().String(), echo.Addr().String(), "hello"); err != nil || got != "hello" {
+		t.Errorf("echo after failed reload got %q, %v", got, err)
+	}
+}
+
+func TestClientFirstData(t *testing.T) {
+	// the first segment the server gets
+	first := make(chan int, 1)
+	fake := serveTest(t, func(c net.Conn) {
+		buf := make([]byte, 1024)
+		n, _ := c.Read(buf)
+		first <- n
+		c.Close()
+	})
+	defer fake.Close()
+	var clients []*Client
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	start := func(server string) string {
+		host, port, _ := net.SplitHostPort(server)
+		c, err := NewClient(&Config{Server: host, ServerPort: mustAtoi(port), Password: "foobar", Method: "aes-128-cfb"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go c.Serve(ln)
+		clients = append(clients, c)
+		return ln.Addr().String()
+	}
+	echoThrough(start(fake.Addr().String()), "127.0.0.1:80", "hello")
+	// iv, ipv4 address and data
+	if n := <-first; n != 16+7+5 {
+		t.Errorf("first segment of %d bytes, want the address and the data in %d", n, 16+7+5)
+	}
+
+	// the server speaks first, the address is sent alone
+	banner := serveTest(t, func(c net.Conn) {
+		io.WriteString(c, "banner")
+		c.Close()
+	})
+	defer banner.Close()
+	port := freePort(t)
+	s, err := NewServer(&Config{PortPassword: map[string]string{port: "foobar"}, Method: "aes-128-cfb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	chain, err := NewProxyChain([]string{"socks5://" + start("127.0.0.1:"+port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := chain.Dial("tcp", banner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 6)
+	if _, err = io.ReadFull(c, buf); err != nil || string(buf) != "banner" {
+		t.Errorf("got %q, %v, want the banner", buf, err)
+	}
+
+	// the socks reply reports the server down
+	if _, err = echoThrough(start("127.0.0.1:"+freePort(t)), "127.0.0.1:80", "hello"); err == nil {
+		t.Error("connecting to a server down should fail")
+	}
+}
+
+func TestServerPortMethod(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	port1, port2 := freePort(t), freePort(t)
+	config := &Config{
+		Method:       "aes-128-cfb",
+		PortPassword: map[string]string{port1: "foobar"},
+		PortUsers:    map[string]*PortUser{port2: {Password: "barfoo", Method: "chacha20-ietf-poly1305"}},
+	}
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	through := func(port, password, method string) error {
+		c, err := NewClient(&Config{ServerPassword: [][]string{{"127.0.0.1:" + port, password, method}}})
+		if err != nil {
+			return err
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		go c.Serve(ln)
+		defer c.Close()
+		_, err = echoThrough(ln.Addr().String(), echo.Addr().String(), "hello")
+		return err
+	}
+	if err = through(port1, "foobar", "aes-128-cfb"); err != nil {
+		t.Error("port with the config's method:", err)
+	}
+	if err = through(port2, "barfoo", "chacha20-ietf-poly1305"); err != nil {
+		t.Error("port with its own method:", err)
+	}
+
+	// a new method restarts the port, even with the same password
+	config.PortUsers[port2].Method = "aes-256-gcm"
+	if err = s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	if err = through(port2, "barfoo", "chacha20-ietf-poly1305"); err == nil {
+		t.Error("client with the old method should fail")
+	}
+	if err = through(port2, "barfoo", "aes-256-gcm"); err != nil {
+		t.Error("port with the new method:", err)
+	}
+	// the method of the config applies to the ports without one
+	config.Method = "aes-256-cfb"
+	if err = s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	if err = through(port1, "foobar", "aes-256-cfb"); err != nil {
+		t.Error("port with the config's new method:", err)
+	}
+
+	if err = s.AddPortUser(port1, &PortUser{Password: "foobar", Method: "rc4-md5"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = through(port1, "foobar", "rc4-md5"); err != nil {
+		t.Error("port added with a method:", err)
+	}
+	if err = s.AddPortUser(port1, &PortUser{Password: "foobar", Method: "aes-256-xyz"}); err == nil {
+		t.Error("unknown method should fail")
+	}
+}
+
+func TestServerKey(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	port := freePort(t)
+	key, _ := GenerateKey("chacha20-ietf-poly1305")
+
+	s, err := NewServer(&Config{PortUsers: map[string]*PortUser{port: {Key: key}}, Method: "chacha20-ietf-poly1305"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := NewClient(&Config{ServerPassword: [][]string{{"127.0.0.1:" + port, "", "chacha20-ietf-poly1305", key}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Serve(ln)
+	defer c.Close()
+	if got, err := echoThrough(ln.Addr().String(), echo.Addr().String(), "hello"); err != nil || got != "hello" {
+		t.Fatalf("echo got %q, %v", got, err)
+	}
+
+	if err = s.AddPortUser(port, &PortUser{Key: "AAECAw=="}); err == nil {
+		t.Error("key of the wrong length should fail")
+	}
+	if _, ok := s.Stats().Traffic[port]; !ok {
+		t.Error("port with an invalid new key should keep serving")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	port := freePort(t)
+	s, err := NewServer(&Config{ServerPort: mustAtoi(port), Password: "foobar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err = s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// an idle connection keeps the port busy until the drain deadline
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	dctx, dcancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer dcancel()
+	if err = s.Shutdown(dctx); err != context.DeadlineExceeded {
+		t.Errorf("shutdown should close the idle connection, got %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("connection should be closed, got %v", err)
+	}
+	if err = s.AddUser("8388", "foobar"); err == nil {
+		t.Error("closed server should not add ports")
+	}
+	cancel()
+}
+
+func mustAtoi(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package shadowsocks
+
+import (
+	"os"
+	"syscall"
+)
+
+// UpgradeSignal asks a running server to hand its listeners to a new process.
+var UpgradeSignal os.Signal = syscall.SIGUSR2
@@ -0,0 +1,6 @@
+package shadowsocks
+
+import "os"
+
+// UpgradeSignal is nil on windows, as sockets can't be handed to a new process.
+var UpgradeSignal os.Signal
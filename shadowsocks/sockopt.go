@@ -0,0 +1,123 @@
+package shadowsocks
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// SocketConfig tunes the tcp sockets, the "socket" section of "listen" for
+// the connections accepted by the server and of "outbound" for the ones
+// made by the server and the client. The zero value keeps the system
+// defaults.
+type SocketConfig struct {
+	// FastOpen enables TCP Fast Open: TCP_FASTOPEN on listeners and
+	// TCP_FASTOPEN_CONNECT on connections, sending the first write, e.g.
+	// the iv and the address, in the SYN. Linux only.
+	FastOpen bool `json:"fast_open"`
+	// NoDelay sets TCP_NODELAY, true if unset as in Go.
+	NoDelay *bool `json:"no_delay"`
+	// RecvBuffer and SendBuffer set SO_RCVBUF and SO_SNDBUF, in bytes.
+	RecvBuffer int `json:"recv_buffer"`
+	SendBuffer int `json:"send_buffer"`
+	// UserTimeout sets TCP_USER_TIMEOUT, the seconds sent data may stay
+	// unacknowledged before the connection is dropped. Linux only.
+	UserTimeout int `json:"user_timeout"`
+	// KeepAliveInterval is the seconds between keepalive probes, and
+	// KeepAliveCount how many probes are lost before the connection is
+	// dropped. The idle time before the first probe is the keepalive
+	// option. Linux only.
+	KeepAliveInterval int `json:"keepalive_interval"`
+	KeepAliveCount    int `json:"keepalive_count"`
+	// Mark sets SO_MARK for policy routing. Linux only, needs
+	// CAP_NET_ADMIN.
+	Mark int `json:"mark"`
+	// Congestion sets the congestion control algorithm, e.g. "bbr". Linux
+	// only.
+	Congestion string `json:"congestion"`
+}
+
+const fastOpenQueue = 256 // pending fast open requests of a listener
+
+// check checks the options are valid and supported on this system.
+func (c *SocketConfig) check() error {
+	if c == nil {
+		return nil
+	}
+	if c.RecvBuffer < 0 || c.SendBuffer < 0 || c.UserTimeout < 0 ||
+		c.KeepAliveInterval < 0 || c.KeepAliveCount < 0 {
+		return errors.New("shadowsocks: socket: negative buffer size, timeout or keepalive")
+	}
+	_, err := c.control(false)
+	return err
+}
+
+// withFastOpen returns a copy of c with fast open on, for the fast_open
+// option of the config.
+func (c *SocketConfig) withFastOpen() *SocketConfig {
+	var sc SocketConfig
+	if c != nil {
+		sc = *c
+	}
+	sc.FastOpen = true
+	return &sc
+}
+
+// apply sets the options that are set on a connected socket.
+func (c *SocketConfig) apply(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if c == nil || !ok {
+		return
+	}
+	if c.NoDelay != nil {
+		tc.SetNoDelay(*c.NoDelay)
+	}
+	if err := c.applyConn(tc); err != nil {
+		tcpLog.Debug("error setting socket options", Err(err))
+	}
+}
+
+// listener returns ln setting the options on the connections it accepts. It
+// goes under the PROXY protocol listener, whose connections hide the
+// *net.TCPConn.
+func (c *SocketConfig) listener(ln net.Listener) net.Listener {
+	if c == nil {
+		return ln
+	}
+	return &socketListener{ln, c}
+}
+
+type socketListener struct {
+	net.Listener
+	socket *SocketConfig
+}
+
+func (l *socketListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.socket.apply(c)
+	}
+	return c, err
+}
+
+// chainControl returns a control function calling the ones given in turn,
+// skipping the nil ones.
+func chainControl(fns ...func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	var chain []func(network, address string, c syscall.RawConn) error
+	for _, fn := range fns {
+		if fn != nil {
+			chain = append(chain, fn)
+		}
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, fn := range chain {
+			if err := fn(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
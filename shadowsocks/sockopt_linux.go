@@ -0,0 +1,93 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// missing from syscall
+const (
+	tcpUserTimeout     = 0x12
+	tcpFastOpen        = 0x17
+	tcpFastOpenConnect = 0x1e
+)
+
+// control returns a control function setting the options that must be set
+// before connecting or listening. Only SO_MARK and the buffers apply to udp
+// sockets.
+func (c *SocketConfig) control(listen bool) (func(network, address string, c syscall.RawConn) error, error) {
+	if c == nil {
+		return nil, nil
+	}
+	return func(network, address string, rc syscall.RawConn) error {
+		tcp := strings.HasPrefix(network, "tcp")
+		var serr error
+		setInt := func(fd, level, opt int, name string, value int) {
+			if serr == nil {
+				if err := syscall.SetsockoptInt(fd, level, opt, value); err != nil {
+					serr = fmt.Errorf("shadowsocks: socket: %s: %v", name, err)
+				}
+			}
+		}
+		err := rc.Control(func(ufd uintptr) {
+			fd := int(ufd)
+			if c.Mark != 0 {
+				setInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, "SO_MARK", c.Mark)
+			}
+			if c.RecvBuffer > 0 {
+				setInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, "SO_RCVBUF", c.RecvBuffer)
+			}
+			if c.SendBuffer > 0 {
+				setInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, "SO_SNDBUF", c.SendBuffer)
+			}
+			if !tcp {
+				return
+			}
+			if c.FastOpen && listen {
+				setInt(fd, syscall.IPPROTO_TCP, tcpFastOpen, "TCP_FASTOPEN", fastOpenQueue)
+			} else if c.FastOpen {
+				setInt(fd, syscall.IPPROTO_TCP, tcpFastOpenConnect, "TCP_FASTOPEN_CONNECT", 1)
+			}
+			if c.UserTimeout > 0 {
+				setInt(fd, syscall.IPPROTO_TCP, tcpUserTimeout, "TCP_USER_TIMEOUT", c.UserTimeout*1000)
+			}
+			if c.Congestion != "" && serr == nil {
+				if err := syscall.SetsockoptString(fd, syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, c.Congestion); err != nil {
+					serr = fmt.Errorf("shadowsocks: socket: congestion %s: %v", c.Congestion, err)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}, nil
+}
+
+// applyConn sets the keepalive probes, after Go has set the keepalive
+// period, which sets the interval too.
+func (c *SocketConfig) applyConn(tc *net.TCPConn) error {
+	if c.KeepAliveInterval == 0 && c.KeepAliveCount == 0 {
+		return nil
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(ufd uintptr) {
+		fd := int(ufd)
+		if c.KeepAliveInterval > 0 {
+			serr = syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, c.KeepAliveInterval)
+		}
+		if c.KeepAliveCount > 0 && serr == nil {
+			serr = syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, c.KeepAliveCount)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
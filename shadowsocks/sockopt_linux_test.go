@@ -0,0 +1,147 @@
+package shadowsocks
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func getsockopt(t *testing.T, c net.Conn, level, opt int) int {
+	rc, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	rc.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestSocketOptions(t *testing.T) {
+	noDelay := false
+	socket := &SocketConfig{
+		NoDelay:           &noDelay,
+		RecvBuffer:        65536,
+		UserTimeout:       5,
+		KeepAliveInterval: 3,
+		KeepAliveCount:    4,
+		Congestion:        "reno",
+	}
+	lc := &ListenConfig{Addresses: []string{"127.0.0.1"}, Socket: socket}
+	lns, err := lc.listen("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lns[0].Close()
+	// accepted like the server does, the options apply to the connections
+	// of trusted PROXY protocol sources too
+	proxyProto := &ProxyProtocol{}
+	if err = proxyProto.Load(&ProxyProtocolConfig{Trusted: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	ln := proxyProto.Listener(lc.socket().listener(lns[0]))
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if pc, ok := c.(*proxyProtoConn); err == nil && ok {
+			accepted <- pc.Conn
+		}
+		close(accepted)
+	}()
+
+	d, err := NewOutboundDialer(&OutboundConfig{Socket: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sc := <-accepted
+	if sc == nil {
+		t.Fatal("accept failed")
+	}
+	defer sc.Close()
+
+	for _, conn := range []net.Conn{c, sc} {
+		if v := getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v != 0 {
+			t.Errorf("TCP_NODELAY %d, want 0", v)
+		}
+		// the kernel doubles the size asked for
+		if v := getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF); v != 2*65536 {
+			t.Errorf("SO_RCVBUF %d, want %d", v, 2*65536)
+		}
+		if v := getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL); v != 3 {
+			t.Errorf("TCP_KEEPINTVL %d, want 3", v)
+		}
+		if v := getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT); v != 4 {
+			t.Errorf("TCP_KEEPCNT %d, want 4", v)
+		}
+	}
+	if v := getsockopt(t, c, syscall.IPPROTO_TCP, tcpUserTimeout); v != 5000 {
+		t.Errorf("TCP_USER_TIMEOUT %d, want 5000", v)
+	}
+
+	// an unknown algorithm fails when connecting
+	d, err = NewOutboundDialer(&OutboundConfig{Socket: &SocketConfig{Congestion: "nosuchalgo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := d.Dial("tcp", ln.Addr().String()); err == nil {
+		c.Close()
+		t.Error("unknown congestion control should fail")
+	}
+}
+
+func TestServerClientFastOpen(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	port := freePort(t)
+	s, err := NewServer(&Config{PortPassword: map[string]string{port: "foobar"}, Method: "aes-128-cfb", FastOpen: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	lns, _ := s.Listeners()
+	if v := getsockoptListener(t, lns[0]); v != fastOpenQueue {
+		t.Errorf("TCP_FASTOPEN %d, want %d", v, fastOpenQueue)
+	}
+
+	c, err := NewClient(&Config{Server: "127.0.0.1", ServerPort: mustAtoi(port), Password: "foobar", Method: "aes-128-cfb", FastOpen: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Serve(ln)
+	defer c.Close()
+	if got, err := echoThrough(ln.Addr().String(), echo.Addr().String(), "hello"); err != nil || got != "hello" {
+		t.Fatalf("echo with fast open got %q, %v", got, err)
+	}
+}
+
+func getsockoptListener(t *testing.T, ln net.Listener) int {
+	rc, err := ln.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	rc.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+// +build !linux
+
+package shadowsocks
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+func (c *SocketConfig) control(listen bool) (func(network, address string, c syscall.RawConn) error, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.FastOpen || c.UserTimeout != 0 || c.KeepAliveInterval != 0 || c.KeepAliveCount != 0 ||
+		c.Mark != 0 || c.Congestion != "" {
+		return nil, errors.New("shadowsocks: socket: fast_open, user_timeout, keepalive_interval, keepalive_count, mark and congestion are only supported on linux")
+	}
+	return nil, nil
+}
+
+// applyConn sets the buffers, there's no control function to set them
+// before connecting.
+func (c *SocketConfig) applyConn(tc *net.TCPConn) error {
+	if c.RecvBuffer > 0 {
+		if err := tc.SetReadBuffer(c.RecvBuffer); err != nil {
+			return err
+		}
+	}
+	if c.SendBuffer > 0 {
+		return tc.SetWriteBuffer(c.SendBuffer)
+	}
+	return nil
+}
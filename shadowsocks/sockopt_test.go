@@ -0,0 +1,42 @@
+package shadowsocks
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestSocketConfigCheck(t *testing.T) {
+	for _, c := range []*SocketConfig{
+		{RecvBuffer: -1},
+		{UserTimeout: -1},
+		{KeepAliveCount: -1},
+	} {
+		if err := c.check(); err == nil {
+			t.Errorf("%+v should fail", c)
+		}
+	}
+	if _, err := NewOutboundDialer(&OutboundConfig{Socket: &SocketConfig{SendBuffer: -1}}); err == nil {
+		t.Error("outbound with an invalid socket config should fail")
+	}
+	if err := (&ListenConfig{Socket: &SocketConfig{SendBuffer: -1}}).check(1); err == nil {
+		t.Error("listen with an invalid socket config should fail")
+	}
+}
+
+func TestChainControl(t *testing.T) {
+	if chainControl(nil, nil) != nil {
+		t.Error("no control function should give nil")
+	}
+	var calls []int
+	control := func(n int, err error) func(network, address string, c syscall.RawConn) error {
+		return func(network, address string, c syscall.RawConn) error {
+			calls = append(calls, n)
+			return err
+		}
+	}
+	fn := chainControl(control(1, nil), nil, control(2, errors.New("failed")), control(3, nil))
+	if err := fn("tcp", "", nil); err == nil || len(calls) != 2 {
+		t.Errorf("got %v after calls %v, want the error of the second", err, calls)
+	}
+}
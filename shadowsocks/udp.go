@@ -33,6 +33,9 @@ func (c *SecurePacketConn) Close() error {
 }
 
 func (c *SecurePacketConn) ReadFrom(b []byte) (n int, src net.Addr, err error) {
+	if c.isAEAD() {
+		return c.readFromAEAD(b)
+	}
 	cipher := c.Copy()
 	buf := make([]byte, 4096)
 	n, src, err = c.PacketConn.ReadFrom(buf)
@@ -62,6 +65,9 @@ func (c *SecurePacketConn) ReadFrom(b []byte) (n int, src net.Addr, err error) {
 }
 
 func (c *SecurePacketConn) WriteTo(b []byte, dst net.Addr) (n int, err error) {
+	if c.isAEAD() {
+		return c.writeToAEAD(b, dst)
+	}
 	cipher := c.Copy()
 	iv, err := cipher.initEncrypt()
 	if err != nil {
@@ -2,7 +2,6 @@ package shadowsocks
 
 import (
 	"encoding/binary"
-	"fmt"
 	"net"
 	"strconv"
 	"strings"
@@ -133,6 +132,12 @@ func parseHeaderFromAddr(addr net.Addr) ([]byte, int) {
 }
 
 func Pipeloop(write net.PacketConn, writeAddr net.Addr, readClose net.PacketConn, addTraffic func(int)) {
+	pipeloop(write, writeAddr, readClose, addTraffic)
+}
+
+// pipeloop relays the replies to writeAddr until reading fails, usually on
+// timeout, and returns the read error.
+func pipeloop(write net.PacketConn, writeAddr net.Addr, readClose net.PacketConn, addTraffic func(int)) error {
 	buf := leakyBuf.Get()
 	defer leakyBuf.Put(buf)
 	defer readClose.Close()
@@ -144,11 +149,11 @@ func Pipeloop(write net.PacketConn, writeAddr net.Addr, readClose net.PacketConn
 				if ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE {
 					// log too many open file error
 					// EMFILE is process reaches open file limits, ENFILE is system limit
-					Debug.Println("[udp]read error:", err)
+					udpLog.Error("read error", Err(err))
 				}
 			}
-			Debug.Printf("[udp]closed pipe %s<-%s\n", writeAddr, readClose.LocalAddr())
-			return
+			udpLog.Debug("closed pipe", ClientAddr(writeAddr), F("local", readClose.LocalAddr()))
+			return err
 		}
 		// need improvement here
 		if req, ok := reqList.Get(raddr.String()); ok {
@@ -162,7 +167,86 @@ func Pipeloop(write net.PacketConn, writeAddr net.Addr, readClose net.PacketConn
 	}
 }
 
-func handleUDPConnection(handle *SecurePacketConn, n int, src net.Addr, receive []byte, addTraffic func(int)) {
+// UDPRelay relays the udp requests read from a server side SecurePacketConn
+// to their destinations.
+type UDPRelay struct {
+	// ACL checks the destination of each request, nil allows everything.
+	ACL *ACL
+	// Resolver resolves domain names, nil uses the system resolver.
+	Resolver *Resolver
+	// AddTraffic is called with the bytes relayed in either direction.
+	AddTraffic func(int)
+	// OnDeny is called for requests denied by the ACL, maybe nil.
+	OnDeny func(err error)
+	// AccessLog records each nat entry, nil for none.
+	AccessLog *AccessLog
+	// Port is recorded in the access log.
+	Port string
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*udpSession
+}
+
+// udpSession is the access log record of a nat entry.
+type udpSession struct {
+	AccessRecord
+	remoteErr bool // the nat entry was closed after a write error
+}
+
+func (relay *UDPRelay) startSession(src, dst net.Addr) {
+	if !relay.AccessLog.Enabled() {
+		return
+	}
+	relay.sessionsMu.Lock()
+	defer relay.sessionsMu.Unlock()
+	if relay.sessions == nil {
+		relay.sessions = map[string]*udpSession{}
+	}
+	relay.sessions[src.String()] = &udpSession{AccessRecord: AccessRecord{
+		ID:          NewConnID(),
+		Network:     "udp",
+		Start:       time.Now(),
+		Port:        relay.Port,
+		Client:      src.String(),
+		Destination: dst.String(),
+	}}
+}
+
+// updateSession calls fn with the session of src, if any.
+func (relay *UDPRelay) updateSession(src net.Addr, fn func(s *udpSession)) {
+	relay.sessionsMu.Lock()
+	defer relay.sessionsMu.Unlock()
+	if s, ok := relay.sessions[src.String()]; ok {
+		fn(s)
+	}
+}
+
+func (relay *UDPRelay) endSession(src net.Addr, err error) {
+	relay.sessionsMu.Lock()
+	s, ok := relay.sessions[src.String()]
+	delete(relay.sessions, src.String())
+	relay.sessionsMu.Unlock()
+	if !ok {
+		return
+	}
+	s.End = time.Now()
+	if s.remoteErr {
+		s.CloseReason = "remote error"
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		s.CloseReason = "idle timeout"
+	} else {
+		s.CloseReason = CloseReason("remote", err)
+	}
+	relay.AccessLog.Log(&s.AccessRecord)
+}
+
+func (relay *UDPRelay) addTraffic(n int) {
+	if relay.AddTraffic != nil {
+		relay.AddTraffic(n)
+	}
+}
+
+func (relay *UDPRelay) handleUDPConnection(handle *SecurePacketConn, n int, src net.Addr, receive []byte) {
 	var dstIP net.IP
 	var reqLen int
 	addrType := receive[idType]
@@ -172,39 +256,51 @@ func handleUDPConnection(handle *SecurePacketConn, n int, src net.Addr, receive
 	case typeIPv4:
 		reqLen = lenIPv4
 		if len(receive) < reqLen {
-			Debug.Println("[udp]invalid received message.")
+			udpLog.Debug("invalid received message", ClientAddr(src))
 		}
 		dstIP = net.IP(receive[idIP0 : idIP0+net.IPv4len])
 	case typeIPv6:
 		reqLen = lenIPv6
 		if len(receive) < reqLen {
-			Debug.Println("[udp]invalid received message.")
+			udpLog.Debug("invalid received message", ClientAddr(src))
 		}
 		dstIP = net.IP(receive[idIP0 : idIP0+net.IPv6len])
 	case typeDm:
 		reqLen = int(receive[idDmLen]) + lenDmBase
 		if len(receive) < reqLen {
-			Debug.Println("[udp]invalid received message.")
+			udpLog.Debug("invalid received message", ClientAddr(src))
 		}
+	default:
+		udpLog.Debug("address type not supported", ClientAddr(src), F("type", addrType&AddrMask))
+		return
+	}
+	dstPort := int(binary.BigEndian.Uint16(receive[reqLen-2 : reqLen]))
+	if dstIP == nil {
 		name := string(receive[idDm0 : idDm0+int(receive[idDmLen])])
 		// avoid panic: syscall: string with NUL passed to StringToUTF16 on windows.
 		if strings.ContainsRune(name, 0x00) {
-			fmt.Println("[udp]invalid domain name.")
+			udpLog.Warn("invalid domain name", ClientAddr(src))
 			return
 		}
-		dIP, err := net.ResolveIPAddr("ip", name) // carefully with const type
+		// the ACL checks both the name and the addresses it resolves to
+		ips, _, err := relay.ACL.Resolve(relay.Resolver, net.JoinHostPort(name, strconv.Itoa(dstPort)))
 		if err != nil {
-			Debug.Printf("[udp]failed to resolve domain name: %s\n", string(receive[idDm0:idDm0+receive[idDmLen]]))
+			if IsACLDenied(err) {
+				relay.deny(err)
+			} else {
+				udpLog.Debug("failed to resolve domain name", F("host", name), Err(err))
+			}
 			return
 		}
-		dstIP = dIP.IP
-	default:
-		Debug.Printf("[udp]addrType %d not supported", addrType)
+		// in the order preferred by the resolver
+		dstIP = ips[0]
+	} else if err := relay.ACL.CheckIP(dstIP, dstPort); err != nil {
+		relay.deny(err)
 		return
 	}
 	dst := &net.UDPAddr{
 		IP:   dstIP,
-		Port: int(binary.BigEndian.Uint16(receive[reqLen-2 : reqLen])),
+		Port: dstPort,
 	}
 	if _, ok := reqList.Get(dst.String()); !ok {
 		req := make([]byte, reqLen)
@@ -214,30 +310,35 @@ func handleUDPConnection(handle *SecurePacketConn, n int, src net.Addr, receive
 
 	remote, exist, err := natlist.Get(src.String())
 	if err != nil {
+		udpLog.Error("error listening for client", ClientAddr(src), Err(err))
 		return
 	}
 	if !exist {
-		Debug.Printf("[udp]new client %s->%s via %s\n", src, dst, remote.LocalAddr())
+		udpLog.Debug("new client", ClientAddr(src), F("dst", dst), F("via", remote.LocalAddr()))
+		relay.startSession(src, dst)
 		go func() {
-			Pipeloop(handle, src, remote, addTraffic)
+			err := pipeloop(handle, src, remote, func(n int) {
+				relay.addTraffic(n)
+				relay.updateSession(src, func(s *udpSession) { s.BytesDown += int64(n) })
+			})
 			natlist.Delete(src.String())
+			relay.endSession(src, err)
 		}()
 	} else {
-		Debug.Printf("[udp]using cached client %s->%s via %s\n", src, dst, remote.LocalAddr())
-	}
-	if remote == nil {
-		fmt.Println("WTF")
+		udpLog.Debug("using cached client", ClientAddr(src), F("dst", dst), F("via", remote.LocalAddr()))
 	}
 	remote.SetDeadline(time.Now().Add(udpTimeout))
 	n, err = remote.WriteTo(receive[reqLen:n], dst)
-	addTraffic(n)
+	relay.addTraffic(n)
+	relay.updateSession(src, func(s *udpSession) { s.BytesUp += int64(n) })
 	if err != nil {
+		relay.updateSession(src, func(s *udpSession) { s.remoteErr = true })
 		if ne, ok := err.(*net.OpError); ok && (ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE) {
 			// log too many open file error
 			// EMFILE is process reaches open file limits, ENFILE is system limit
-			Debug.Println("[udp]write error:", err)
+			udpLog.Error("write error", Err(err))
 		} else {
-			Debug.Println("[udp]error connecting to:", dst, err)
+			udpLog.Debug("error connecting", F("dst", dst), Err(err))
 		}
 		if conn := natlist.Delete(src.String()); conn != nil {
 			conn.Close()
@@ -247,12 +348,26 @@ func handleUDPConnection(handle *SecurePacketConn, n int, src net.Addr, receive
 	return
 }
 
-func ReadAndHandleUDPReq(c *SecurePacketConn, addTraffic func(int)) error {
+func (relay *UDPRelay) deny(err error) {
+	udpLog.Info("request denied", Err(err))
+	if relay.OnDeny != nil {
+		relay.OnDeny(err)
+	}
+}
+
+// ReadAndHandle reads a request from c and relays it in background.
+func (relay *UDPRelay) ReadAndHandle(c *SecurePacketConn) error {
 	buf := leakyBuf.Get()
 	n, src, err := c.ReadFrom(buf[0:])
 	if err != nil {
+		leakyBuf.Put(buf)
 		return err
 	}
-	go handleUDPConnection(c, n, src, buf, addTraffic)
+	go relay.handleUDPConnection(c, n, src, buf)
 	return nil
 }
+
+func ReadAndHandleUDPReq(c *SecurePacketConn, addTraffic func(int)) error {
+	relay := &UDPRelay{AddTraffic: addTraffic}
+	return relay.ReadAndHandle(c)
+}
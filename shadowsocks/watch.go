@@ -0,0 +1,211 @@
+package shadowsocks
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	defaultWatchDebounce = 500 * time.Millisecond
+	defaultPollInterval  = 2 * time.Second
+)
+
+// ConfigWatcher reloads the config when the config file or a file it
+// includes changes. The changes are debounced, as editors often write a
+// file in several steps, and the config is applied only if it loads.
+type ConfigWatcher struct {
+	Loader *ConfigLoader
+	// Apply applies the config loaded, e.g. Server.Reload. The old config
+	// is assumed to be kept on error.
+	Apply func(*Config) error
+	// Debounce is how long the files must be left alone before reloading,
+	// 500ms if zero.
+	Debounce time.Duration
+	// PollInterval is how often the files are checked when polling, 2s if
+	// zero.
+	PollInterval time.Duration
+	// Poll checks the files by polling instead of with inotify or the like,
+	// for file systems that don't report changes. Watch falls back to it
+	// if the changes can't be watched.
+	Poll bool
+
+	mu    sync.Mutex
+	stats ReloadStats
+}
+
+// ReloadStats counts the reloads of a ConfigWatcher.
+type ReloadStats struct {
+	Reloads  int64 // configs applied
+	Failures int64 // configs failing to load or to apply
+}
+
+// Stats returns the reload counters.
+func (w *ConfigWatcher) Stats() ReloadStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stats
+}
+
+// Reload loads the config and applies it, logging and counting the
+// outcome. It's what Watch calls on changes, and what SIGHUP should call.
+func (w *ConfigWatcher) Reload() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	config, err := w.Loader.Load()
+	if err == nil {
+		err = w.Apply(config)
+	}
+	if err != nil {
+		w.stats.Failures++
+		mainLog.Error("error reloading config, keep using the old one", F("file", w.Loader.File),
+			F("failures", w.stats.Failures), Err(err))
+		return err
+	}
+	w.stats.Reloads++
+	mainLog.Info("config reloaded", F("file", w.Loader.File), F("reloads", w.stats.Reloads))
+	return nil
+}
+
+// files returns the files to watch, those read by the last load. The lock
+// keeps Reload from changing them meanwhile.
+func (w *ConfigWatcher) files() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	files := w.Loader.Files()
+	if len(files) == 0 && w.Loader.File != "" {
+		files = []string{w.Loader.File}
+	}
+	return files
+}
+
+func (w *ConfigWatcher) debounce() time.Duration {
+	if w.Debounce > 0 {
+		return w.Debounce
+	}
+	return defaultWatchDebounce
+}
+
+// Watch reloads the config on changes until ctx is done.
+func (w *ConfigWatcher) Watch(ctx context.Context) {
+	if !w.Poll {
+		err := w.watchNotify(ctx)
+		if err == nil {
+			return
+		}
+		mainLog.Warn("can't watch the config files, polling them instead", Err(err))
+	}
+	w.watchPoll(ctx)
+}
+
+// watchNotify watches the directories of the files rather than the files,
+// so the files replaced by a rename are still watched.
+func (w *ConfigWatcher) watchNotify(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	dirs := make(map[string]bool)
+	var names map[string]bool
+	watch := func() error {
+		names = make(map[string]bool)
+		for _, file := range w.files() {
+			file = filepath.Clean(file)
+			names[file] = true
+			dir := filepath.Dir(file)
+			if dirs[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				return err
+			}
+			dirs[dir] = true
+		}
+		return nil
+	}
+	if err = watch(); err != nil {
+		return err
+	}
+
+	var fire <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if ev.Op == fsnotify.Chmod || !names[filepath.Clean(ev.Name)] {
+				continue
+			}
+			fire = time.After(w.debounce())
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			mainLog.Warn("error watching config files", Err(err))
+		case <-fire:
+			fire = nil
+			w.Reload()
+			// the includes may have changed
+			if err := watch(); err != nil {
+				mainLog.Warn("error watching config files", Err(err))
+			}
+		}
+	}
+}
+
+// fileStamp is what polling compares to find the files changed.
+type fileStamp struct {
+	exists  bool
+	modTime time.Time
+	size    int64
+}
+
+func statFiles(files []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp, len(files))
+	for _, file := range files {
+		if fi, err := os.Stat(file); err == nil {
+			stamps[file] = fileStamp{true, fi.ModTime(), fi.Size()}
+		} else {
+			stamps[file] = fileStamp{}
+		}
+	}
+	return stamps
+}
+
+func (w *ConfigWatcher) watchPoll(ctx context.Context) {
+	interval := w.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := statFiles(w.files())
+	var fire <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stamps := statFiles(w.files())
+			for file, stamp := range stamps {
+				if last[file] != stamp {
+					fire = time.After(w.debounce())
+					break
+				}
+			}
+			last = stamps
+		case <-fire:
+			fire = nil
+			w.Reload()
+			last = statFiles(w.files())
+		}
+	}
+}
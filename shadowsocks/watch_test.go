@@ -0,0 +1,91 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigWatcher(t *testing.T) {
+	for _, poll := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "sswatch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "config.json")
+		users := filepath.Join(dir, "users.json")
+		write := func(path, content string) {
+			if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		write(file, `{"include": "users.json", "method": "aes-128-cfb"}`)
+		write(users, `{"port_password": {"8388": "foobar"}}`)
+
+		applied := make(chan *Config, 10)
+		w := &ConfigWatcher{
+			Loader:       &ConfigLoader{File: file, Env: []string{}},
+			Debounce:     50 * time.Millisecond,
+			PollInterval: 20 * time.Millisecond,
+			Poll:         poll,
+			Apply: func(config *Config) error {
+				if config.Timeout == 1 {
+					return errors.New("timeout too short")
+				}
+				applied <- config
+				return nil
+			},
+		}
+		if err = w.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		<-applied
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go w.Watch(ctx)
+		// let the watch start before changing the files
+		time.Sleep(100 * time.Millisecond)
+
+		wait := func() *Config {
+			select {
+			case config := <-applied:
+				return config
+			case <-time.After(2 * time.Second):
+				return nil
+			}
+		}
+		// several writes are applied once
+		write(users, `{"port_password": {"8388": "barfoo"}}`)
+		write(users, `{"port_password": {"8388": "foobar", "8389": "barfoo"}}`)
+		if config := wait(); config == nil || len(config.PortPassword) != 2 {
+			t.Fatalf("poll %v: change of the included file not applied, got %+v", poll, config)
+		}
+		select {
+		case config := <-applied:
+			t.Errorf("poll %v: changes should be debounced, applied again %+v", poll, config)
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		write(file, `{"include": "users.json", "method": "aes-128-cfb", "timeout": "60"}`)
+		write(file, `{"include": "users.json", "method": "aes-128-cfb", "timeout": 1}`)
+		time.Sleep(300 * time.Millisecond)
+		if stats := w.Stats(); stats.Reloads != 2 || stats.Failures != 1 {
+			t.Errorf("poll %v: got %+v, want 2 reloads and 1 failure", poll, stats)
+		}
+
+		// a new file replacing the old one, as editors do
+		write(file+".new", `{"include": "users.json", "method": "aes-256-cfb"}`)
+		if err = os.Rename(file+".new", file); err != nil {
+			t.Fatal(err)
+		}
+		if config := wait(); config == nil || config.Method != "aes-256-cfb" {
+			t.Errorf("poll %v: replaced file not applied, got %+v", poll, config)
+		}
+		cancel()
+	}
+}